@@ -1,46 +1,75 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "os/exec"
     "strings"
     "time"
 )
 
-// Check if ADB device is connected
-func (t *FlashTool) isADBDeviceConnected() (bool, string, string) {
-    cmd := exec.Command("adb", "devices")
-    output, err := cmd.CombinedOutput()
+// Run the adb executable through the configured command runner
+func (t *FlashTool) adb(ctx context.Context, timeout time.Duration, args ...string) (*CommandResult, error) {
+    return t.runner.Run(ctx, Command{Name: "adb", Args: args, Timeout: timeout})
+}
+
+// List devices known to the adb server, plus those connected directly
+func (t *FlashTool) adbDevices(ctx context.Context) ([]adbDeviceInfo, error) {
+    direct := t.direct.devices()
+    host, err := t.adbHost(ctx)
+    if err != nil {
+        if len(direct) > 0 {
+            return direct, nil
+        }
+        return nil, err
+    }
+    ctx, cancel := context.WithTimeout(ctx, quickTimeout)
+    defer cancel()
+    devices, err := host.Devices(ctx)
+    if err != nil && len(direct) == 0 {
+        return nil, err
+    }
+    return append(devices, direct...), nil
+}
+
+// Check if the target ADB device is connected. With several devices and
+// none selected there is no target.
+func (t *FlashTool) isADBDeviceConnected(ctx context.Context) (bool, string, string) {
+    devices, err := t.adbDevices(ctx)
     if err != nil {
         return false, "", "ADB not responding"
     }
 
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        line = strings.TrimSpace(line)
-        if line != "" && !strings.Contains(line, "List of devices") {
-            parts := strings.Fields(line)
-            if len(parts) >= 2 {
-                switch parts[1] {
-                case "device":
-                    return true, parts[0], "Connected"
-                case "unauthorized":
-                    return false, parts[0], "Unauthorized (Check USB debugging)"
-                case "offline":
-                    return false, parts[0], "Device offline (reconnect USB)"
-                }
-            }
+    selected := targetFrom(ctx)
+    var candidates []adbDeviceInfo
+    for _, device := range devices {
+        if selected == "" || device.Serial == selected {
+            candidates = append(candidates, device)
         }
     }
+    switch {
+    case len(candidates) == 0 && selected != "":
+        return false, selected, fmt.Sprintf("%s not connected in ADB mode", selected)
+    case len(candidates) == 0:
+        return false, "", "No device connected"
+    case len(candidates) > 1:
+        return false, "", "Multiple devices connected - choose the target device"
+    }
 
-    return false, "", "No device connected"
+    device := candidates[0]
+    switch device.State {
+    case "device":
+        return true, device.Serial, "Connected"
+    case "unauthorized":
+        return false, device.Serial, "Unauthorized (Check USB debugging)"
+    case "offline":
+        return false, device.Serial, "Device offline (reconnect USB)"
+    }
+    return false, device.Serial, fmt.Sprintf("Device in %s mode", device.State)
 }
 
 // ✅ Enable DIAG mode without root (if possible)
-func (t *FlashTool) adbEnableDiag() {
-    t.logOutput.SetText("")
-
-    connected, deviceID, status := t.isADBDeviceConnected()
+func (t *FlashTool) adbEnableDiag(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ No device connected")
         t.appendLog(fmt.Sprintf("Reason: %s", status))
@@ -51,15 +80,18 @@ func (t *FlashTool) adbEnableDiag() {
     t.appendLog(fmt.Sprintf("Device ID: %s", deviceID))
 
     // Run commands to attempt diag activation
-    cmds := [][]string{
-        {"shell", "am", "start", "-n", "com.longcheertel.midtest/com.longcheertel.midtest.Diag"},
-        {"shell", "setprop", "sys.usb.config", "diag,adb"},
-        {"shell", "setprop", "vendor.usb.config", "diag,adb"},
+    cmds := []string{
+        "am start -n com.longcheertel.midtest/com.longcheertel.midtest.Diag",
+        "setprop sys.usb.config diag,adb",
+        "setprop vendor.usb.config diag,adb",
     }
 
-    for i, args := range cmds {
-        cmd := exec.Command("adb", args...)
-        err := cmd.Run()
+    for i, command := range cmds {
+        if ctx.Err() != nil {
+            return
+        }
+        nextStep(ctx, command)
+        _, err := t.adbShell(ctx, deviceID, command)
         if err != nil {
             t.appendLog(fmt.Sprintf("⚠️ Command %d failed: %v", i+1, err))
         } else {
@@ -70,10 +102,9 @@ func (t *FlashTool) adbEnableDiag() {
     time.Sleep(1 * time.Second)
 
     // Try to get USB config
-    cmd := exec.Command("adb", "shell", "getprop", "sys.usb.config")
-    out, err := cmd.CombinedOutput()
+    result, err := t.adbShell(ctx, deviceID, "getprop sys.usb.config")
     if err == nil {
-        value := strings.TrimSpace(string(out))
+        value := strings.TrimSpace(result.Stdout)
         t.appendLog(fmt.Sprintf("🔍 Current USB Config: %s", value))
         if strings.Contains(value, "diag") {
             t.appendLog("✅ DIAG mode looks active!")
@@ -87,9 +118,8 @@ func (t *FlashTool) adbEnableDiag() {
 }
 
 // ✅ Display basic device connection
-func (t *FlashTool) checkADBDevice() {
-    t.logOutput.SetText("")
-    connected, deviceID, status := t.isADBDeviceConnected()
+func (t *FlashTool) checkADBDevice(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ No ADB device detected")
         t.appendLog(fmt.Sprintf("Status: %s", status))
@@ -103,9 +133,8 @@ func (t *FlashTool) checkADBDevice() {
 }
 
 // ✅ Show detailed ADB info
-func (t *FlashTool) getADBInfo() {
-    t.logOutput.SetText("")
-    connected, _, status := t.isADBDeviceConnected()
+func (t *FlashTool) getADBInfo(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ Cannot read device info - not connected")
         t.appendLog(fmt.Sprintf("Status: %s", status))
@@ -162,13 +191,28 @@ func (t *FlashTool) getADBInfo() {
         "Battery Level":   "%-20s: %s",
     }
 
+    // One getprop call returns every property at once
+    nextStep(ctx, "getprop")
+    result, err := t.adbShell(ctx, deviceID, "getprop")
+    if err != nil {
+        if ctx.Err() == nil {
+            t.appendLog(fmt.Sprintf("❌ Reading properties failed: %v", err))
+        }
+        return
+    }
+    values := parseGetprop(result.Stdout)
+    t.devices.setProps(deviceID, values)
+
     for _, prop := range props {
+        if ctx.Err() != nil {
+            return
+        }
         var value string
         if prop.Label == "Battery Level" {
-            cmd := exec.Command("adb", "shell", "dumpsys", "battery")
-            out, err := cmd.CombinedOutput()
+            nextStep(ctx, "dumpsys battery")
+            result, err := t.adbShell(ctx, deviceID, "dumpsys battery")
             if err == nil {
-                lines := strings.Split(string(out), "\n")
+                lines := strings.Split(result.Stdout, "\n")
                 for _, line := range lines {
                     if strings.Contains(line, "level:") {
                         parts := strings.Split(line, ":")
@@ -180,10 +224,7 @@ func (t *FlashTool) getADBInfo() {
                 }
             }
         } else {
-            out, err := exec.Command("adb", "shell", "getprop", prop.Prop).CombinedOutput()
-            if err == nil {
-                value = strings.TrimSpace(string(out))
-            }
+            value = strings.TrimSpace(values[prop.Prop])
         }
 
         if value != "" && value != "Unknown" {
@@ -199,9 +240,8 @@ func (t *FlashTool) getADBInfo() {
     t.appendLog(fmt.Sprintf("\n✅ Info retrieved in %.2fs", elapsed.Seconds()))
 }
 // ✅ Reboot normally
-func (t *FlashTool) adbReboot() {
-    t.logOutput.SetText("")
-    connected, _, status := t.isADBDeviceConnected()
+func (t *FlashTool) adbReboot(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ Cannot reboot - device not connected")
         t.appendLog(fmt.Sprintf("Status: %s", status))
@@ -209,19 +249,19 @@ func (t *FlashTool) adbReboot() {
     }
 
     t.appendLog("🔁 Rebooting device...")
-    err := exec.Command("adb", "reboot").Run()
+    err := t.adbRebootTo(ctx, deviceID, "")
     if err != nil {
         t.appendLog(fmt.Sprintf("❌ Reboot failed: %v", err))
         return
     }
 
     t.appendLog("✅ Reboot command sent")
+    t.waitAfterReboot(ctx, deviceID, modeADB, modeBooted)
 }
 
 // ✅ Reboot to bootloader / fastboot
-func (t *FlashTool) adbRebootFastboot() {
-    t.logOutput.SetText("")
-    connected, _, status := t.isADBDeviceConnected()
+func (t *FlashTool) adbRebootFastboot(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ Cannot reboot to fastboot - no device detected")
         t.appendLog(fmt.Sprintf("Status: %s", status))
@@ -229,19 +269,19 @@ func (t *FlashTool) adbRebootFastboot() {
     }
 
     t.appendLog("🚀 Rebooting to fastboot...")
-    err := exec.Command("adb", "reboot", "bootloader").Run()
+    err := t.adbRebootTo(ctx, deviceID, "bootloader")
     if err != nil {
         t.appendLog(fmt.Sprintf("❌ Fastboot reboot failed: %v", err))
         return
     }
 
     t.appendLog("✅ Fastboot command sent")
+    t.waitAfterReboot(ctx, deviceID, modeADB, modeFastboot)
 }
 
 // ✅ Reboot to recovery
-func (t *FlashTool) adbRebootRecovery() {
-    t.logOutput.SetText("")
-    connected, _, status := t.isADBDeviceConnected()
+func (t *FlashTool) adbRebootRecovery(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
     if !connected {
         t.appendLog("❌ Cannot reboot to recovery - no device detected")
         t.appendLog(fmt.Sprintf("Status: %s", status))
@@ -249,11 +289,32 @@ func (t *FlashTool) adbRebootRecovery() {
     }
 
     t.appendLog("🛠 Rebooting to recovery...")
-    err := exec.Command("adb", "reboot", "recovery").Run()
+    err := t.adbRebootTo(ctx, deviceID, "recovery")
     if err != nil {
         t.appendLog(fmt.Sprintf("❌ Recovery reboot failed: %v", err))
         return
     }
 
     t.appendLog("✅ Recovery command sent")
+    t.waitAfterReboot(ctx, deviceID, modeADB, modeRecovery)
+}
+
+// ✅ Reboot to sideload (adb sideload from recovery)
+func (t *FlashTool) adbRebootSideload(ctx context.Context) {
+    connected, deviceID, status := t.isADBDeviceConnected(ctx)
+    if !connected {
+        t.appendLog("❌ Cannot reboot to sideload - no device detected")
+        t.appendLog(fmt.Sprintf("Status: %s", status))
+        return
+    }
+
+    t.appendLog("📦 Rebooting to sideload...")
+    err := t.adbRebootTo(ctx, deviceID, "sideload")
+    if err != nil {
+        t.appendLog(fmt.Sprintf("❌ Sideload reboot failed: %v", err))
+        return
+    }
+
+    t.appendLog("✅ Sideload command sent")
+    t.waitAfterReboot(ctx, deviceID, modeADB, modeSideload)
 }
\ No newline at end of file
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultADBServerPort = 5037
+
+// ADBError is a FAIL answer from the adb server or the device
+type ADBError struct {
+	Request string
+	Message string
+}
+
+func (e *ADBError) Error() string {
+	return fmt.Sprintf("adb %s: %s", e.Request, e.Message)
+}
+
+// adbConnector opens service streams on a device. The adb server client
+// implements it; anything else that can reach adbd can too.
+type adbConnector interface {
+	openService(ctx context.Context, serial, service string) (io.ReadWriteCloser, error)
+	deviceFeatures(ctx context.Context, serial string) (map[string]bool, error)
+}
+
+// adbClient talks to the local adb server over its smart-socket protocol
+// instead of spawning an adb process for every request
+type adbClient struct {
+	addr string
+
+	mu       sync.Mutex
+	features map[string]map[string]bool // per serial
+}
+
+func newADBClient() *adbClient {
+	port := defaultADBServerPort
+	if p, err := strconv.Atoi(os.Getenv("ANDROID_ADB_SERVER_PORT")); err == nil && p > 0 {
+		port = p
+	}
+	return &adbClient{addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+// ctxConn closes the connection when the context is cancelled, so blocked
+// reads return right away
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+func (c *adbClient) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &ctxConn{Conn: conn, stop: stop}, nil
+}
+
+// writeRequest sends a request as 4 hex digits of length and the payload
+func writeRequest(w io.Writer, request string) error {
+	_, err := fmt.Fprintf(w, "%04x%s", len(request), request)
+	return err
+}
+
+// readStatus reads OKAY, or FAIL with its message
+func readStatus(r io.Reader, request string) error {
+	status := make([]byte, 4)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return fmt.Errorf("adb %s: %w", request, err)
+	}
+	switch string(status) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		msg, err := readHexString(r)
+		if err != nil {
+			return fmt.Errorf("adb %s: %w", request, err)
+		}
+		return &ADBError{Request: request, Message: msg}
+	}
+	return fmt.Errorf("adb %s: unexpected status %q", request, status)
+}
+
+// readHexString reads a payload prefixed by its length in 4 hex digits
+func readHexString(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("bad length %q", header)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// roundTrip sends one host request and checks the status
+func (c *adbClient) roundTrip(ctx context.Context, conn net.Conn, request string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writeRequest(conn, request); err != nil {
+		return err
+	}
+	return readStatus(conn, request)
+}
+
+// query sends a host request that answers with one length-prefixed string
+func (c *adbClient) query(ctx context.Context, request string) (string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := c.roundTrip(ctx, conn, request); err != nil {
+		return "", err
+	}
+	return readHexString(conn)
+}
+
+// Version returns the protocol version of the running adb server
+func (c *adbClient) Version(ctx context.Context) (int, error) {
+	reply, err := c.query(ctx, "host:version")
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.ParseInt(reply, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("adb host:version: bad reply %q", reply)
+	}
+	return int(version), nil
+}
+
+// adbDeviceInfo is one device as listed by host:devices-l
+type adbDeviceInfo struct {
+	Serial      string
+	State       string
+	USB         string
+	Product     string
+	Model       string
+	Device      string
+	TransportID string
+}
+
+// Devices lists the devices known to the adb server
+func (c *adbClient) Devices(ctx context.Context) ([]adbDeviceInfo, error) {
+	reply, err := c.query(ctx, "host:devices-l")
+	if err != nil {
+		return nil, err
+	}
+	return parseDevicesLong(reply), nil
+}
+
+// parseDevicesLong parses "serial state key:value..." lines
+func parseDevicesLong(reply string) []adbDeviceInfo {
+	var devices []adbDeviceInfo
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		info := adbDeviceInfo{Serial: fields[0], State: fields[1]}
+		for _, field := range fields[2:] {
+			key, value, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "usb":
+				info.USB = value
+			case "product":
+				info.Product = value
+			case "model":
+				info.Model = value
+			case "device":
+				info.Device = value
+			case "transport_id":
+				info.TransportID = value
+			}
+		}
+		devices = append(devices, info)
+	}
+	return devices
+}
+
+// openService switches a connection to the device and starts service on
+// it. An empty serial picks the only connected device.
+func (c *adbClient) openService(ctx context.Context, serial, service string) (io.ReadWriteCloser, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transport := "host:transport-any"
+	if serial != "" {
+		transport = "host:transport:" + serial
+	}
+	if err := c.roundTrip(ctx, conn, transport); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.roundTrip(ctx, conn, service); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// deviceFeatures returns the adbd feature list of a device, cached
+func (c *adbClient) deviceFeatures(ctx context.Context, serial string) (map[string]bool, error) {
+	c.mu.Lock()
+	features, ok := c.features[serial]
+	c.mu.Unlock()
+	if ok {
+		return features, nil
+	}
+
+	request := "host:features"
+	if serial != "" {
+		request = "host-serial:" + serial + ":features"
+	}
+	reply, err := c.query(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	features = make(map[string]bool)
+	for _, feature := range strings.Split(reply, ",") {
+		features[strings.TrimSpace(feature)] = true
+	}
+
+	if serial == "" {
+		// "any device" may be a different phone next time
+		return features, nil
+	}
+	c.mu.Lock()
+	if c.features == nil {
+		c.features = make(map[string]map[string]bool)
+	}
+	c.features[serial] = features
+	c.mu.Unlock()
+	return features, nil
+}
+
+// Shell protocol v2 packet ids
+const (
+	shellStdin  = 0
+	shellStdout = 1
+	shellStderr = 2
+	shellExit   = 3
+)
+
+// adbShell runs a command on the device. With shell_v2 stdout, stderr and
+// the exit code come back separately, older devices only give merged
+// output without an exit code.
+func adbShell(ctx context.Context, c adbConnector, serial, command string) (*CommandResult, error) {
+	start := time.Now()
+	result := &CommandResult{ExitCode: -1}
+
+	features, err := c.deviceFeatures(ctx, serial)
+	if err != nil {
+		return result, err
+	}
+	service := "shell:" + command
+	if features["shell_v2"] {
+		service = "shell,v2,raw:" + command
+	}
+
+	stream, err := c.openService(ctx, serial, service)
+	if err != nil {
+		return result, err
+	}
+	defer stream.Close()
+
+	if !features["shell_v2"] {
+		out, err := io.ReadAll(stream)
+		result.Stdout = strings.ReplaceAll(string(out), "\r\n", "\n")
+		result.Duration = time.Since(start)
+		if err != nil {
+			return result, err
+		}
+		result.ExitCode = 0
+		return result, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(stream, header); err != nil {
+			result.Stdout, result.Stderr = stdout.String(), stderr.String()
+			result.Duration = time.Since(start)
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			return result, fmt.Errorf("adb shell: connection closed before exit status: %w", err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(stream, payload); err != nil {
+			return result, fmt.Errorf("adb shell: %w", err)
+		}
+		switch header[0] {
+		case shellStdout:
+			stdout.Write(payload)
+		case shellStderr:
+			stderr.Write(payload)
+		case shellExit:
+			result.Stdout, result.Stderr = stdout.String(), stderr.String()
+			result.Duration = time.Since(start)
+			if len(payload) > 0 {
+				result.ExitCode = int(payload[0])
+			}
+			if result.ExitCode != 0 {
+				cmd := Command{Name: "adb", Args: []string{"shell", command}}
+				return result, &CommandError{Command: cmd, ExitCode: result.ExitCode, Stderr: result.Stderr}
+			}
+			return result, nil
+		}
+	}
+}
+
+// adbExec runs a command over exec:, which returns the raw stdout bytes
+func adbExec(ctx context.Context, c adbConnector, serial, command string) ([]byte, error) {
+	stream, err := c.openService(ctx, serial, "exec:"+command)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	out, err := io.ReadAll(stream)
+	if err != nil && ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	return out, err
+}
+
+// adbService starts a service that does its work and closes, such as
+// reboot:bootloader, and returns whatever it printed
+func adbService(ctx context.Context, c adbConnector, serial, service string) (string, error) {
+	stream, err := c.openService(ctx, serial, service)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	out, err := io.ReadAll(stream)
+	if err != nil && ctx.Err() != nil {
+		return string(out), ctx.Err()
+	}
+	// A rebooting device may drop the connection without a clean close
+	return string(out), nil
+}
+
+var getpropLine = regexp.MustCompile(`^\[(.+?)\]: \[(.*)\]$`)
+
+// parseGetprop turns the output of a bare "getprop" into a map
+func parseGetprop(output string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if m := getpropLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			props[m[1]] = m[2]
+		}
+	}
+	return props
+}
+
+// adbHost returns the adb server client, starting the server when it is
+// not running yet
+func (t *FlashTool) adbHost(ctx context.Context) (*adbClient, error) {
+	if _, err := t.adbServer.Version(ctx); err == nil {
+		return t.adbServer, nil
+	} else if isADBError(err) {
+		return nil, err
+	}
+	if _, err := t.adb(ctx, quickTimeout, "start-server"); err != nil {
+		return nil, fmt.Errorf("starting adb server: %w", err)
+	}
+	if _, err := t.adbServer.Version(ctx); err != nil {
+		return nil, err
+	}
+	return t.adbServer, nil
+}
+
+// Run a shell command on a device
+func (t *FlashTool) adbShell(ctx context.Context, serial, command string) (*CommandResult, error) {
+	transport, err := t.adbTransport(ctx, serial)
+	if err != nil {
+		return &CommandResult{ExitCode: -1}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, quickTimeout)
+	defer cancel()
+	return adbShell(ctx, transport, serial, command)
+}
+
+// Ask adbd to reboot, an empty target reboots normally
+func (t *FlashTool) adbRebootTo(ctx context.Context, serial, target string) error {
+	transport, err := t.adbTransport(ctx, serial)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, rebootTimeout)
+	defer cancel()
+	_, err = adbService(ctx, transport, serial, "reboot:"+target)
+	return err
+}
+
+// isADBError reports whether err is a FAIL answer from adb
+func isADBError(err error) bool {
+	var adbErr *ADBError
+	return errors.As(err, &adbErr)
+}
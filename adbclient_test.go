@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeADBServer answers the adb host protocol on a loopback port. Host
+// requests get their reply from replies, services opened on a device are
+// handed to services.
+type fakeADBServer struct {
+	addr     string
+	replies  map[string]string                          // host request -> payload, "FAIL:" prefix fails
+	services map[string]func(conn net.Conn, arg string) // service prefix -> handler
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeADBServer(t *testing.T) *fakeADBServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeADBServer{
+		addr:     ln.Addr().String(),
+		replies:  map[string]string{},
+		services: map[string]func(net.Conn, string){},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeADBServer) client() *adbClient {
+	return &adbClient{addr: s.addr}
+}
+
+func (s *fakeADBServer) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *fakeADBServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := readHexString(conn)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, request)
+		s.mu.Unlock()
+
+		if strings.HasPrefix(request, "host:transport") {
+			io.WriteString(conn, "OKAY")
+			continue
+		}
+		if reply, ok := s.replies[request]; ok {
+			if message, failed := strings.CutPrefix(reply, "FAIL:"); failed {
+				fmt.Fprintf(conn, "FAIL%04x%s", len(message), message)
+				return
+			}
+			fmt.Fprintf(conn, "OKAY%04x%s", len(reply), reply)
+			return
+		}
+		for prefix, handler := range s.services {
+			if arg, ok := strings.CutPrefix(request, prefix); ok {
+				io.WriteString(conn, "OKAY")
+				handler(conn, arg)
+				return
+			}
+		}
+		message := "unknown request " + request
+		fmt.Fprintf(conn, "FAIL%04x%s", len(message), message)
+		return
+	}
+}
+
+// writeShellPacket writes one shell protocol v2 packet
+func writeShellPacket(w io.Writer, id byte, data string) {
+	header := make([]byte, 5)
+	header[0] = id
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	w.Write(header)
+	io.WriteString(w, data)
+}
+
+func TestADBClientVersion(t *testing.T) {
+	server := newFakeADBServer(t)
+	server.replies["host:version"] = "0029"
+	version, err := server.client().Version(context.Background())
+	if err != nil || version != 41 {
+		t.Errorf("version = %d, %v", version, err)
+	}
+
+	server.replies["host:version"] = "xyz"
+	if _, err := server.client().Version(context.Background()); err == nil {
+		t.Error("bad version reply accepted")
+	}
+}
+
+func TestADBClientDevices(t *testing.T) {
+	server := newFakeADBServer(t)
+	server.replies["host:devices-l"] = "" +
+		"SER123               device usb:1-1 product:lavender model:Redmi_Note_7 device:lavender transport_id:3\n" +
+		"192.168.1.50:5555    offline transport_id:4\n" +
+		"\n"
+	devices, err := server.client().Devices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []adbDeviceInfo{
+		{Serial: "SER123", State: "device", USB: "1-1", Product: "lavender", Model: "Redmi_Note_7", Device: "lavender", TransportID: "3"},
+		{Serial: "192.168.1.50:5555", State: "offline", TransportID: "4"},
+	}
+	if len(devices) != len(want) {
+		t.Fatalf("devices = %+v", devices)
+	}
+	for i := range want {
+		if devices[i] != want[i] {
+			t.Errorf("device %d = %+v, want %+v", i, devices[i], want[i])
+		}
+	}
+}
+
+func TestADBClientFail(t *testing.T) {
+	server := newFakeADBServer(t)
+	server.replies["host:devices-l"] = "FAIL:protocol fault"
+	_, err := server.client().Devices(context.Background())
+	var adbErr *ADBError
+	if !errors.As(err, &adbErr) || adbErr.Message != "protocol fault" || !isADBError(err) {
+		t.Errorf("err = %v", err)
+	}
+	_, err = adbService(context.Background(), server.client(), "SER123", "reboot:bootloader")
+	if !isADBError(err) {
+		t.Errorf("unknown service: %v", err)
+	}
+}
+
+func TestADBShellV2(t *testing.T) {
+	server := newFakeADBServer(t)
+	server.replies["host-serial:SER123:features"] = "shell_v2,cmd,stat_v2"
+	server.services["shell,v2,raw:"] = func(conn net.Conn, command string) {
+		switch command {
+		case "getprop ro.product.model":
+			writeShellPacket(conn, shellStdout, "Redmi ")
+			writeShellPacket(conn, shellStdout, "Note 7\n")
+			writeShellPacket(conn, shellExit, "\x00")
+		case "ls /nope":
+			writeShellPacket(conn, shellStderr, "ls: /nope: No such file or directory\n")
+			writeShellPacket(conn, shellExit, "\x01")
+		case "hang up":
+			writeShellPacket(conn, shellStdout, "partial")
+		}
+	}
+	client := server.client()
+	ctx := context.Background()
+
+	result, err := adbShell(ctx, client, "SER123", "getprop ro.product.model")
+	if err != nil || result.ExitCode != 0 || result.Stdout != "Redmi Note 7\n" {
+		t.Errorf("result = %+v, err = %v", result, err)
+	}
+
+	result, err = adbShell(ctx, client, "SER123", "ls /nope")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 1 || result.ExitCode != 1 || !strings.Contains(result.Stderr, "No such file") {
+		t.Errorf("result = %+v, err = %v", result, err)
+	}
+
+	result, err = adbShell(ctx, client, "SER123", "hang up")
+	if err == nil || result.Stdout != "partial" {
+		t.Errorf("result = %+v, err = %v", result, err)
+	}
+
+	// Features are asked once per device
+	count := 0
+	for _, request := range server.log() {
+		if strings.HasSuffix(request, ":features") {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("features requested %d times", count)
+	}
+}
+
+func TestADBShellLegacy(t *testing.T) {
+	server := newFakeADBServer(t)
+	server.replies["host-serial:OLD1:features"] = ""
+	server.services["shell:"] = func(conn net.Conn, command string) {
+		io.WriteString(conn, "[ro.product.brand]: [Xiaomi]\r\n[ro.build.version.release]: [10]\r\n")
+	}
+	result, err := adbShell(context.Background(), server.client(), "OLD1", "getprop")
+	if err != nil || result.ExitCode != 0 {
+		t.Fatalf("result = %+v, err = %v", result, err)
+	}
+	props := parseGetprop(result.Stdout)
+	if props["ro.product.brand"] != "Xiaomi" || props["ro.build.version.release"] != "10" || len(props) != 2 {
+		t.Errorf("props = %v", props)
+	}
+	log := server.log()
+	if len(log) < 3 || log[1] != "host:transport:OLD1" || log[2] != "shell:getprop" {
+		t.Errorf("requests = %q", log)
+	}
+}
+
+func TestParseGetprop(t *testing.T) {
+	props := parseGetprop("[a.b]: [1]\n  [ro.empty]: []\n[ro.with.brackets]: [x [y] z]\nnoise\n[broken]: 3\n")
+	want := map[string]string{"a.b": "1", "ro.empty": "", "ro.with.brackets": "x [y] z"}
+	if len(props) != len(want) {
+		t.Fatalf("props = %v", props)
+	}
+	for key, value := range want {
+		if props[key] != value {
+			t.Errorf("%s = %q, want %q", key, props[key], value)
+		}
+	}
+}
+
+func TestADBServiceCancel(t *testing.T) {
+	server := newFakeADBServer(t)
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	server.services["exec:"] = func(conn net.Conn, command string) { <-block }
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := adbExec(ctx, server.client(), "SER123", "cat /dev/zero")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v", err)
+	}
+}
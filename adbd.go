@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages of the adb transport protocol, as spoken by adbd itself
+const (
+	adbCmdCNXN = 0x4e584e43
+	adbCmdAUTH = 0x48545541
+	adbCmdOPEN = 0x4e45504f
+	adbCmdOKAY = 0x59414b4f
+	adbCmdCLSE = 0x45534c43
+	adbCmdWRTE = 0x45545257
+	adbCmdSTLS = 0x534c5453
+
+	adbVersion     = 0x01000001 // skips payload checksums
+	adbSTLSVersion = 0x01000000
+	adbMaxPayload  = 1024 * 1024
+	adbHeaderSize  = 24
+
+	// AUTH message types
+	adbAuthToken        = 1
+	adbAuthSignature    = 2
+	adbAuthRSAPublicKey = 3
+
+	adbdHandshakeTimeout = 10 * time.Second
+	adbdAcceptTimeout    = 60 * time.Second // for the "Allow USB debugging?" prompt
+)
+
+// adbHostFeatures is what we implement on top of the transport, device
+// features outside this list are ignored
+var adbHostFeatures = []string{"shell_v2", "cmd", "stat_v2", "ls_v2"}
+
+var errADBDClosed = errors.New("connection to adbd closed")
+
+// adbMessage is one packet: a 24-byte little-endian header and a payload
+type adbMessage struct {
+	command uint32
+	arg0    uint32
+	arg1    uint32
+	data    []byte
+}
+
+func writeADBMessage(w io.Writer, m adbMessage) error {
+	packet := make([]byte, adbHeaderSize, adbHeaderSize+len(m.data))
+	var sum uint32
+	for _, b := range m.data {
+		sum += uint32(b)
+	}
+	binary.LittleEndian.PutUint32(packet[0:], m.command)
+	binary.LittleEndian.PutUint32(packet[4:], m.arg0)
+	binary.LittleEndian.PutUint32(packet[8:], m.arg1)
+	binary.LittleEndian.PutUint32(packet[12:], uint32(len(m.data)))
+	binary.LittleEndian.PutUint32(packet[16:], sum)
+	binary.LittleEndian.PutUint32(packet[20:], m.command^0xffffffff)
+	_, err := w.Write(append(packet, m.data...))
+	return err
+}
+
+func readADBMessage(r io.Reader) (adbMessage, error) {
+	header := make([]byte, adbHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return adbMessage{}, err
+	}
+	m := adbMessage{
+		command: binary.LittleEndian.Uint32(header[0:]),
+		arg0:    binary.LittleEndian.Uint32(header[4:]),
+		arg1:    binary.LittleEndian.Uint32(header[8:]),
+	}
+	size := binary.LittleEndian.Uint32(header[12:])
+	if binary.LittleEndian.Uint32(header[20:]) != m.command^0xffffffff || size > adbMaxPayload {
+		return adbMessage{}, fmt.Errorf("bad adb packet header %x", header)
+	}
+	m.data = make([]byte, size)
+	if _, err := io.ReadFull(r, m.data); err != nil {
+		return adbMessage{}, err
+	}
+	return m, nil
+}
+
+// adbdConn is a connection straight to adbd, without the adb server in
+// between. It implements adbConnector, so shell, sync and reboot work on
+// it the same way.
+type adbdConn struct {
+	conn       net.Conn
+	serial     string
+	info       adbDeviceInfo
+	features   map[string]bool
+	maxPayload int
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*adbdStream
+	lastID  uint32
+
+	done chan struct{}
+}
+
+// dialADBD connects to adbd on addr and authenticates with our adb key.
+// onPrompt is called when the phone has to confirm the key first.
+func dialADBD(ctx context.Context, addr string, keys *adbKeyStore, onPrompt func()) (*adbdConn, error) {
+	key, err := keys.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: fastbootDialTimeout}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+
+	var conn net.Conn = raw
+	conn.SetDeadline(time.Now().Add(adbdHandshakeTimeout))
+	banner := "host::features=" + strings.Join(adbHostFeatures, ",")
+	if err := writeADBMessage(conn, adbMessage{command: adbCmdCNXN, arg0: adbVersion, arg1: adbMaxPayload, data: []byte(banner)}); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	signed, offered := false, false
+	for {
+		m, err := readADBMessage(conn)
+		if err != nil {
+			raw.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if offered && errors.Is(err, io.EOF) {
+				return nil, errors.New("the phone refused this computer's key")
+			}
+			return nil, err
+		}
+		switch m.command {
+		case adbCmdCNXN:
+			conn.SetDeadline(time.Time{})
+			return newADBDConn(conn, addr, m), nil
+
+		case adbCmdSTLS:
+			// Wireless debugging: the rest of the session runs over TLS and
+			// the client certificate stands in for the AUTH exchange
+			if err := writeADBMessage(conn, adbMessage{command: adbCmdSTLS, arg0: adbSTLSVersion}); err != nil {
+				raw.Close()
+				return nil, err
+			}
+			cert, err := keys.tlsCertificate()
+			if err != nil {
+				raw.Close()
+				return nil, err
+			}
+			tlsConn := tls.Client(raw, &tls.Config{
+				Certificates:       []tls.Certificate{cert},
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS13,
+			})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				raw.Close()
+				return nil, fmt.Errorf("TLS handshake: %w (is this computer paired?)", err)
+			}
+			conn = tlsConn
+
+		case adbCmdAUTH:
+			if m.arg0 != adbAuthToken {
+				raw.Close()
+				return nil, fmt.Errorf("unexpected AUTH type %d", m.arg0)
+			}
+			var reply adbMessage
+			switch {
+			case !signed:
+				// adbd hands us a 20-byte token and checks it as a SHA-1 digest
+				signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, m.data)
+				if err != nil {
+					raw.Close()
+					return nil, err
+				}
+				reply = adbMessage{command: adbCmdAUTH, arg0: adbAuthSignature, data: signature}
+				signed = true
+			case !offered:
+				// The phone does not know our key yet, offer it
+				publicKey, err := keys.publicKey()
+				if err != nil {
+					raw.Close()
+					return nil, err
+				}
+				reply = adbMessage{command: adbCmdAUTH, arg0: adbAuthRSAPublicKey, data: append([]byte(publicKey), 0)}
+				offered = true
+				conn.SetDeadline(time.Now().Add(adbdAcceptTimeout))
+				if onPrompt != nil {
+					onPrompt()
+				}
+			default:
+				raw.Close()
+				return nil, errors.New("the phone refused this computer's key")
+			}
+			if err := writeADBMessage(conn, reply); err != nil {
+				raw.Close()
+				return nil, err
+			}
+
+		default:
+			raw.Close()
+			return nil, fmt.Errorf("unexpected adb message %08x during connect", m.command)
+		}
+	}
+}
+
+func newADBDConn(conn net.Conn, serial string, cnxn adbMessage) *adbdConn {
+	c := &adbdConn{
+		conn:       conn,
+		serial:     serial,
+		maxPayload: int(min(cnxn.arg1, adbMaxPayload)),
+		streams:    make(map[uint32]*adbdStream),
+		done:       make(chan struct{}),
+	}
+	c.info, c.features = parseDeviceBanner(serial, string(cnxn.data))
+	go c.readLoop()
+	return c
+}
+
+// parseDeviceBanner reads the CNXN banner of adbd:
+// "device::ro.product.name=x;ro.product.model=y;ro.product.device=z;features=a,b"
+func parseDeviceBanner(serial, banner string) (adbDeviceInfo, map[string]bool) {
+	state, props, _ := strings.Cut(banner, "::")
+	info := adbDeviceInfo{Serial: serial, State: state}
+	features := make(map[string]bool)
+	for _, prop := range strings.Split(strings.TrimRight(props, "\x00"), ";") {
+		key, value, _ := strings.Cut(prop, "=")
+		switch key {
+		case "ro.product.name":
+			info.Product = value
+		case "ro.product.model":
+			info.Model = value
+		case "ro.product.device":
+			info.Device = value
+		case "features":
+			for _, feature := range strings.Split(value, ",") {
+				features[feature] = true
+			}
+		}
+	}
+	// Only what both sides support counts, like host:features
+	common := make(map[string]bool)
+	for _, feature := range adbHostFeatures {
+		if features[feature] {
+			common[feature] = true
+		}
+	}
+	return info, common
+}
+
+// Serial is the address the connection was made to
+func (c *adbdConn) Serial() string {
+	return c.serial
+}
+
+// Info describes the device the way host:devices-l would
+func (c *adbdConn) Info() adbDeviceInfo {
+	return c.info
+}
+
+// Done is closed when the connection is gone
+func (c *adbdConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *adbdConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *adbdConn) send(m adbMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeADBMessage(c.conn, m)
+}
+
+// readLoop hands every incoming message to its stream until the
+// connection breaks
+func (c *adbdConn) readLoop() {
+	for {
+		m, err := readADBMessage(c.conn)
+		if err != nil {
+			break
+		}
+		c.mu.Lock()
+		s := c.streams[m.arg1]
+		c.mu.Unlock()
+		if s == nil {
+			// A stream we already closed, or an OPEN from the device
+			if m.command == adbCmdWRTE || m.command == adbCmdOPEN {
+				c.send(adbMessage{command: adbCmdCLSE, arg1: m.arg0})
+			}
+			continue
+		}
+		switch m.command {
+		case adbCmdOKAY:
+			s.okay(m.arg0)
+		case adbCmdWRTE:
+			select {
+			case s.data <- m.data:
+			case <-s.local:
+			}
+		case adbCmdCLSE:
+			s.remoteClose()
+		}
+	}
+
+	c.conn.Close()
+	c.mu.Lock()
+	c.streams = nil
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// openService implements adbConnector, serial has to be ours
+func (c *adbdConn) openService(ctx context.Context, serial, service string) (io.ReadWriteCloser, error) {
+	if serial != "" && serial != c.serial {
+		return nil, fmt.Errorf("device %s is not on this connection", serial)
+	}
+	c.mu.Lock()
+	if c.streams == nil {
+		c.mu.Unlock()
+		return nil, errADBDClosed
+	}
+	c.lastID++
+	s := &adbdStream{
+		conn:    c,
+		localID: c.lastID,
+		opened:  make(chan struct{}),
+		data:    make(chan []byte, 1),
+		acks:    make(chan struct{}, 1),
+		remote:  make(chan struct{}),
+		local:   make(chan struct{}),
+	}
+	c.streams[s.localID] = s
+	c.mu.Unlock()
+
+	if err := c.send(adbMessage{command: adbCmdOPEN, arg0: s.localID, data: append([]byte(service), 0)}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	select {
+	case <-s.opened:
+	case <-s.remote:
+		s.Close()
+		return nil, &ADBError{Request: service, Message: "refused by device"}
+	case <-c.done:
+		return nil, errADBDClosed
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	}
+	s.stop = context.AfterFunc(ctx, func() { s.Close() })
+	return s, nil
+}
+
+// deviceFeatures implements adbConnector from the CNXN banner
+func (c *adbdConn) deviceFeatures(ctx context.Context, serial string) (map[string]bool, error) {
+	return c.features, nil
+}
+
+// adbdStream is one service on an adbd connection. The device sends the
+// next WRTE only after we acknowledged the last one, and so do we.
+type adbdStream struct {
+	conn     *adbdConn
+	localID  uint32
+	remoteID uint32
+	stop     func() bool
+
+	opened chan struct{}
+	data   chan []byte
+	acks   chan struct{}
+	remote chan struct{} // closed by the device
+	local  chan struct{} // closed by us
+
+	pending    []byte
+	remoteOnce sync.Once
+	localOnce  sync.Once
+}
+
+// okay is the answer to OPEN the first time, then acknowledges our WRTE
+func (s *adbdStream) okay(remoteID uint32) {
+	select {
+	case <-s.opened:
+		select {
+		case s.acks <- struct{}{}:
+		default:
+		}
+	default:
+		s.conn.mu.Lock()
+		s.remoteID = remoteID
+		s.conn.mu.Unlock()
+		close(s.opened)
+	}
+}
+
+func (s *adbdStream) remoteClose() {
+	s.remoteOnce.Do(func() { close(s.remote) })
+}
+
+func (s *adbdStream) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		var chunk []byte
+		select {
+		case chunk = <-s.data:
+		case <-s.remote:
+			// Data sent right before CLSE is still ours
+			select {
+			case chunk = <-s.data:
+			default:
+				return 0, io.EOF
+			}
+		case <-s.local:
+			return 0, io.ErrClosedPipe
+		case <-s.conn.done:
+			return 0, errADBDClosed
+		}
+		if err := s.conn.send(adbMessage{command: adbCmdOKAY, arg0: s.localID, arg1: s.remoteID}); err != nil {
+			return 0, err
+		}
+		s.pending = chunk
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *adbdStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+s.conn.maxPayload)]
+		if err := s.conn.send(adbMessage{command: adbCmdWRTE, arg0: s.localID, arg1: s.remoteID, data: chunk}); err != nil {
+			return written, err
+		}
+		select {
+		case <-s.acks:
+		case <-s.remote:
+			return written, io.ErrClosedPipe
+		case <-s.local:
+			return written, io.ErrClosedPipe
+		case <-s.conn.done:
+			return written, errADBDClosed
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (s *adbdStream) Close() error {
+	s.localOnce.Do(func() {
+		if s.stop != nil {
+			s.stop()
+		}
+		close(s.local)
+		s.conn.mu.Lock()
+		if s.conn.streams != nil {
+			delete(s.conn.streams, s.localID)
+		}
+		remoteID := s.remoteID
+		s.conn.mu.Unlock()
+		s.conn.send(adbMessage{command: adbCmdCLSE, arg0: s.localID, arg1: remoteID})
+	})
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeADBD plays adbd's side of the transport protocol: CNXN, AUTH or
+// STLS, then a shell service that answers in several WRTEs
+type fakeADBD struct {
+	t       *testing.T
+	addr    string
+	trusted *rsa.PublicKey   // signatures of this key are accepted
+	accept  bool             // trust a key the host offers
+	cert    *tls.Certificate // ask for STLS with this certificate
+	output  []string         // shell v2 stream, one WRTE each
+
+	mu       sync.Mutex
+	offered  string       // public key the host sent
+	received []adbMessage // from the host after the connection is up
+}
+
+func newFakeADBD(t *testing.T) *fakeADBD {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	d := &fakeADBD{t: t, addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeADBD) offer() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.offered
+}
+
+func (d *fakeADBD) messages() []adbMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]adbMessage(nil), d.received...)
+}
+
+func (d *fakeADBD) serve(conn net.Conn) {
+	defer conn.Close()
+	if m, err := readADBMessage(conn); err != nil || m.command != adbCmdCNXN || !strings.HasPrefix(string(m.data), "host::features=") {
+		d.t.Errorf("connect = %+v, %v", m, err)
+		return
+	}
+	if !d.authenticate(conn) {
+		return
+	}
+	if d.cert != nil {
+		conn = tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{*d.cert},
+			ClientAuth:   tls.RequireAnyClientCert,
+			MinVersion:   tls.VersionTLS13,
+		})
+	}
+	banner := "device::ro.product.name=cheetah;ro.product.model=Pixel 7 Pro;ro.product.device=cheetah;features=shell_v2,abb,stat_v2"
+	writeADBMessage(conn, adbMessage{command: adbCmdCNXN, arg0: adbVersion, arg1: 4096, data: []byte(banner)})
+
+	const remoteID = 77
+	for {
+		m, err := readADBMessage(conn)
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.received = append(d.received, m)
+		d.mu.Unlock()
+		if m.command != adbCmdOPEN {
+			continue
+		}
+		if !strings.HasPrefix(string(m.data), "shell,v2,raw:") {
+			writeADBMessage(conn, adbMessage{command: adbCmdCLSE, arg1: m.arg0})
+			continue
+		}
+		localID := m.arg0
+		writeADBMessage(conn, adbMessage{command: adbCmdOKAY, arg0: remoteID, arg1: localID})
+		for _, chunk := range d.output {
+			writeADBMessage(conn, adbMessage{command: adbCmdWRTE, arg0: remoteID, arg1: localID, data: []byte(chunk)})
+			// The next WRTE waits for the host to take this one
+			ack, err := readADBMessage(conn)
+			if err != nil {
+				return
+			}
+			d.mu.Lock()
+			d.received = append(d.received, ack)
+			d.mu.Unlock()
+			if ack.command != adbCmdOKAY || ack.arg0 != localID || ack.arg1 != remoteID {
+				d.t.Errorf("after WRTE got %08x %d %d", ack.command, ack.arg0, ack.arg1)
+				return
+			}
+		}
+		writeADBMessage(conn, adbMessage{command: adbCmdCLSE, arg0: remoteID, arg1: localID})
+	}
+}
+
+// authenticate runs STLS or the AUTH exchange and reports whether the
+// host may connect
+func (d *fakeADBD) authenticate(conn net.Conn) bool {
+	if d.cert != nil {
+		writeADBMessage(conn, adbMessage{command: adbCmdSTLS, arg0: adbSTLSVersion})
+		m, err := readADBMessage(conn)
+		if err != nil || m.command != adbCmdSTLS || m.arg0 != adbSTLSVersion {
+			d.t.Errorf("STLS answer = %+v, %v", m, err)
+			return false
+		}
+		return true
+	}
+
+	token := bytes.Repeat([]byte{0x5a}, 20)
+	writeADBMessage(conn, adbMessage{command: adbCmdAUTH, arg0: adbAuthToken, data: token})
+	m, err := readADBMessage(conn)
+	if err != nil || m.command != adbCmdAUTH || m.arg0 != adbAuthSignature {
+		d.t.Errorf("signature = %+v, %v", m, err)
+		return false
+	}
+	if d.trusted != nil && rsa.VerifyPKCS1v15(d.trusted, crypto.SHA1, token, m.data) == nil {
+		return true
+	}
+
+	writeADBMessage(conn, adbMessage{command: adbCmdAUTH, arg0: adbAuthToken, data: token})
+	m, err = readADBMessage(conn)
+	if err != nil || m.command != adbCmdAUTH || m.arg0 != adbAuthRSAPublicKey {
+		d.t.Errorf("key offer = %+v, %v", m, err)
+		return false
+	}
+	d.mu.Lock()
+	d.offered = string(m.data)
+	d.mu.Unlock()
+	// Refusing is hanging up, like a phone where the user tapped Deny
+	return d.accept
+}
+
+func TestDialADBD(t *testing.T) {
+	keys := &adbKeyStore{dir: t.TempDir()}
+	key, err := keys.privateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := keys.publicKey()
+	ctx := context.Background()
+
+	t.Run("signature accepted", func(t *testing.T) {
+		d := newFakeADBD(t)
+		d.trusted = &key.PublicKey
+		prompted := false
+		c, err := dialADBD(ctx, d.addr, keys, func() { prompted = true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if prompted || d.offer() != "" {
+			t.Errorf("prompted %v, offered %q", prompted, d.offer())
+		}
+		if info := c.Info(); info.State != "device" || info.Model != "Pixel 7 Pro" || info.Serial != d.addr {
+			t.Errorf("info = %+v", info)
+		}
+		if features, _ := c.deviceFeatures(ctx, ""); !features["shell_v2"] || !features["stat_v2"] || features["abb"] || features["cmd"] {
+			t.Errorf("features = %v", features)
+		}
+	})
+
+	t.Run("key offered", func(t *testing.T) {
+		d := newFakeADBD(t)
+		d.trusted = &rsa.PublicKey{N: key.N, E: 3} // a different key
+		d.accept = true
+		prompted := false
+		c, err := dialADBD(ctx, d.addr, keys, func() { prompted = true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if !prompted || d.offer() != publicKey+"\x00" {
+			t.Errorf("prompted %v, offered %q", prompted, d.offer())
+		}
+	})
+
+	t.Run("key refused", func(t *testing.T) {
+		d := newFakeADBD(t)
+		_, err := dialADBD(ctx, d.addr, keys, nil)
+		if err == nil || !strings.Contains(err.Error(), "refused this computer's key") {
+			t.Errorf("err = %v", err)
+		}
+	})
+
+	t.Run("STLS", func(t *testing.T) {
+		cert, err := (&adbKeyStore{dir: t.TempDir()}).tlsCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := newFakeADBD(t)
+		d.cert = &cert
+		d.output = []string{"\x01\x03\x00\x00\x00ok\n", "\x03\x01\x00\x00\x00\x00"}
+		c, err := dialADBD(ctx, d.addr, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if result, err := adbShell(ctx, c, d.addr, "true"); err != nil || result.Stdout != "ok\n" {
+			t.Errorf("shell over TLS = %+v, %v", result, err)
+		}
+	})
+}
+
+func TestADBDStreams(t *testing.T) {
+	keys := &adbKeyStore{dir: t.TempDir()}
+	key, err := keys.privateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newFakeADBD(t)
+	d.trusted = &key.PublicKey
+	// Packets split across WRTEs anywhere, even inside a header
+	d.output = []string{"\x01\x0c\x00\x00\x00Pixel", " 7 Pro\n\x02\x04", "\x00\x00\x00warn\x03\x01\x00\x00\x00\x00"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := dialADBD(ctx, d.addr, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := adbShell(ctx, c, d.addr, "getprop ro.product.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "Pixel 7 Pro\n" || result.Stderr != "warn" || result.ExitCode != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	if _, err := c.openService(ctx, d.addr, "reboot:bootloader"); !isADBError(err) {
+		t.Errorf("refused service: %v", err)
+	}
+	if _, err := c.openService(ctx, "other", "shell:true"); err == nil {
+		t.Error("opened a stream for another serial")
+	}
+
+	// Wait for our CLSE of the first stream to reach the fake
+	deadline := time.Now().Add(time.Second)
+	for len(d.messages()) < 6 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var got []string
+	for _, m := range d.messages() {
+		name := map[uint32]string{adbCmdOPEN: "OPEN", adbCmdOKAY: "OKAY", adbCmdCLSE: "CLSE", adbCmdWRTE: "WRTE"}[m.command]
+		got = append(got, fmt.Sprintf("%s %d %d", name, m.arg0, m.arg1))
+	}
+	// Our ids count up from 1, every WRTE of the device is acknowledged
+	// with both ids, the device's CLSE is answered with ours
+	want := []string{"OPEN 1 0", "OKAY 1 77", "OKAY 1 77", "OKAY 1 77", "CLSE 1 77", "OPEN 2 0"}
+	slices.Sort(got[4:])
+	slices.Sort(want[4:])
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("messages = %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Device source for adbd connections made without the adb server
+const sourceDirect = "direct"
+
+// directDevices holds the open adbd connections, keyed by address
+type directDevices struct {
+	mu    sync.Mutex
+	conns map[string]*adbdConn
+}
+
+func (d *directDevices) get(serial string) *adbdConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns[serial]
+}
+
+func (d *directDevices) add(conn *adbdConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns == nil {
+		d.conns = make(map[string]*adbdConn)
+	}
+	if old := d.conns[conn.Serial()]; old != nil {
+		old.Close()
+	}
+	d.conns[conn.Serial()] = conn
+}
+
+// remove forgets conn, unless a newer connection replaced it already
+func (d *directDevices) remove(conn *adbdConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[conn.Serial()] == conn {
+		delete(d.conns, conn.Serial())
+	}
+}
+
+// devices lists the connected devices sorted by serial
+func (d *directDevices) devices() []adbDeviceInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var devices []adbDeviceInfo
+	for _, conn := range d.conns {
+		devices = append(devices, conn.Info())
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Serial < devices[j].Serial })
+	return devices
+}
+
+// adbTransport returns what reaches serial: its direct connection, or
+// else the adb server
+func (t *FlashTool) adbTransport(ctx context.Context, serial string) (adbConnector, error) {
+	if conn := t.direct.get(serial); conn != nil {
+		return conn, nil
+	}
+	return t.adbHost(ctx)
+}
+
+// adbConnectDirect connects to adbd on addr itself, for emulators and
+// network devices when no adb server is available
+func (t *FlashTool) adbConnectDirect(ctx context.Context, addr string) error {
+	t.appendLog(fmt.Sprintf("🔗 Connecting to adbd at %s directly...", addr))
+	conn, err := dialADBD(ctx, addr, t.adbKeys, func() {
+		t.appendLog("📲 Allow USB debugging for this computer on the phone")
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			t.appendLog(fmt.Sprintf("❌ Connection failed: %v", err))
+		}
+		return err
+	}
+	t.direct.add(conn)
+	t.publishDirect()
+	go func() {
+		<-conn.Done()
+		t.direct.remove(conn)
+		t.publishDirect()
+	}()
+
+	info := conn.Info()
+	name := info.Model
+	if name == "" {
+		name = addr
+	}
+	t.appendLog(fmt.Sprintf("✅ Connected to %s (%s) without adb server", name, info.State))
+	return nil
+}
+
+// adbDisconnectDirect closes the direct connection to addr, if any
+func (t *FlashTool) adbDisconnectDirect(addr string) bool {
+	conn := t.direct.get(addr)
+	if conn == nil {
+		return false
+	}
+	conn.Close()
+	t.direct.remove(conn)
+	t.publishDirect()
+	return true
+}
+
+// publishDirect tells the device watcher about direct connections, so
+// they show up next to the ones the server knows
+func (t *FlashTool) publishDirect() {
+	if t.watcher == nil {
+		return
+	}
+	var devices []watchedDevice
+	for _, info := range t.direct.devices() {
+		devices = append(devices, watchedDevice{Serial: info.Serial, Source: sourceDirect, State: info.State, Info: info})
+	}
+	t.watcher.update(sourceDirect, devices)
+}
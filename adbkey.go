@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	adbKeyBits     = 2048
+	adbKeyExponent = 65537
+)
+
+// adbKeyStore is the host's adb key pair, shared with the adb server in
+// ~/.android/adbkey so a device that trusts one trusts the other. Pairing
+// and direct connections all use it.
+type adbKeyStore struct {
+	dir string
+
+	mu  sync.Mutex
+	key *rsa.PrivateKey
+}
+
+// newADBKeyStore uses $ANDROID_USER_HOME like adb does, else ~/.android
+func newADBKeyStore() *adbKeyStore {
+	dir := os.Getenv("ANDROID_USER_HOME")
+	if dir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".android")
+		}
+	}
+	return &adbKeyStore{dir: dir}
+}
+
+func (s *adbKeyStore) keyPath() string {
+	return filepath.Join(s.dir, "adbkey")
+}
+
+// privateKey loads adbkey, creating the key pair the first time
+func (s *adbKeyStore) privateKey() (*rsa.PrivateKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != nil {
+		return s.key, nil
+	}
+
+	data, err := os.ReadFile(s.keyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := s.generate()
+		if err != nil {
+			return nil, fmt.Errorf("creating %s: %w", s.keyPath(), err)
+		}
+		s.key = key
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseADBKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.keyPath(), err)
+	}
+	s.key = key
+	return key, nil
+}
+
+// parseADBKey reads a PEM private key, PKCS#8 as adb writes it or PKCS#1
+func parseADBKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// generate writes a new adbkey and adbkey.pub
+func (s *adbKeyStore) generate() (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, adbKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, err
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(s.keyPath(), pemData, 0600); err != nil {
+		return nil, err
+	}
+	pub, err := androidPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.keyPath()+".pub", []byte(pub+" "+hostUserInfo()+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// publicKey returns the key the way adbd stores it in adb_keys:
+// base64 of the Android key structure followed by " user@host"
+func (s *adbKeyStore) publicKey() (string, error) {
+	key, err := s.privateKey()
+	if err != nil {
+		return "", err
+	}
+	pub, err := androidPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return pub + " " + hostUserInfo(), nil
+}
+
+// tlsCertificate is a self-signed certificate for the adb key, which is
+// what adbd expects from the host for pairing and TLS connections
+func (s *adbKeyStore) tlsCertificate() (tls.Certificate, error) {
+	key, err := s.privateKey()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "adb", Organization: []string{"Android"}, Country: []string{"US"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// androidPublicKey encodes an RSA key in the format of Android's
+// RSAPublicKey struct: word count, -1/n[0] mod 2^32, modulus, R^2 mod n
+// (both little-endian) and the exponent, then base64
+func androidPublicKey(pub *rsa.PublicKey) (string, error) {
+	if pub.N.BitLen() != adbKeyBits || pub.E != adbKeyExponent {
+		return "", fmt.Errorf("adb needs a %d-bit RSA key with exponent %d", adbKeyBits, adbKeyExponent)
+	}
+	const words = adbKeyBits / 32
+	buf := make([]byte, 4+4+adbKeyBits/8*2+4)
+	binary.LittleEndian.PutUint32(buf[0:], words)
+
+	r32 := new(big.Int).Lsh(big.NewInt(1), 32)
+	n0inv := new(big.Int).Mod(pub.N, r32)
+	n0inv.ModInverse(n0inv, r32)
+	n0inv.Sub(r32, n0inv)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(n0inv.Uint64()))
+
+	putLittleEndian(buf[8:8+adbKeyBits/8], pub.N)
+	rr := new(big.Int).Lsh(big.NewInt(1), adbKeyBits*2)
+	rr.Mod(rr, pub.N)
+	putLittleEndian(buf[8+adbKeyBits/8:8+adbKeyBits/4], rr)
+	binary.LittleEndian.PutUint32(buf[8+adbKeyBits/4:], uint32(pub.E))
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// putLittleEndian writes n into buf with the least significant byte first
+func putLittleEndian(buf []byte, n *big.Int) {
+	n.FillBytes(buf)
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+}
+
+// hostUserInfo is the "user@host" label adb appends to public keys
+func hostUserInfo() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = filepath.Base(u.Username) // DOMAIN\user on Windows
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Wireless debugging pairing (Android 11+): TLS 1.3 to the pairing port,
+// SPAKE2 keyed with the 6-digit code plus TLS exported keying material,
+// then both sides swap their identity encrypted with the derived key.
+const (
+	pairingVersion     = 1
+	pairingSPAKE2Msg   = 0
+	pairingPeerInfo    = 1
+	pairingHeaderSize  = 6
+	pairingMaxPeerInfo = 8192
+	pairingMaxPayload  = 2 * pairingMaxPeerInfo
+
+	peerInfoRSAPublicKey = 0
+	peerInfoDeviceGUID   = 1
+
+	pairingTimeout = 30 * time.Second
+	pairingKeySize = 64
+)
+
+var (
+	pairingClientName = []byte("adb pair client\x00")
+	pairingServerName = []byte("adb pair server\x00")
+	pairingLabel      = "adb-label\x00"
+	pairingKeyInfo    = "adb pairing_auth aes-128-gcm key"
+)
+
+// errWrongPairingCode is what a refused pairing looks like from our side:
+// adbd cannot decrypt our peer info and hangs up
+var errWrongPairingCode = errors.New("pairing refused, check the pairing code")
+
+// pairingCipher is AES-128-GCM with a counter nonce per direction
+type pairingCipher struct {
+	aead     cipher.AEAD
+	encCount uint64
+	decCount uint64
+}
+
+func newPairingCipher(keyMaterial []byte) (*pairingCipher, error) {
+	key, err := hkdf.Key(sha256.New, keyMaterial, nil, pairingKeyInfo, 16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pairingCipher{aead: aead}, nil
+}
+
+func (c *pairingCipher) nonce(counter uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, counter)
+	return nonce
+}
+
+func (c *pairingCipher) encrypt(plain []byte) []byte {
+	out := c.aead.Seal(nil, c.nonce(c.encCount), plain, nil)
+	c.encCount++
+	return out
+}
+
+func (c *pairingCipher) decrypt(sealed []byte) ([]byte, error) {
+	out, err := c.aead.Open(nil, c.nonce(c.decCount), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.decCount++
+	return out, nil
+}
+
+func writePairingPacket(w io.Writer, kind byte, payload []byte) error {
+	header := make([]byte, pairingHeaderSize)
+	header[0], header[1] = pairingVersion, kind
+	binary.BigEndian.PutUint32(header[2:], uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readPairingPacket(r io.Reader, kind byte) ([]byte, error) {
+	header := make([]byte, pairingHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if header[0] != pairingVersion || header[1] != kind || size == 0 || size > pairingMaxPayload {
+		return nil, fmt.Errorf("unexpected pairing packet: version %d, type %d, %d bytes", header[0], header[1], size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// pairDevice pairs with adbd on addr and returns the device's GUID. The
+// device stores our public key, so the adb server (same key) can connect.
+func pairDevice(ctx context.Context, keys *adbKeyStore, addr, code string) (string, error) {
+	cert, err := keys.tlsCertificate()
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := keys.publicKey()
+	if err != nil {
+		return "", err
+	}
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: fastbootDialTimeout},
+		Config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			// adbd's certificate is self-signed, the code authenticates it
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS13,
+		},
+	}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	conn := raw.(*tls.Conn)
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+
+	state := conn.ConnectionState()
+	exported, err := state.ExportKeyingMaterial(pairingLabel, nil, pairingKeySize)
+	if err != nil {
+		return "", err
+	}
+	password := append([]byte(code), exported...)
+
+	spake := newSPAKE2(spakeAlice, pairingClientName, pairingServerName)
+	msg, err := spake.generateMsg(password)
+	if err != nil {
+		return "", err
+	}
+	if err := writePairingPacket(conn, pairingSPAKE2Msg, msg); err != nil {
+		return "", err
+	}
+	theirMsg, err := readPairingPacket(conn, pairingSPAKE2Msg)
+	if err != nil {
+		return "", err
+	}
+	keyMaterial, err := spake.processMsg(theirMsg)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newPairingCipher(keyMaterial)
+	if err != nil {
+		return "", err
+	}
+
+	info := make([]byte, pairingMaxPeerInfo)
+	info[0] = peerInfoRSAPublicKey
+	if len(publicKey) >= len(info)-1 {
+		return "", errors.New("public key too long for pairing")
+	}
+	copy(info[1:], publicKey)
+	if err := writePairingPacket(conn, pairingPeerInfo, aead.encrypt(info)); err != nil {
+		return "", err
+	}
+	sealed, err := readPairingPacket(conn, pairingPeerInfo)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", errWrongPairingCode
+	}
+	theirInfo, err := aead.decrypt(sealed)
+	if err != nil || len(theirInfo) != pairingMaxPeerInfo {
+		return "", errWrongPairingCode
+	}
+	guid, _, _ := strings.Cut(string(theirInfo[1:]), "\x00")
+	return guid, nil
+}
+
+// adbPairDevice pairs with a phone showing "Pair device with pairing code"
+func (t *FlashTool) adbPairDevice(ctx context.Context, addr, code string) {
+	t.appendLog(fmt.Sprintf("🔐 Pairing with %s...", addr))
+	guid, err := pairDevice(ctx, t.adbKeys, addr, code)
+	if err != nil {
+		if ctx.Err() == nil {
+			t.appendLog(fmt.Sprintf("❌ Pairing failed: %v", err))
+		}
+		return
+	}
+	t.appendLog(fmt.Sprintf("✅ Paired with %s", guid))
+	t.appendLog("📌 Use Connect Wi-Fi with the IP address & port shown under Wireless debugging")
+}
+
+// showPairDialog asks for the pairing address and code shown on the phone
+func (t *FlashTool) showPairDialog() {
+	ip := widget.NewEntry()
+	ip.SetPlaceHolder("192.168.1.20")
+	port := widget.NewEntry()
+	port.SetPlaceHolder("37123")
+	code := widget.NewEntry()
+	code.SetPlaceHolder("6-digit code")
+	dialog.ShowForm("Pair device", "Pair", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("IP address", ip),
+			widget.NewFormItem("Port", port),
+			widget.NewFormItem("Pairing code", code),
+		},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			addr, err := parseADBAddress(net.JoinHostPort(strings.TrimSpace(ip.Text), strings.TrimSpace(port.Text)))
+			if err != nil {
+				dialog.ShowError(err, t.window)
+				return
+			}
+			pairingCode := strings.TrimSpace(code.Text)
+			if pairingCode == "" {
+				dialog.ShowError(errors.New("enter the pairing code shown on the phone"), t.window)
+				return
+			}
+			t.run(jobControl, "Pair Device", func(ctx context.Context) {
+				t.adbPairDevice(ctx, addr, pairingCode)
+			})
+		}, t.window)
+}
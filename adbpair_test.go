@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPairingPacket(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePairingPacket(&buf, pairingPeerInfo, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, []byte{1, 1, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("packet = %v", got)
+	}
+	payload, err := readPairingPacket(&buf, pairingPeerInfo)
+	if err != nil || string(payload) != "hello" {
+		t.Errorf("payload = %q, %v", payload, err)
+	}
+
+	for name, packet := range map[string][]byte{
+		"wrong type":    {1, 0, 0, 0, 0, 1, 'x'},
+		"wrong version": {2, 1, 0, 0, 0, 1, 'x'},
+		"empty":         {1, 1, 0, 0, 0, 0},
+		"too big":       binary.BigEndian.AppendUint32([]byte{1, 1}, pairingMaxPayload+1),
+		"short":         {1, 1, 0, 0, 0, 9, 'x'},
+	} {
+		if _, err := readPairingPacket(bytes.NewReader(packet), pairingPeerInfo); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestPairingCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, pairingKeySize)
+	ours, _ := newPairingCipher(key)
+	theirs, _ := newPairingCipher(key)
+	first, second := ours.encrypt([]byte("one")), ours.encrypt([]byte("one"))
+	if bytes.Equal(first, second) {
+		t.Error("the nonce did not change")
+	}
+	for _, sealed := range [][]byte{first, second} {
+		if plain, err := theirs.decrypt(sealed); err != nil || string(plain) != "one" {
+			t.Errorf("decrypt = %q, %v", plain, err)
+		}
+	}
+	// Out of order or replayed messages do not open
+	if _, err := theirs.decrypt(first); err == nil {
+		t.Error("a replayed message was decrypted")
+	}
+}
+
+// fakePairingServer plays adbd's side of pairing with code and records
+// the peer info the client sent
+type fakePairingServer struct {
+	addr string
+	code string
+
+	mu   sync.Mutex
+	info []byte
+}
+
+func newFakePairingServer(t *testing.T, code string) *fakePairingServer {
+	t.Helper()
+	cert, err := (&adbKeyStore{dir: t.TempDir()}).tlsCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakePairingServer{addr: ln.Addr().String(), code: code}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn.(*tls.Conn))
+		}
+	}()
+	return s
+}
+
+func (s *fakePairingServer) serve(conn *tls.Conn) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	state := conn.ConnectionState()
+	exported, _ := state.ExportKeyingMaterial(pairingLabel, nil, pairingKeySize)
+	spake := newSPAKE2(spakeBob, pairingServerName, pairingClientName)
+	msg, _ := spake.generateMsg(append([]byte(s.code), exported...))
+	theirMsg, err := readPairingPacket(conn, pairingSPAKE2Msg)
+	if err != nil {
+		return
+	}
+	writePairingPacket(conn, pairingSPAKE2Msg, msg)
+	keyMaterial, err := spake.processMsg(theirMsg)
+	if err != nil {
+		return
+	}
+	aead, _ := newPairingCipher(keyMaterial)
+	sealed, err := readPairingPacket(conn, pairingPeerInfo)
+	if err != nil {
+		return
+	}
+	info, err := aead.decrypt(sealed)
+	if err != nil {
+		return // a wrong code: adbd hangs up
+	}
+	s.mu.Lock()
+	s.info = info
+	s.mu.Unlock()
+
+	reply := make([]byte, pairingMaxPeerInfo)
+	reply[0] = peerInfoDeviceGUID
+	copy(reply[1:], "adb-R5CN1234-AbCdEf")
+	writePairingPacket(conn, pairingPeerInfo, aead.encrypt(reply))
+}
+
+func TestPairDevice(t *testing.T) {
+	server := newFakePairingServer(t, "482913")
+	keys := &adbKeyStore{dir: t.TempDir()}
+
+	if _, err := pairDevice(context.Background(), keys, server.addr, "000000"); !errors.Is(err, errWrongPairingCode) {
+		t.Errorf("wrong code: %v", err)
+	}
+	guid, err := pairDevice(context.Background(), keys, server.addr, "482913")
+	if err != nil || guid != "adb-R5CN1234-AbCdEf" {
+		t.Fatalf("guid = %q, %v", guid, err)
+	}
+
+	// Our peer info is the public key, NUL padded to the full size
+	publicKey, _ := keys.publicKey()
+	server.mu.Lock()
+	info := server.info
+	server.mu.Unlock()
+	if len(info) != pairingMaxPeerInfo || info[0] != peerInfoRSAPublicKey {
+		t.Fatalf("peer info of %d bytes, type %d", len(info), info[0])
+	}
+	key, padding, _ := strings.Cut(string(info[1:]), "\x00")
+	if key != publicKey || strings.Trim(padding, "\x00") != "" {
+		t.Errorf("peer info key = %q", key)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sync protocol limits
+const (
+	syncMaxChunk   = 64 * 1024
+	syncMaxPathLen = 1024
+)
+
+// Unix file type bits as sent by adbd
+const (
+	unixTypeMask = 0170000
+	unixDir      = 0040000
+	unixRegular  = 0100000
+	unixSymlink  = 0120000
+)
+
+// SyncError is a failure reported by the device's sync service
+type SyncError struct {
+	Op      string // STAT, LIST, SEND, RECV
+	Path    string
+	Errno   int // errno from STA2/LIS2, 0 when only a message was sent
+	Message string
+}
+
+func (e *SyncError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = fmt.Sprintf("errno %d", e.Errno)
+	}
+	return fmt.Sprintf("sync %s %s: %s", e.Op, e.Path, msg)
+}
+
+// Unwrap maps device errors onto the fs errors so callers can use
+// errors.Is(err, fs.ErrNotExist)
+func (e *SyncError) Unwrap() error {
+	switch {
+	case e.Errno == 2 || strings.Contains(e.Message, "No such file"):
+		return fs.ErrNotExist
+	case e.Errno == 13 || strings.Contains(e.Message, "Permission denied"):
+		return fs.ErrPermission
+	case e.Errno == 17 || strings.Contains(e.Message, "File exists"):
+		return fs.ErrExist
+	}
+	return nil
+}
+
+// ErrSyncProtocol is returned when the device answers something the sync
+// protocol does not allow
+var ErrSyncProtocol = errors.New("sync: protocol error")
+
+// syncStat is the metadata of a file on the device
+type syncStat struct {
+	Mode  fs.FileMode
+	Size  int64
+	Mtime time.Time
+	UID   uint32
+	GID   uint32
+}
+
+// syncDirEntry is one entry of a directory listing
+type syncDirEntry struct {
+	Name string
+	syncStat
+}
+
+// syncProgress is reported while files move
+type syncProgress struct {
+	Path      string // file being transferred
+	FileDone  int64
+	FileSize  int64
+	Files     int // files finished so far
+	BytesDone int64
+}
+
+// syncConn is an open sync: service on one device
+type syncConn struct {
+	ctx    context.Context
+	stream io.ReadWriteCloser
+	statV2 bool
+	lsV2   bool
+}
+
+// openSync starts the sync service, using the v2 stat and list requests
+// when the device supports them
+func openSync(ctx context.Context, c adbConnector, serial string) (*syncConn, error) {
+	features, err := c.deviceFeatures(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.openService(ctx, serial, "sync:")
+	if err != nil {
+		return nil, err
+	}
+	return &syncConn{ctx: ctx, stream: stream, statV2: features["stat_v2"], lsV2: features["ls_v2"]}, nil
+}
+
+// Close ends the sync session
+func (s *syncConn) Close() error {
+	s.sendRequest("QUIT", "")
+	return s.stream.Close()
+}
+
+// err prefers the context error when a cancel broke the connection
+func (s *syncConn) err(err error) error {
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (s *syncConn) sendRequest(id, arg string) error {
+	if len(arg) > syncMaxPathLen {
+		return fmt.Errorf("sync %s: path too long: %s", id, arg)
+	}
+	buf := make([]byte, 8+len(arg))
+	copy(buf, id)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(arg)))
+	copy(buf[8:], arg)
+	_, err := s.stream.Write(buf)
+	return s.err(err)
+}
+
+func (s *syncConn) readID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(s.stream, id); err != nil {
+		return "", s.err(err)
+	}
+	return string(id), nil
+}
+
+func (s *syncConn) readUint32() (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s.stream, buf); err != nil {
+		return 0, s.err(err)
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// readFail reads the message that follows a FAIL id
+func (s *syncConn) readFail(op, p string) error {
+	n, err := s.readUint32()
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(s.stream, msg); err != nil {
+		return s.err(err)
+	}
+	return &SyncError{Op: op, Path: p, Message: string(msg)}
+}
+
+// statV2Fields decodes the fields shared by STA2/LST2 and DNT2
+func statV2Fields(buf []byte) (errno uint32, st syncStat) {
+	le := binary.LittleEndian
+	errno = le.Uint32(buf[0:])
+	// dev and ino at 4 and 12 are not used
+	st.Mode = fileModeFromUnix(le.Uint32(buf[20:]))
+	st.UID = le.Uint32(buf[28:])
+	st.GID = le.Uint32(buf[32:])
+	st.Size = int64(le.Uint64(buf[36:]))
+	st.Mtime = time.Unix(int64(le.Uint64(buf[52:])), 0)
+	return errno, st
+}
+
+// Size of a STA2/DNT2 body after the id, without DNT2's name length
+const statV2Size = 68
+
+// Stat returns the metadata of path on the device
+func (s *syncConn) Stat(p string) (syncStat, error) {
+	if s.statV2 {
+		if err := s.sendRequest("STA2", p); err != nil {
+			return syncStat{}, err
+		}
+		id, err := s.readID()
+		if err != nil {
+			return syncStat{}, err
+		}
+		if id != "STA2" {
+			return syncStat{}, fmt.Errorf("%w: STA2 answered with %q", ErrSyncProtocol, id)
+		}
+		buf := make([]byte, statV2Size)
+		if _, err := io.ReadFull(s.stream, buf); err != nil {
+			return syncStat{}, s.err(err)
+		}
+		errno, st := statV2Fields(buf)
+		if errno != 0 {
+			return syncStat{}, &SyncError{Op: "STAT", Path: p, Errno: int(errno)}
+		}
+		return st, nil
+	}
+
+	if err := s.sendRequest("STAT", p); err != nil {
+		return syncStat{}, err
+	}
+	id, err := s.readID()
+	if err != nil {
+		return syncStat{}, err
+	}
+	if id != "STAT" {
+		return syncStat{}, fmt.Errorf("%w: STAT answered with %q", ErrSyncProtocol, id)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(s.stream, buf); err != nil {
+		return syncStat{}, s.err(err)
+	}
+	mode := binary.LittleEndian.Uint32(buf[0:])
+	if mode == 0 {
+		// v1 has no error field, an all-zero answer means "not found"
+		return syncStat{}, &SyncError{Op: "STAT", Path: p, Errno: 2, Message: "No such file or directory"}
+	}
+	return syncStat{
+		Mode:  fileModeFromUnix(mode),
+		Size:  int64(binary.LittleEndian.Uint32(buf[4:])),
+		Mtime: time.Unix(int64(binary.LittleEndian.Uint32(buf[8:])), 0),
+	}, nil
+}
+
+// List returns the entries of a directory on the device without . and ..
+func (s *syncConn) List(p string) ([]syncDirEntry, error) {
+	request, entryID, bodySize := "LIST", "DENT", 16
+	if s.lsV2 {
+		request, entryID, bodySize = "LIS2", "DNT2", statV2Size+4
+	}
+	if err := s.sendRequest(request, p); err != nil {
+		return nil, err
+	}
+
+	var entries []syncDirEntry
+	for {
+		id, err := s.readID()
+		if err != nil {
+			return nil, err
+		}
+		body := make([]byte, bodySize)
+		if _, err := io.ReadFull(s.stream, body); err != nil {
+			return nil, s.err(err)
+		}
+		if id == "DONE" {
+			return entries, nil
+		}
+		if id != entryID {
+			return nil, fmt.Errorf("%w: %s answered with %q", ErrSyncProtocol, request, id)
+		}
+
+		nameLen := binary.LittleEndian.Uint32(body[bodySize-4:])
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(s.stream, name); err != nil {
+			return nil, s.err(err)
+		}
+		if string(name) == "." || string(name) == ".." {
+			continue
+		}
+
+		entry := syncDirEntry{Name: string(name)}
+		if s.lsV2 {
+			errno, st := statV2Fields(body)
+			if errno != 0 {
+				// adbd could not stat this entry, keep listing the rest
+				continue
+			}
+			entry.syncStat = st
+		} else {
+			le := binary.LittleEndian
+			entry.Mode = fileModeFromUnix(le.Uint32(body[0:]))
+			entry.Size = int64(le.Uint32(body[4:]))
+			entry.Mtime = time.Unix(int64(le.Uint32(body[8:])), 0)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Send writes r to path on the device with the given mode and mtime
+func (s *syncConn) Send(p string, mode fs.FileMode, mtime time.Time, r io.Reader, progress func(n int64)) error {
+	if err := s.sendRequest("SEND", fmt.Sprintf("%s,%d", p, unixRegular|uint32(mode.Perm()))); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8+syncMaxChunk)
+	copy(buf, "DATA")
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := r.Read(buf[8:])
+		if n > 0 {
+			binary.LittleEndian.PutUint32(buf[4:], uint32(n))
+			if _, err := s.stream.Write(buf[:8+n]); err != nil {
+				return s.err(err)
+			}
+			if progress != nil {
+				progress(int64(n))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	done := make([]byte, 8)
+	copy(done, "DONE")
+	binary.LittleEndian.PutUint32(done[4:], uint32(mtime.Unix()))
+	if _, err := s.stream.Write(done); err != nil {
+		return s.err(err)
+	}
+
+	id, err := s.readID()
+	if err != nil {
+		return err
+	}
+	switch id {
+	case "OKAY":
+		_, err := s.readUint32()
+		return err
+	case "FAIL":
+		return s.readFail("SEND", p)
+	}
+	return fmt.Errorf("%w: SEND answered with %q", ErrSyncProtocol, id)
+}
+
+// Recv copies path on the device into w
+func (s *syncConn) Recv(p string, w io.Writer, progress func(n int64)) error {
+	if err := s.sendRequest("RECV", p); err != nil {
+		return err
+	}
+	buf := make([]byte, syncMaxChunk)
+	for {
+		id, err := s.readID()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case "DATA":
+			n, err := s.readUint32()
+			if err != nil {
+				return err
+			}
+			if n > syncMaxChunk {
+				return fmt.Errorf("%w: DATA chunk of %d bytes", ErrSyncProtocol, n)
+			}
+			if _, err := io.ReadFull(s.stream, buf[:n]); err != nil {
+				return s.err(err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(int64(n))
+			}
+		case "DONE":
+			_, err := s.readUint32()
+			return err
+		case "FAIL":
+			return s.readFail("RECV", p)
+		default:
+			return fmt.Errorf("%w: RECV answered with %q", ErrSyncProtocol, id)
+		}
+	}
+}
+
+func fileModeFromUnix(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & unixTypeMask {
+	case unixDir:
+		m |= fs.ModeDir
+	case unixSymlink:
+		m |= fs.ModeSymlink
+	case unixRegular:
+	default:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
+
+// pullPath copies a file or a whole directory tree from the device,
+// keeping permissions and modification times
+func (s *syncConn) pullPath(remote, local string, progress func(syncProgress)) error {
+	st, err := s.Stat(remote)
+	if err != nil {
+		return err
+	}
+	var total syncProgress
+	return s.pull(remote, local, st, &total, progress)
+}
+
+func (s *syncConn) pull(remote, local string, st syncStat, total *syncProgress, progress func(syncProgress)) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if st.Mode.IsDir() {
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return err
+		}
+		entries, err := s.List(remote)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// Skip symlinks and device files, like adb pull does
+			if !entry.Mode.IsDir() && !entry.Mode.IsRegular() {
+				continue
+			}
+			// The name comes from the device and must stay inside local
+			if !filepath.IsLocal(entry.Name) || filepath.Base(entry.Name) != entry.Name {
+				return fmt.Errorf("adb pull %s: unsafe name %q", remote, entry.Name)
+			}
+			if err := s.pull(path.Join(remote, entry.Name), filepath.Join(local, entry.Name), entry.syncStat, total, progress); err != nil {
+				return err
+			}
+		}
+		os.Chtimes(local, st.Mtime, st.Mtime)
+		return nil
+	}
+
+	f, err := os.OpenFile(local, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	total.Path, total.FileDone, total.FileSize = remote, 0, st.Size
+	err = s.Recv(remote, f, func(n int64) {
+		total.FileDone += n
+		total.BytesDone += n
+		if progress != nil {
+			progress(*total)
+		}
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(local)
+		return err
+	}
+	os.Chmod(local, st.Mode.Perm()|0200)
+	os.Chtimes(local, st.Mtime, st.Mtime)
+	total.Files++
+	if progress != nil {
+		progress(*total)
+	}
+	return nil
+}
+
+// pushPath copies a file or a whole directory tree to the device,
+// keeping permissions and modification times
+func (s *syncConn) pushPath(local, remote string, progress func(syncProgress)) error {
+	var total syncProgress
+	return filepath.WalkDir(local, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(local, file)
+		if err != nil {
+			return err
+		}
+		target := remote
+		if rel != "." {
+			target = path.Join(remote, filepath.ToSlash(rel))
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		total.Path, total.FileDone, total.FileSize = target, 0, info.Size()
+		err = s.Send(target, info.Mode(), info.ModTime(), f, func(n int64) {
+			total.FileDone += n
+			total.BytesDone += n
+			if progress != nil {
+				progress(total)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		total.Files++
+		if progress != nil {
+			progress(total)
+		}
+		return nil
+	})
+}
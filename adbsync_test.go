@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostileSyncDevice lists whatever names it is given for any folder
+type hostileSyncDevice struct {
+	names []string
+}
+
+func (d *hostileSyncDevice) deviceFeatures(ctx context.Context, serial string) (map[string]bool, error) {
+	return map[string]bool{}, nil
+}
+
+func (d *hostileSyncDevice) openService(ctx context.Context, serial, service string) (io.ReadWriteCloser, error) {
+	client, device := net.Pipe()
+	go d.serve(device)
+	return client, nil
+}
+
+func (d *hostileSyncDevice) serve(conn net.Conn) {
+	defer conn.Close()
+	u32 := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		io.CopyN(io.Discard, conn, int64(binary.LittleEndian.Uint32(header[4:])))
+		switch string(header[:4]) {
+		case "STAT":
+			conn.Write([]byte("STAT"))
+			conn.Write(u32(unixDir | 0o755))
+			conn.Write(u32(0))
+			conn.Write(u32(0))
+		case "LIST":
+			for _, name := range d.names {
+				conn.Write([]byte("DENT"))
+				conn.Write(u32(unixRegular | 0o644))
+				conn.Write(u32(4))
+				conn.Write(u32(0))
+				conn.Write(u32(uint32(len(name))))
+				conn.Write([]byte(name))
+			}
+			conn.Write(append([]byte("DONE"), make([]byte, 16)...))
+		default:
+			return
+		}
+	}
+}
+
+func TestPullRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"../evil", "a/../../evil", "sub/file", "/etc/passwd"} {
+		dir := t.TempDir()
+		local := filepath.Join(dir, "backup")
+		s, err := openSync(context.Background(), &hostileSyncDevice{names: []string{name}}, "X")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.pullPath("/sdcard/DCIM", local, nil)
+		s.Close()
+		if err == nil || !strings.Contains(err.Error(), "unsafe name") {
+			t.Errorf("%q: err = %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+			t.Errorf("%q: wrote outside the backup folder", name)
+		}
+	}
+}
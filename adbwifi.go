@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	defaultADBWifiPort = 5555
+	wifiConnectTries   = 10
+
+	// Preference key holding the host:port of every wireless device
+	prefWirelessEndpoints = "adb.wireless.endpoints"
+)
+
+// Connect asks the adb server to connect to adbd at host:port
+func (c *adbClient) Connect(ctx context.Context, addr string) (string, error) {
+	request := "host:connect:" + addr
+	reply, err := c.query(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	// The server answers OKAY even when the connection failed
+	if !strings.HasPrefix(reply, "connected to") && !strings.HasPrefix(reply, "already connected to") {
+		return reply, &ADBError{Request: request, Message: reply}
+	}
+	return reply, nil
+}
+
+// Disconnect drops the connection to a wireless device
+func (c *adbClient) Disconnect(ctx context.Context, addr string) error {
+	_, err := c.query(ctx, "host:disconnect:"+addr)
+	return err
+}
+
+// parseADBAddress accepts "host" or "host:port" and returns "host:port"
+func parseADBAddress(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("enter an IP address")
+	}
+	host, port, err := net.SplitHostPort(input)
+	if err != nil {
+		host, port = strings.Trim(input, "[]"), strconv.Itoa(defaultADBWifiPort)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// isWirelessSerial reports whether adb reaches the device over the network:
+// "192.168.1.20:5555" or an mDNS name like "adb-XYZ._adb-tls-connect._tcp"
+func isWirelessSerial(serial string) bool {
+	if strings.Contains(serial, "._adb-tls-connect.") {
+		return true
+	}
+	_, _, err := net.SplitHostPort(serial)
+	return err == nil
+}
+
+var wlanInetLine = regexp.MustCompile(`inet (\d+\.\d+\.\d+\.\d+)/`)
+var routeSrcField = regexp.MustCompile(`\bsrc (\d+\.\d+\.\d+\.\d+)`)
+
+// wifiIP reads the device's IPv4 address on wlan0
+func (t *FlashTool) wifiIP(ctx context.Context, serial string) (string, error) {
+	if result, err := t.adbShell(ctx, serial, "ip -f inet addr show wlan0"); err == nil {
+		if m := wlanInetLine.FindStringSubmatch(result.Stdout); m != nil {
+			return m[1], nil
+		}
+	}
+	// Some vendors name the interface differently
+	result, err := t.adbShell(ctx, serial, "ip route")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if strings.Contains(line, "wlan") || strings.Contains(line, "wifi") {
+			if m := routeSrcField.FindStringSubmatch(line); m != nil {
+				return m[1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no Wi-Fi address found, is Wi-Fi on?")
+}
+
+// savedEndpoints returns the wireless devices to reconnect on launch
+func savedEndpoints() []string {
+	return fyne.CurrentApp().Preferences().StringList(prefWirelessEndpoints)
+}
+
+func saveEndpoint(addr string) {
+	endpoints := savedEndpoints()
+	if !slices.Contains(endpoints, addr) {
+		fyne.CurrentApp().Preferences().SetStringList(prefWirelessEndpoints, append(endpoints, addr))
+	}
+}
+
+func forgetEndpoint(addr string) {
+	endpoints := slices.DeleteFunc(savedEndpoints(), func(e string) bool { return e == addr })
+	fyne.CurrentApp().Preferences().SetStringList(prefWirelessEndpoints, endpoints)
+}
+
+// adbEnableWifi switches the USB device to adb over TCP and connects to it
+func (t *FlashTool) adbEnableWifi(ctx context.Context) {
+	connected, deviceID, status := t.isADBDeviceConnected(ctx)
+	if !connected {
+		t.appendLog("❌ Cannot enable Wi-Fi ADB - device not connected")
+		t.appendLog(fmt.Sprintf("Status: %s", status))
+		return
+	}
+	if isWirelessSerial(deviceID) {
+		t.appendLog(fmt.Sprintf("✅ %s is already connected over Wi-Fi", deviceID))
+		return
+	}
+
+	nextStep(ctx, "read Wi-Fi address")
+	ip, err := t.wifiIP(ctx, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ %v", err))
+		return
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(defaultADBWifiPort))
+	t.appendLog(fmt.Sprintf("📶 Wi-Fi address: %s", ip))
+
+	nextStep(ctx, "tcpip")
+	transport, err := t.adbTransport(ctx, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ ADB server not available: %v", err))
+		return
+	}
+	reply, err := adbService(ctx, transport, deviceID, fmt.Sprintf("tcpip:%d", defaultADBWifiPort))
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ tcpip failed: %v", err))
+		return
+	}
+	t.appendLog(strings.TrimSpace(reply))
+
+	// adbd restarts before it listens on the new port
+	nextStep(ctx, "connect")
+	if err := t.adbConnectWifi(ctx, addr); err != nil {
+		return
+	}
+	t.appendLog("📌 You can unplug the USB cable now")
+}
+
+// adbConnectWifi connects to a wireless device, retrying while adbd
+// comes up, and remembers it for the next launch. Without an adb server
+// it connects to adbd directly.
+func (t *FlashTool) adbConnectWifi(ctx context.Context, addr string) error {
+	host, err := t.adbHost(ctx)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("⚠️ ADB server not available: %v", err))
+		return t.adbConnectDirect(ctx, addr)
+	}
+	t.appendLog(fmt.Sprintf("🔗 Connecting to %s...", addr))
+	for try := 1; ; try++ {
+		var reply string
+		reply, err = host.Connect(ctx, addr)
+		if err == nil {
+			t.appendLog("✅ " + reply)
+			saveEndpoint(addr)
+			return nil
+		}
+		if try == wifiConnectTries || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	if ctx.Err() == nil {
+		t.appendLog(fmt.Sprintf("❌ Connection failed: %v", err))
+	}
+	return err
+}
+
+// adbDisconnectWifi drops a wireless device and stops reconnecting to it
+func (t *FlashTool) adbDisconnectWifi(ctx context.Context, addr string) {
+	forgetEndpoint(addr)
+	if t.adbDisconnectDirect(addr) {
+		t.appendLog(fmt.Sprintf("⏏ Disconnected from %s", addr))
+		return
+	}
+	host, err := t.adbHost(ctx)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ ADB server not available: %v", err))
+		return
+	}
+	if err := host.Disconnect(ctx, addr); err != nil {
+		t.appendLog(fmt.Sprintf("⚠️ %v", err))
+	}
+	t.appendLog(fmt.Sprintf("⏏ Disconnected from %s", addr))
+}
+
+// reconnectWireless connects to the devices saved from earlier sessions
+func (t *FlashTool) reconnectWireless(ctx context.Context) {
+	endpoints := savedEndpoints()
+	if len(endpoints) == 0 {
+		return
+	}
+	host, err := t.adbHost(ctx)
+	if err != nil {
+		return
+	}
+	for _, addr := range endpoints {
+		if reply, err := host.Connect(ctx, addr); err != nil {
+			t.appendLog(fmt.Sprintf("📶 %s not reachable, will stay saved", addr))
+		} else {
+			t.appendLog("📶 " + reply)
+		}
+	}
+}
+
+// showConnectWifiDialog asks for the address of a wireless device
+func (t *FlashTool) showConnectWifiDialog() {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder(fmt.Sprintf("192.168.1.20 or 192.168.1.20:%d", defaultADBWifiPort))
+	direct := widget.NewCheck("Without adb server", nil)
+	dialog.ShowForm("Connect over Wi-Fi", "Connect", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Address", entry),
+			widget.NewFormItem("", direct),
+		},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			addr, err := parseADBAddress(entry.Text)
+			if err != nil {
+				dialog.ShowError(err, t.window)
+				return
+			}
+			connectDirect := direct.Checked
+			t.run(jobControl, "Connect Wi-Fi", func(ctx context.Context) {
+				if connectDirect {
+					t.adbConnectDirect(ctx, addr)
+				} else {
+					t.adbConnectWifi(ctx, addr)
+				}
+			})
+		}, t.window)
+}
+
+// showDisconnectWifiDialog lets the user pick a saved device to drop
+func (t *FlashTool) showDisconnectWifiDialog() {
+	endpoints := savedEndpoints()
+	for _, info := range t.direct.devices() {
+		if !slices.Contains(endpoints, info.Serial) {
+			endpoints = append(endpoints, info.Serial)
+		}
+	}
+	if len(endpoints) == 0 {
+		dialog.ShowInformation("Disconnect Wi-Fi", "No wireless devices saved", t.window)
+		return
+	}
+	choice := widget.NewSelect(endpoints, nil)
+	choice.SetSelectedIndex(0)
+	dialog.ShowForm("Disconnect Wi-Fi", "Disconnect", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Device", choice)},
+		func(ok bool) {
+			if !ok || choice.Selected == "" {
+				return
+			}
+			addr := choice.Selected
+			t.run(jobControl, "Disconnect Wi-Fi", func(ctx context.Context) {
+				t.adbDisconnectWifi(ctx, addr)
+			})
+		}, t.window)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// android-info.txt lists what a firmware bundle needs from the phone:
+//
+//	require board=oriole
+//	require version-bootloader=slider-1.3-10780582
+//	require-for-product:oriole version-baseband=g5123b-130914*|g5123b-140312*
+//	reject version-bootloader=slider-1.1*
+//	require partition-exists=vendor_dlkm
+//
+// Each line is checked against the live getvar value the way fastboot
+// update does before it flashes anything. Lines fastboot does not
+// understand are reported and skipped, as fastboot does.
+
+// infoRequirement is one require or reject line of android-info.txt
+type infoRequirement struct {
+	Line    int
+	Var     string   // getvar name, board, bootloader and baseband mapped
+	Values  []string // a trailing * matches any value starting with the rest
+	Reject  bool
+	Product string // require-for-product: checked on this product only
+}
+
+// What fastboot reads for the short names android-info.txt uses
+var infoVarNames = map[string]string{
+	"board":      "product",
+	"bootloader": "version-bootloader",
+	"baseband":   "version-baseband",
+}
+
+func (r *infoRequirement) String() string {
+	verb := "require"
+	switch {
+	case r.Reject:
+		verb = "reject"
+	case r.Product != "":
+		verb = "require-for-product:" + r.Product
+	}
+	return fmt.Sprintf("%s %s=%s", verb, r.Var, strings.Join(r.Values, "|"))
+}
+
+// match reports whether value satisfies the line, reject lines included
+func (r *infoRequirement) match(value string) bool {
+	matched := false
+	for _, want := range r.Values {
+		if prefix, wildcard := strings.CutSuffix(want, "*"); (wildcard && strings.HasPrefix(value, prefix)) || want == value {
+			matched = true
+			break
+		}
+	}
+	return matched != r.Reject
+}
+
+// mismatch explains a failed line in fastboot update's words
+func (r *infoRequirement) mismatch(value string) string {
+	verb := "requires"
+	if r.Reject {
+		verb = "rejects"
+	}
+	return fmt.Sprintf("Device %s is '%s'. Update %s '%s'.", r.Var, value, verb, strings.Join(r.Values, "' or '"))
+}
+
+// parseAndroidInfo reads the require and reject lines of android-info.txt.
+// skipped describes the lines that are neither.
+func parseAndroidInfo(text string) (requirements []*infoRequirement, skipped []string) {
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		skip := func(reason string) {
+			skipped = append(skipped, fmt.Sprintf("android-info.txt line %d: %s: %s", i+1, reason, line))
+		}
+		verb, rest, _ := strings.Cut(line, " ")
+		r := &infoRequirement{Line: i + 1}
+		switch {
+		case verb == "require":
+		case verb == "reject":
+			r.Reject = true
+		case strings.HasPrefix(verb, "require-for-product:"):
+			r.Product = strings.TrimPrefix(verb, "require-for-product:")
+		default:
+			skip("not a require or reject line")
+			continue
+		}
+		name, values, ok := strings.Cut(strings.TrimSpace(rest), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			skip("expected name=value")
+			continue
+		}
+		if mapped, found := infoVarNames[name]; found {
+			name = mapped
+		}
+		r.Var = name
+		for _, value := range strings.Split(values, "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				r.Values = append(r.Values, value)
+			}
+		}
+		if len(r.Values) == 0 {
+			skip("no value")
+			continue
+		}
+		requirements = append(requirements, r)
+	}
+	return requirements, skipped
+}
+
+// loadAndroidInfo reads android-info.txt at path
+func loadAndroidInfo(path string) ([]*infoRequirement, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	requirements, skipped := parseAndroidInfo(string(data))
+	return requirements, skipped, nil
+}
+
+// checkRequirement reads the variable of one line from the phone. The
+// error is only set when the phone stopped answering.
+func checkRequirement(ctx context.Context, conn fastbootConn, r *infoRequirement) (preflightCheck, error) {
+	check := preflightCheck{Name: "Checking '" + r.Var + "'"}
+	if r.Product != "" {
+		product, err := conn.GetVar(ctx, "product")
+		if err != nil && !isFastbootError(err) {
+			return check, err
+		}
+		if product != r.Product {
+			check.Result = checkPassed
+			check.Detail = fmt.Sprintf("IGNORE, product is %s required only for %s", product, r.Product)
+			return check, nil
+		}
+	}
+	if r.Var == "partition-exists" {
+		return checkPartitionExists(ctx, conn, r.Values[0])
+	}
+	value, err := conn.GetVar(ctx, r.Var)
+	if err != nil {
+		if !isFastbootError(err) {
+			return check, err
+		}
+		check.Result = checkFailed
+		check.Detail = fmt.Sprintf("Could not getvar for '%s' (%v)", r.Var, err)
+		return check, nil
+	}
+	if !r.match(value) {
+		check.Result = checkFailed
+		check.Detail = r.mismatch(value)
+		return check, nil
+	}
+	check.Result = checkPassed
+	check.Detail = value
+	return check, nil
+}
+
+// checkPartitionExists asks for has-slot:<name> like fastboot update, any
+// yes or no means the partition is there. Bootloaders without has-slot
+// still answer partition-type:<name> for their partitions.
+func checkPartitionExists(ctx context.Context, conn fastbootConn, name string) (preflightCheck, error) {
+	check := preflightCheck{Name: "Checking partition '" + name + "'"}
+	value, err := conn.GetVar(ctx, "has-slot:"+name)
+	if err != nil && !isFastbootError(err) {
+		return check, err
+	}
+	if err == nil && (value == "yes" || value == "no") {
+		check.Result = checkPassed
+		check.Detail = "exists"
+		return check, nil
+	}
+	value, err = conn.GetVar(ctx, "partition-type:"+name)
+	if err != nil && !isFastbootError(err) {
+		return check, err
+	}
+	if err == nil && value != "" {
+		check.Result = checkPassed
+		check.Detail = "exists, " + value
+		return check, nil
+	}
+	check.Result = checkFailed
+	check.Detail = fmt.Sprintf("Device doesn't have required partition %s", name)
+	return check, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckPartitionExists(t *testing.T) {
+	requirements, _ := parseAndroidInfo("require partition-exists=vendor_dlkm\n")
+	tests := []struct {
+		name   string
+		vars   map[string]string
+		result string
+	}{
+		{name: "has-slot yes", vars: map[string]string{"has-slot:vendor_dlkm": "yes"}, result: checkPassed},
+		{name: "has-slot no", vars: map[string]string{"has-slot:vendor_dlkm": "no"}, result: checkPassed},
+		{name: "partition-type only", vars: map[string]string{"partition-type:vendor_dlkm": "raw"}, result: checkPassed},
+		{name: "has-slot garbage", vars: map[string]string{"has-slot:vendor_dlkm": "maybe"}, result: checkFailed},
+		{name: "missing", vars: map[string]string{"has-slot:boot": "yes"}, result: checkFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dev := NewFakeFastboot(test.vars)
+			defer dev.Close()
+			check, err := checkRequirement(context.Background(), newFastbootClient(dev, "X"), requirements[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.Result != test.result || check.Name != "Checking partition 'vendor_dlkm'" {
+				t.Errorf("check = %v", check)
+			}
+			// Never read as a variable of its own
+			for _, command := range dev.Commands() {
+				if command == "getvar:partition-exists" {
+					t.Error("asked for getvar:partition-exists")
+				}
+			}
+		})
+	}
+}
+
+func TestParseAndroidInfo(t *testing.T) {
+	requirements, skipped := parseAndroidInfo("# oriole\r\n" +
+		"require board=oriole|raven\r\n" +
+		"\r\n" +
+		"require version-bootloader=slider-1.3*\n" +
+		"reject baseband=g5123b-1*\n" +
+		"require-for-product:cheetah version-baseband=g5300q-230626-230818\n" +
+		"require partition-exists=vendor_dlkm\n" +
+		"board=oriole\n" +
+		"require board\n" +
+		"require board=|\n")
+	var got []string
+	for _, r := range requirements {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"require product=oriole|raven",
+		"require version-bootloader=slider-1.3*",
+		"reject version-baseband=g5123b-1*",
+		"require-for-product:cheetah version-baseband=g5300q-230626-230818",
+		"require partition-exists=vendor_dlkm",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requirements =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// Lines fastboot does not understand are skipped, not fatal
+	wantSkipped := []string{
+		"android-info.txt line 8: not a require or reject line: board=oriole",
+		"android-info.txt line 9: expected name=value: require board",
+		"android-info.txt line 10: no value: require board=|",
+	}
+	if strings.Join(skipped, "\n") != strings.Join(wantSkipped, "\n") {
+		t.Errorf("skipped = %q", skipped)
+	}
+	if requirements[3].Product != "cheetah" || requirements[2].Line != 5 {
+		t.Errorf("requirements = %+v, %+v", requirements[2], requirements[3])
+	}
+
+	matches := []struct {
+		r     int
+		value string
+		match bool
+	}{
+		{0, "oriole", true},
+		{0, "raven", true},
+		{0, "oriole2", false},
+		{0, "cheetah", false},
+		{1, "slider-1.3-10780582", true},
+		{1, "slider-1.3", true},
+		{1, "slider-1.2-9152140", false},
+		{2, "g5123b-130914-230626-b-10399817", false},
+		{2, "g5300q-230626-230818", true},
+		{2, "", true},
+	}
+	for _, m := range matches {
+		if got := requirements[m.r].match(m.value); got != m.match {
+			t.Errorf("%s matches %q = %v", requirements[m.r], m.value, got)
+		}
+	}
+	if got := requirements[0].mismatch("cheetah"); got != "Device product is 'cheetah'. Update requires 'oriole' or 'raven'." {
+		t.Errorf("mismatch = %q", got)
+	}
+}
+
+func TestCheckRequirementForOtherProduct(t *testing.T) {
+	requirements, _ := parseAndroidInfo("require-for-product:cheetah version-baseband=g5300q-230626-230818\n")
+	dev := NewFakeFastboot(map[string]string{"product": "oriole", "version-baseband": "g5123b-130914"})
+	defer dev.Close()
+	check, err := checkRequirement(context.Background(), newFastbootClient(dev, "X"), requirements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Result != checkPassed || !strings.HasPrefix(check.Detail, "IGNORE") {
+		t.Errorf("check = %v", check)
+	}
+	for _, command := range dev.Commands() {
+		if command == "getvar:version-baseband" {
+			t.Error("read the baseband of a product the line is not for")
+		}
+	}
+}
@@ -1,22 +1,178 @@
 package main
 import (
-	 
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
 )
 
+// Folders on internal storage that make up a backup
+var backupFolders = []string{"DCIM", "Pictures", "Download", "Documents", "Music", "Movies", "Recordings"}
+
+const sdcardRoot = "/sdcard"
+
+// Network serials like 192.168.1.20:5555 are not valid folder names on Windows
+var serialPathReplacer = strings.NewReplacer(":", "_", "\\", "_", "/", "_")
+
+//androidBackup pulls the user folders into a new folder under dir
+func (t *FlashTool) androidBackup(ctx context.Context, dir string) {
+	connected, deviceID, status := t.isADBDeviceConnected(ctx)
+	if !connected {
+		t.appendLog("❌ Cannot back up - device not connected")
+		t.appendLog(fmt.Sprintf("Status: %s", status))
+		return
+	}
 
-//androidBackup
-func (t *FlashTool) androidBackup() {
-    t.appendLog("Starting Android backup...")
-    // Implement backup logic here
+	target := filepath.Join(dir, fmt.Sprintf("%s-%s", serialPathReplacer.Replace(deviceID), time.Now().Format("20060102-150405")))
+	t.appendLog("Starting Android backup...")
+	t.appendLog(fmt.Sprintf("📁 Saving to %s", target))
+
+	transport, err := t.adbTransport(ctx, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ ADB server not available: %v", err))
+		return
+	}
+	conn, err := openSync(ctx, transport, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ Cannot open sync service: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	defer t.hideTransferProgress()
+	var files int
+	var bytes int64
+	for _, folder := range backupFolders {
+		nextStep(ctx, "pull "+folder)
+		remote := sdcardRoot + "/" + folder
+		err := conn.pullPath(remote, filepath.Join(target, folder), t.showTransferProgress("📥 "+folder))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			t.appendLog(fmt.Sprintf("⏭ %s not found, skipped", remote))
+			continue
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			t.appendLog(fmt.Sprintf("❌ Backup of %s failed: %v", remote, err))
+			return
+		}
+		n, size := countFiles(filepath.Join(target, folder))
+		files += n
+		bytes += size
+		t.appendLog(fmt.Sprintf("✅ %s: %d files, %s", folder, n, formatBytes(size)))
+	}
+
+	t.appendLog(fmt.Sprintf("\n✅ Backup complete: %d files, %s in %.1fs", files, formatBytes(bytes), time.Since(start).Seconds()))
 }
 
-//androidRestore
-func (t *FlashTool) androidRestore() {
+//androidRestore pushes every folder of a backup back to internal storage
+func (t *FlashTool) androidRestore(ctx context.Context, dir string) {
+	connected, deviceID, status := t.isADBDeviceConnected(ctx)
+	if !connected {
+		t.appendLog("❌ Cannot restore - device not connected")
+		t.appendLog(fmt.Sprintf("Status: %s", status))
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ Cannot read %s: %v", dir, err))
+		return
+	}
 	t.appendLog("Starting Android restore...")
-	// Implement restore logic here
-	// Example of updating log output (ensure currentText and message are defined appropriately)
-	// currentText := t.logOutput.Text
-	// message := "Restore completed."
-	// t.logOutput.SetText(currentText + "\n" + message)
+	t.appendLog(fmt.Sprintf("📁 Restoring from %s", dir))
+
+	transport, err := t.adbTransport(ctx, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ ADB server not available: %v", err))
+		return
+	}
+	conn, err := openSync(ctx, transport, deviceID)
+	if err != nil {
+		t.appendLog(fmt.Sprintf("❌ Cannot open sync service: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	defer t.hideTransferProgress()
+	restored := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		nextStep(ctx, "push "+entry.Name())
+		remote := sdcardRoot + "/" + entry.Name()
+		err := conn.pushPath(filepath.Join(dir, entry.Name()), remote, t.showTransferProgress("📤 "+entry.Name()))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			t.appendLog(fmt.Sprintf("❌ Restore of %s failed: %v", remote, err))
+			return
+		}
+		n, size := countFiles(filepath.Join(dir, entry.Name()))
+		t.appendLog(fmt.Sprintf("✅ %s: %d files, %s", entry.Name(), n, formatBytes(size)))
+		restored++
+	}
+
+	if restored == 0 {
+		t.appendLog("⚠️ Nothing to restore - pick a folder created by Backup")
+		return
+	}
+	t.appendLog(fmt.Sprintf("\n✅ Restore complete in %.1fs", time.Since(start).Seconds()))
+}
+
+// showTransferProgress returns a sync progress callback that drives the
+// progress bar, at most a few updates per second
+func (t *FlashTool) showTransferProgress(title string) func(syncProgress) {
+	fyne.Do(func() {
+		t.progressBar.SetValue(0)
+		t.progressLabel.SetText(title)
+		t.progressBox.Show()
+	})
+	var last time.Time
+	return func(p syncProgress) {
+		if p.FileDone < p.FileSize && time.Since(last) < 200*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		fraction := 1.0
+		if p.FileSize > 0 {
+			fraction = float64(p.FileDone) / float64(p.FileSize)
+		}
+		label := fmt.Sprintf("%s  %s  (%s / %s, %d files, %s total)", title, filepath.Base(p.Path),
+			formatBytes(p.FileDone), formatBytes(p.FileSize), p.Files, formatBytes(p.BytesDone))
+		fyne.Do(func() {
+			t.progressBar.SetValue(fraction)
+			t.progressLabel.SetText(label)
+		})
+	}
+}
+
+func (t *FlashTool) hideTransferProgress() {
+	fyne.Do(t.progressBox.Hide)
 }
 
+// countFiles returns the number and total size of regular files under dir
+func countFiles(dir string) (int, int64) {
+	var n int
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				n++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return n, size
+}
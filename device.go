@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Oldest entries are dropped beyond this many mode changes
+const maxModeHistory = 50
+
+// modeChange is one entry of a phone's mode history
+type modeChange struct {
+	Time   time.Time
+	From   deviceMode
+	To     deviceMode
+	SeenAs string // serial the phone showed up under
+}
+
+func (c modeChange) String() string {
+	return fmt.Sprintf("%s  %s → %s  (%s)", c.Time.Format("15:04:05"), describeMode(c.From), describeMode(c.To), c.SeenAs)
+}
+
+// Device is one phone, followed across adb, fastboot and recovery. It is
+// keyed by the hardware serial number; other serials the phone shows up
+// under (Wi-Fi adb, network fastboot) become aliases once its props or
+// variables tell us it is the same phone.
+type Device struct {
+	Serial   string
+	Mode     deviceMode
+	SeenAs   string            // serial of the current mode
+	Info     adbDeviceInfo     // last host:devices-l entry
+	Props    map[string]string // last getprop
+	Vars     map[string]string // fastboot variables read so far
+	History  []modeChange
+	LastSeen time.Time
+
+	source string // watcher source that reported Mode
+}
+
+// Model is the best name we know for the phone's model
+func (d Device) Model() string {
+	if model := d.Props["ro.product.model"]; model != "" {
+		return model
+	}
+	if d.Info.Model != "" {
+		return strings.ReplaceAll(d.Info.Model, "_", " ")
+	}
+	return d.Vars["product"]
+}
+
+// Name is how the UI refers to the phone in every mode
+func (d Device) Name() string {
+	if model := d.Model(); model != "" {
+		return model + " · " + d.Serial
+	}
+	return d.Serial
+}
+
+// deviceRegistry holds every phone seen since the app started
+type deviceRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*Device
+	aliases map[string]string // other serial -> hardware serial
+}
+
+// lookup returns the phone seen as serial, creating it. r.mu must be held.
+func (r *deviceRegistry) lookup(serial string) *Device {
+	if r.devices == nil {
+		r.devices = make(map[string]*Device)
+		r.aliases = make(map[string]string)
+	}
+	if key, ok := r.aliases[serial]; ok {
+		serial = key
+	}
+	d, ok := r.devices[serial]
+	if !ok {
+		d = &Device{Serial: serial, Props: map[string]string{}, Vars: map[string]string{}}
+		r.devices[serial] = d
+	}
+	return d
+}
+
+// observe follows a watcher event into the phone's mode and history
+func (r *deviceRegistry) observe(e deviceEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.lookup(e.Serial)
+	d.LastSeen = e.Time
+	switch {
+	case e.Kind == eventDisconnected:
+		// Only the source that reported the mode can take it away, the
+		// phone may already be up in the other one
+		if d.source == e.Source && d.SeenAs == e.Serial {
+			d.setMode(modeNone, "", e.Serial, e.Time)
+		}
+	case e.Source == sourceFastboot:
+		d.setMode(modeFastboot, e.Source, e.Serial, e.Time)
+	default:
+		if e.Info.Serial != "" {
+			d.Info = e.Info
+		}
+		d.setMode(adbStateMode(e.State), e.Source, e.Serial, e.Time)
+	}
+}
+
+func (d *Device) setMode(mode deviceMode, source, seenAs string, at time.Time) {
+	if mode != d.Mode {
+		d.History = append(d.History, modeChange{Time: at, From: d.Mode, To: mode, SeenAs: seenAs})
+		if len(d.History) > maxModeHistory {
+			d.History = d.History[len(d.History)-maxModeHistory:]
+		}
+	}
+	d.Mode, d.source = mode, source
+	if mode != modeNone {
+		d.SeenAs = seenAs
+	}
+}
+
+// setProps stores a full getprop of the phone seen as serial
+func (r *deviceRegistry) setProps(serial string, props map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookup(serial).Props = maps.Clone(props)
+	r.link(serial, props["ro.serialno"])
+}
+
+// setVar stores one fastboot variable of the phone seen as serial
+func (r *deviceRegistry) setVar(serial, name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookup(serial).Vars[name] = value
+	if name == "serialno" {
+		r.link(serial, value)
+	}
+}
+
+// link records that serial is the phone with hardware serial hw and merges
+// what was known under both. r.mu must be held.
+func (r *deviceRegistry) link(serial, hw string) {
+	hw = strings.TrimSpace(hw)
+	if hw == "" || r.lookup(serial).Serial == hw {
+		return
+	}
+	alias := r.lookup(serial)
+	d := r.lookup(hw)
+	if alias == d {
+		return
+	}
+
+	maps.Copy(d.Props, alias.Props)
+	maps.Copy(d.Vars, alias.Vars)
+	if alias.Info.Serial != "" {
+		d.Info = alias.Info
+	}
+	d.History = append(d.History, alias.History...)
+	sort.SliceStable(d.History, func(i, j int) bool { return d.History[i].Time.Before(d.History[j].Time) })
+	if alias.LastSeen.After(d.LastSeen) {
+		d.LastSeen = alias.LastSeen
+		if alias.Mode != modeNone {
+			d.Mode, d.SeenAs, d.source = alias.Mode, alias.SeenAs, alias.source
+		}
+	}
+
+	delete(r.devices, alias.Serial)
+	r.aliases[alias.Serial] = d.Serial
+	for other, key := range r.aliases {
+		if key == alias.Serial {
+			r.aliases[other] = d.Serial
+		}
+	}
+	r.aliases[serial] = d.Serial
+}
+
+// get returns a copy of the phone seen as serial
+func (r *deviceRegistry) get(serial string) Device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := *r.lookup(serial)
+	d.Props = maps.Clone(d.Props)
+	d.Vars = maps.Clone(d.Vars)
+	d.History = slices.Clone(d.History)
+	return d
+}
+
+// name is the display name of the phone seen as serial
+func (r *deviceRegistry) name(serial string) string {
+	return r.get(serial).Name()
+}
+
+// connected returns the phones currently visible in some mode
+func (r *deviceRegistry) connected() []Device {
+	r.mu.Lock()
+	var serials []string
+	for serial, d := range r.devices {
+		if d.Mode != modeNone {
+			serials = append(serials, serial)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(serials)
+	var devices []Device
+	for _, serial := range serials {
+		devices = append(devices, r.get(serial))
+	}
+	return devices
+}
+
+// varRecorder remembers every variable read through a fastboot
+// connection on the phone it belongs to
+type varRecorder struct {
+	fastbootConn
+	devices *deviceRegistry
+}
+
+func (v varRecorder) GetVar(ctx context.Context, name string) (string, error) {
+	value, err := v.fastbootConn.GetVar(ctx, name)
+	if err == nil {
+		v.devices.setVar(v.Serial(), name, value)
+	}
+	return value, err
+}
+
+// readDeviceProps fills in the props of a phone that just came up in adb
+func (t *FlashTool) readDeviceProps(serial string) {
+	ctx, cancel := context.WithTimeout(context.Background(), quickTimeout)
+	defer cancel()
+	result, err := t.adbShell(ctx, serial, "getprop")
+	if err != nil {
+		return
+	}
+	t.devices.setProps(serial, parseGetprop(result.Stdout))
+	t.refreshDeviceStatus()
+}
+
+// Props worth showing in the phone panel
+var phoneProps = []struct {
+	label string
+	prop  string
+}{
+	{"Brand", "ro.product.brand"},
+	{"Device", "ro.product.device"},
+	{"Android", "ro.build.version.release"},
+	{"Build", "ro.build.display.id"},
+	{"Security patch", "ro.build.version.security_patch"},
+}
+
+// showPhoneInfo shows what is known about the target phone, whatever mode
+// it is in now
+func (t *FlashTool) showPhoneInfo() {
+	serial := t.target.get()
+	if serial == "" {
+		phones := t.devices.connected()
+		switch len(phones) {
+		case 0:
+			dialog.ShowInformation("Phone", "📵 No device", t.window)
+			return
+		case 1:
+			serial = phones[0].Serial
+		default:
+			dialog.ShowError(errAmbiguousTarget, t.window)
+			return
+		}
+	}
+	d := t.devices.get(serial)
+
+	lines := []string{
+		fmt.Sprintf("%-16s: %s", "Phone", d.Name()),
+		fmt.Sprintf("%-16s: %s", "Mode", describeMode(d.Mode)),
+	}
+	if d.SeenAs != "" && d.SeenAs != d.Serial {
+		lines = append(lines, fmt.Sprintf("%-16s: %s", "Connected as", d.SeenAs))
+	}
+	if !d.LastSeen.IsZero() {
+		lines = append(lines, fmt.Sprintf("%-16s: %s", "Last seen", d.LastSeen.Format("15:04:05")))
+	}
+	for _, p := range phoneProps {
+		if value := d.Props[p.prop]; value != "" {
+			lines = append(lines, fmt.Sprintf("%-16s: %s", p.label, value))
+		}
+	}
+	if len(d.Vars) > 0 {
+		lines = append(lines, "", "Fastboot variables:")
+		for _, name := range slices.Sorted(maps.Keys(d.Vars)) {
+			lines = append(lines, fmt.Sprintf("   %s: %s", name, d.Vars[name]))
+		}
+	}
+	if len(d.History) > 0 {
+		lines = append(lines, "", "Mode history:")
+		for _, change := range d.History {
+			lines = append(lines, "   "+change.String())
+		}
+	}
+
+	text := widget.NewLabel(strings.Join(lines, "\n"))
+	text.TextStyle = fyne.TextStyle{Monospace: true}
+	scroll := container.NewVScroll(text)
+	scroll.SetMinSize(fyne.NewSize(520, 360))
+	dialog.ShowCustom("Phone", "Close", scroll, t.window)
+}
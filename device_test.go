@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeHistory writes a mode history as "from>to@seenAs" entries
+func describeHistory(history []modeChange) string {
+	var entries []string
+	for _, c := range history {
+		entries = append(entries, string(c.From)+">"+string(c.To)+"@"+c.SeenAs)
+	}
+	return strings.Join(entries, " ")
+}
+
+func TestDeviceRegistryLinks(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	t.Run("adb then fastboot", func(t *testing.T) {
+		var r deviceRegistry
+		r.observe(deviceEvent{Time: at(0), Kind: eventConnected, Serial: "192.168.1.20:5555", Source: sourceADB, State: "device"})
+		r.setProps("192.168.1.20:5555", map[string]string{"ro.serialno": "R5CN1234", "ro.product.model": "Galaxy S21"})
+		r.observe(deviceEvent{Time: at(1), Kind: eventDisconnected, Serial: "192.168.1.20:5555", Source: sourceADB})
+		r.observe(deviceEvent{Time: at(2), Kind: eventConnected, Serial: "R5CN1234", Source: sourceFastboot, State: "fastboot"})
+
+		devices := r.connected()
+		if len(devices) != 1 {
+			t.Fatalf("devices = %+v", devices)
+		}
+		d := devices[0]
+		if d.Serial != "R5CN1234" || d.Mode != modeFastboot || d.SeenAs != "R5CN1234" || d.Model() != "Galaxy S21" {
+			t.Errorf("device = %+v", d)
+		}
+		if got := describeHistory(d.History); got != ">adb@192.168.1.20:5555 adb>@192.168.1.20:5555 >fastboot@R5CN1234" {
+			t.Errorf("history = %s", got)
+		}
+		if r.get("192.168.1.20:5555").Serial != "R5CN1234" {
+			t.Error("the network serial is not an alias")
+		}
+	})
+
+	t.Run("fastboot then adb", func(t *testing.T) {
+		var r deviceRegistry
+		r.observe(deviceEvent{Time: at(0), Kind: eventConnected, Serial: "R5CN1234", Source: sourceFastboot, State: "fastboot"})
+		r.setVar("R5CN1234", "product", "o1s")
+		r.observe(deviceEvent{Time: at(1), Kind: eventDisconnected, Serial: "R5CN1234", Source: sourceFastboot})
+		r.observe(deviceEvent{Time: at(2), Kind: eventConnected, Serial: "192.168.1.20:5555", Source: sourceADB, State: "device"})
+		// Until its props are read the network phone looks like another one
+		if devices := r.connected(); len(devices) != 1 || devices[0].Serial != "192.168.1.20:5555" {
+			t.Fatalf("devices = %+v", devices)
+		}
+		r.setProps("192.168.1.20:5555", map[string]string{"ro.serialno": "R5CN1234"})
+
+		d := r.get("192.168.1.20:5555")
+		if d.Serial != "R5CN1234" || d.Mode != modeADB || d.SeenAs != "192.168.1.20:5555" || d.Vars["product"] != "o1s" {
+			t.Errorf("device = %+v", d)
+		}
+		// Both histories in time order
+		if got := describeHistory(d.History); got != ">fastboot@R5CN1234 fastboot>@R5CN1234 >adb@192.168.1.20:5555" {
+			t.Errorf("history = %s", got)
+		}
+		// The adb watcher still reports the network serial
+		r.observe(deviceEvent{Time: at(3), Kind: eventDisconnected, Serial: "192.168.1.20:5555", Source: sourceADB})
+		if devices := r.connected(); len(devices) != 0 {
+			t.Errorf("devices after disconnect = %+v", devices)
+		}
+	})
+
+	t.Run("two phones", func(t *testing.T) {
+		var r deviceRegistry
+		r.observe(deviceEvent{Time: at(0), Kind: eventConnected, Serial: "R5CN1234", Source: sourceFastboot, State: "fastboot"})
+		r.setVar("R5CN1234", "serialno", "R5CN1234")
+		r.observe(deviceEvent{Time: at(1), Kind: eventConnected, Serial: "192.168.1.30:5555", Source: sourceADB, State: "device"})
+		r.setProps("192.168.1.30:5555", map[string]string{"ro.serialno": "9B071FFAZ00123"})
+
+		devices := r.connected()
+		if len(devices) != 2 || devices[0].Serial != "9B071FFAZ00123" || devices[1].Serial != "R5CN1234" {
+			t.Fatalf("devices = %+v", devices)
+		}
+		if first := devices[1]; first.Mode != modeFastboot || describeHistory(first.History) != ">fastboot@R5CN1234" {
+			t.Errorf("first phone = %+v", first)
+		}
+		if second := devices[0]; second.Mode != modeADB || second.SeenAs != "192.168.1.30:5555" {
+			t.Errorf("second phone = %+v", second)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Shown in the target list when no device is chosen
+const targetAuto = "Auto (single device)"
+
+var errAmbiguousTarget = errors.New("several devices connected, choose the target device first")
+
+// selectedTarget is the device the user chose in the target list. Empty
+// means "the only device connected".
+type selectedTarget struct {
+	mu     sync.Mutex
+	serial string
+}
+
+func (s *selectedTarget) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serial
+}
+
+func (s *selectedTarget) set(serial string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial = serial
+}
+
+type targetKey struct{}
+
+// withTarget pins the device a job was started for, so changing the
+// selection later does not redirect a running job
+func withTarget(ctx context.Context, serial string) context.Context {
+	return context.WithValue(ctx, targetKey{}, serial)
+}
+
+// targetFrom returns the serial pinned by withTarget, empty for "auto"
+func targetFrom(ctx context.Context) string {
+	serial, _ := ctx.Value(targetKey{}).(string)
+	return serial
+}
+
+// pickTarget chooses the device to talk to among the candidates of one
+// mode: the selected one, or else the only one. errNone is returned
+// when there is nothing to pick.
+func pickTarget(selected string, candidates []string, errNone error) (string, error) {
+	if selected != "" {
+		if slices.Contains(candidates, selected) {
+			return selected, nil
+		}
+		return "", fmt.Errorf("%w (%s is selected)", errNone, selected)
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errNone
+	case 1:
+		return candidates[0], nil
+	}
+	return "", errAmbiguousTarget
+}
+
+// logTargetError explains why an operation found no device to run on
+func (t *FlashTool) logTargetError(err error) {
+	if err == errNoFastbootDevice {
+		t.appendLog("Error: No device connected!")
+		return
+	}
+	t.appendLog(fmt.Sprintf("❌ %v", err))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Device sources reported by the watcher
+const (
+	sourceADB      = "adb"
+	sourceFastboot = "fastboot"
+)
+
+const (
+	fastbootPollInterval = 2 * time.Second
+	trackRetryMin        = 2 * time.Second
+	trackRetryMax        = 10 * time.Second
+)
+
+// Kinds of device events
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventChanged      = "changed"
+)
+
+// deviceEvent is published whenever a device appears, leaves or changes
+// state (device, unauthorized, offline, recovery, sideload, bootloader)
+type deviceEvent struct {
+	Time     time.Time
+	Kind     string
+	Serial   string
+	Source   string
+	OldState string
+	State    string
+	Info     adbDeviceInfo // from host:track-devices-l, adb only
+}
+
+func (e deviceEvent) String() string {
+	switch e.Kind {
+	case eventConnected:
+		return fmt.Sprintf("🔌 %s connected (%s)", e.Serial, e.State)
+	case eventDisconnected:
+		return fmt.Sprintf("⏏ %s disconnected", e.Serial)
+	}
+	return fmt.Sprintf("🔄 %s: %s → %s", e.Serial, e.OldState, e.State)
+}
+
+// watchedDevice is the last known state of a device
+type watchedDevice struct {
+	Serial string
+	Source string
+	State  string
+	Info   adbDeviceInfo
+}
+
+// deviceWatcher follows devices without anyone pressing "Check Device":
+// adb devices through host:track-devices-l, fastboot ones by polling
+type deviceWatcher struct {
+	adb           *adbClient
+	startServer   func(ctx context.Context) error
+	listFastboot  func(ctx context.Context) ([]deviceEntry, error)
+	pauseFastboot func() bool // fastboot is not polled while this is true
+
+	mu          sync.Mutex
+	devices     map[string]watchedDevice // keyed by source + serial
+	subscribers []func(deviceEvent)
+}
+
+// subscribe registers fn for every future event
+func (w *deviceWatcher) subscribe(fn func(deviceEvent)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// snapshot returns all known devices sorted by serial
+func (w *deviceWatcher) snapshot() []watchedDevice {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	devices := make([]watchedDevice, 0, len(w.devices))
+	for _, device := range w.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Serial != devices[j].Serial {
+			return devices[i].Serial < devices[j].Serial
+		}
+		return devices[i].Source < devices[j].Source
+	})
+	return devices
+}
+
+func (w *deviceWatcher) start(ctx context.Context) {
+	if w.devices == nil {
+		w.devices = make(map[string]watchedDevice)
+	}
+	go w.trackADB(ctx)
+	go w.pollFastboot(ctx)
+}
+
+// trackADB keeps a track-devices connection open, reconnecting with a
+// growing delay while the adb server is unavailable
+func (w *deviceWatcher) trackADB(ctx context.Context) {
+	retry := trackRetryMin
+	for ctx.Err() == nil {
+		err := w.trackOnce(ctx)
+		// Whatever the server knew is gone with the connection
+		w.update(sourceADB, nil)
+		if err == nil {
+			retry = trackRetryMin
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, trackRetryMax)
+		if w.startServer != nil {
+			w.startServer(ctx)
+		}
+	}
+}
+
+// trackOnce reads device lists from one track-devices connection. The
+// server sends the full list again after every change.
+func (w *deviceWatcher) trackOnce(ctx context.Context) error {
+	conn, err := w.adb.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := w.adb.roundTrip(ctx, conn, "host:track-devices-l"); err != nil {
+		return err
+	}
+	for {
+		list, err := readHexString(conn)
+		if err != nil {
+			return err
+		}
+		var devices []watchedDevice
+		for _, info := range parseDevicesLong(list) {
+			devices = append(devices, watchedDevice{Serial: info.Serial, Source: sourceADB, State: info.State, Info: info})
+		}
+		w.update(sourceADB, devices)
+	}
+}
+
+func (w *deviceWatcher) pollFastboot(ctx context.Context) {
+	ticker := time.NewTicker(fastbootPollInterval)
+	defer ticker.Stop()
+	for {
+		if w.pauseFastboot == nil || !w.pauseFastboot() {
+			if entries, err := w.listFastboot(ctx); err == nil {
+				var devices []watchedDevice
+				for _, entry := range entries {
+					devices = append(devices, watchedDevice{Serial: entry.Serial, Source: sourceFastboot, State: "bootloader"})
+				}
+				w.update(sourceFastboot, devices)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update replaces the device list of one source and publishes the changes
+func (w *deviceWatcher) update(source string, devices []watchedDevice) {
+	now := time.Now()
+	var events []deviceEvent
+
+	w.mu.Lock()
+	if w.devices == nil {
+		w.devices = make(map[string]watchedDevice)
+	}
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		key := source + "/" + device.Serial
+		seen[key] = true
+		old, known := w.devices[key]
+		w.devices[key] = device
+		switch {
+		case !known:
+			events = append(events, deviceEvent{Time: now, Kind: eventConnected, Serial: device.Serial, Source: source, State: device.State, Info: device.Info})
+		case old.State != device.State:
+			events = append(events, deviceEvent{Time: now, Kind: eventChanged, Serial: device.Serial, Source: source, OldState: old.State, State: device.State, Info: device.Info})
+		}
+	}
+	for key, old := range w.devices {
+		if old.Source == source && !seen[key] {
+			delete(w.devices, key)
+			events = append(events, deviceEvent{Time: now, Kind: eventDisconnected, Serial: old.Serial, Source: source, OldState: old.State})
+		}
+	}
+	subscribers := slices.Clone(w.subscribers)
+	w.mu.Unlock()
+
+	for _, event := range events {
+		for _, fn := range subscribers {
+			fn(event)
+		}
+	}
+}
+
+// List devices in fastboot mode
+func (t *FlashTool) fastbootDevices(ctx context.Context) ([]deviceEntry, error) {
+	result, err := t.fastboot(ctx, quickTimeout, "devices")
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceList(result.Stdout), nil
+}
+
+// startDeviceWatcher follows devices in the background for the lifetime
+// of the app and keeps the status line and buttons current
+func (t *FlashTool) startDeviceWatcher() {
+	t.watcher = &deviceWatcher{
+		adb: t.adbServer,
+		startServer: func(ctx context.Context) error {
+			_, err := t.adbHost(ctx)
+			return err
+		},
+		listFastboot:  t.fastbootDevices,
+		pauseFastboot: t.jobs.destructiveRunning,
+	}
+	t.watcher.subscribe(func(event deviceEvent) {
+		t.devices.observe(event)
+		if event.Kind != eventDisconnected && event.Source != sourceFastboot && event.State == "device" {
+			go t.readDeviceProps(event.Serial)
+		}
+		// Log the phone by name, the same in every mode
+		shown := event
+		shown.Serial = t.devices.name(event.Serial)
+		t.appendLog(shown.String())
+		t.refreshDeviceStatus()
+	})
+	t.watcher.start(context.Background())
+	t.refreshDeviceStatus()
+	// Wireless devices from the last session show up like USB ones
+	go t.reconnectWireless(context.Background())
+}
+
+// refreshDeviceStatus shows the connected devices, offers them as
+// targets and enables the buttons that need one. Buttons stay disabled
+// while the target is ambiguous.
+func (t *FlashTool) refreshDeviceStatus() {
+	devices := t.watcher.snapshot()
+	selected := t.target.get()
+	targets := []string{targetAuto}
+	var shown []string
+	var adbCandidates []watchedDevice
+	fastbootCandidates := 0
+	for _, device := range devices {
+		icon := "📱"
+		switch {
+		case device.Source == sourceDirect:
+			icon = "🔗"
+		case isWirelessSerial(device.Serial):
+			icon = "📶"
+		}
+		if device.Serial == selected {
+			icon = "🎯" + icon
+		}
+		shown = append(shown, fmt.Sprintf("%s %s (%s)", icon, t.devices.name(device.Serial), device.State))
+		if !slices.Contains(targets, device.Serial) {
+			targets = append(targets, device.Serial)
+		}
+		if selected != "" && device.Serial != selected {
+			continue
+		}
+		if device.Source == sourceFastboot {
+			fastbootCandidates++
+		} else {
+			adbCandidates = append(adbCandidates, device)
+		}
+	}
+	if serial := t.fastbootNet.get(); serial != "" {
+		icon := "🌐"
+		if serial == selected {
+			icon = "🎯" + icon
+		}
+		shown = append(shown, fmt.Sprintf("%s %s (fastboot)", icon, t.devices.name(serial)))
+		targets = append(targets, serial)
+		if selected == "" || selected == serial {
+			fastbootCandidates++
+		}
+	}
+	// A rebooting phone stays the target while it is gone
+	if selected != "" && !slices.Contains(targets, selected) {
+		targets = append(targets, selected)
+	}
+
+	adbReady := len(adbCandidates) == 1 && adbCandidates[0].State == "device"
+	fastbootReady := fastbootCandidates == 1
+	status := "📵 No device"
+	if len(shown) > 0 {
+		status = strings.Join(shown, "   ")
+	}
+	if len(adbCandidates) > 1 || fastbootCandidates > 1 {
+		status += "   ⚠️ Choose a target"
+	}
+	t.updateConnectIPButton()
+
+	choice := selected
+	if choice == "" {
+		choice = targetAuto
+	}
+	fyne.Do(func() {
+		t.deviceStatus.SetText(status)
+		t.targetSelect.SetOptions(targets)
+		if t.targetSelect.Selected != choice {
+			t.targetSelect.SetSelected(choice)
+		}
+		for _, button := range t.adbButtons {
+			setEnabled(button, adbReady)
+		}
+		for _, button := range t.fastbootButtons {
+			setEnabled(button, fastbootReady)
+		}
+	})
+}
+
+// selectTarget makes serial the device operations go to
+func (t *FlashTool) selectTarget(serial string) {
+	t.target.set(serial)
+	t.refreshDeviceStatus()
+}
+
+func setEnabled(button *widget.Button, enabled bool) {
+	if enabled {
+		button.Enable()
+	} else {
+		button.Disable()
+	}
+}
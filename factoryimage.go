@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Google factory images (Pixel and friends) hold bootloader-*.img,
+// radio-*.img and an image-*.zip with the partition images. Their
+// flash-all script ends in "fastboot update", which we do not hand to the
+// fastboot binary: the package becomes a script of our own steps, in the
+// order fastboot update flashes it.
+
+// Images flashed from the bootloader, before the phone moves to fastbootd
+var factoryBootImages = []string{
+	"boot", "init_boot", "dtbo", "dts", "pvmfw", "recovery", "vbmeta", "vbmeta_system",
+	"vbmeta_vendor", "vendor_boot", "vendor_kernel_boot",
+}
+
+// Images of the logical partitions inside super, flashed from fastbootd
+var factoryOSImages = []string{
+	"odm", "odm_dlkm", "product", "system", "system_dlkm", "system_ext", "vendor", "vendor_dlkm",
+}
+
+// Folder names look like oriole-tq3a.230901.001
+var factoryFolderName = regexp.MustCompile(`^([a-z0-9]+)-([a-z0-9.]+)$`)
+
+// factoryImage is an extracted Google factory image
+type factoryImage struct {
+	Root       string
+	Product    string
+	Build      string
+	Bootloader string // bootloader image path
+	Radio      string // radio image path, empty for devices without one
+	ImageZip   string
+	ImageDir   string // where the image zip is extracted
+}
+
+// Name describes the package the way the technician knows it
+func (f *factoryImage) Name() string {
+	if f.Product == "" {
+		return filepath.Base(f.Root)
+	}
+	return strings.TrimSpace(f.Product + " " + f.Build)
+}
+
+// Extracted reports whether the image zip has been fully extracted
+func (f *factoryImage) Extracted() bool {
+	_, err := os.Stat(filepath.Join(f.ImageDir, romExtractedMarker))
+	return err == nil
+}
+
+// findFactoryImage looks for a factory image in dir or the folder the
+// archive unpacked into
+func findFactoryImage(dir string) (*factoryImage, error) {
+	candidates := []string{dir}
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				candidates = append(candidates, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	for _, root := range candidates {
+		bootloaders, _ := filepath.Glob(filepath.Join(root, "bootloader-*.img"))
+		zips, _ := filepath.Glob(filepath.Join(root, "image-*.zip"))
+		if len(bootloaders) != 1 || len(zips) != 1 {
+			continue
+		}
+		f := &factoryImage{
+			Root:       root,
+			Bootloader: bootloaders[0],
+			ImageZip:   zips[0],
+			ImageDir:   romWorkDir(zips[0]),
+		}
+		if radios, _ := filepath.Glob(filepath.Join(root, "radio-*.img")); len(radios) == 1 {
+			f.Radio = radios[0]
+		}
+		if m := factoryFolderName.FindStringSubmatch(filepath.Base(root)); m != nil {
+			f.Product, f.Build = m[1], m[2]
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("no factory image in %s", filepath.Base(dir))
+}
+
+// extractZip unpacks a .zip into dir. onProgress gets the fraction of the
+// archive written and the file being written.
+func extractZip(ctx context.Context, pkg, dir string, onProgress func(float64, string)) error {
+	archive, err := zip.OpenReader(pkg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(pkg), err)
+	}
+	defer archive.Close()
+	var total, done int64
+	for _, file := range archive.File {
+		total += int64(file.CompressedSize64)
+	}
+	fraction := func() float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(done) / float64(total)
+	}
+
+	// Incomplete extractions are never reused
+	os.Remove(filepath.Join(dir, romExtractedMarker))
+	for _, file := range archive.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := filepath.FromSlash(file.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: unsafe path %s", filepath.Base(pkg), file.Name)
+		}
+		target := filepath.Join(dir, name)
+		onProgress(fraction(), file.Name)
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		r, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+		err = writeROMFile(ctx, target, r, file.Mode().Perm()|0o600)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		done += int64(file.CompressedSize64)
+		onProgress(fraction(), file.Name)
+	}
+	onProgress(1, "")
+	return os.WriteFile(filepath.Join(dir, romExtractedMarker), []byte(filepath.Base(pkg)+"\n"), 0o644)
+}
+
+// script turns the package into the steps fastboot update would take:
+// bootloader and radio first, each followed by a reboot into the new
+// bootloader, then the android-info.txt checks, the boot images and super
+// from fastbootd. wipe adds the -w of flash-all.
+func (f *factoryImage) script(wipe bool) (*flashScript, error) {
+	images := map[string]string{}
+	entries, err := os.ReadDir(f.ImageDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".img"); ok && !entry.IsDir() {
+			images[name] = filepath.Join(f.ImageDir, entry.Name())
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images in %s", filepath.Base(f.ImageZip))
+	}
+	requirements, skipped, err := loadAndroidInfo(filepath.Join(f.ImageDir, "android-info.txt"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	script := &flashScript{Path: f.Root, Dir: f.ImageDir, StopOnError: true}
+	add := func(step *scriptStep) {
+		step.Source = step.String()
+		step.Check = &errorCheck{Stop: true}
+		script.Steps = append(script.Steps, step)
+	}
+	fastboot := func(args ...string) *scriptStep {
+		return &scriptStep{Kind: stepFastboot, Args: args}
+	}
+	flash := func(name string, resize bool) {
+		if image, ok := images[name]; ok {
+			step := fastboot("flash", name, image)
+			step.Resize = resize
+			add(step)
+			delete(images, name)
+		}
+	}
+
+	add(fastboot("flash", "bootloader", f.Bootloader))
+	add(fastboot("reboot", "bootloader"))
+	if f.Radio != "" {
+		add(fastboot("flash", "radio", f.Radio))
+		add(fastboot("reboot", "bootloader"))
+	}
+	// fastboot update checks android-info.txt against the new bootloader
+	for _, requirement := range requirements {
+		add(&scriptStep{Kind: stepRequire, Require: requirement})
+	}
+	for _, line := range skipped {
+		script.Steps = append(script.Steps, &scriptStep{Kind: stepSkip, Source: line})
+	}
+	for _, name := range factoryBootImages {
+		flash(name, false)
+	}
+	if superEmpty, ok := images["super_empty"]; ok {
+		// Logical partitions are only reachable from fastbootd
+		delete(images, "super_empty")
+		add(fastboot("reboot", "fastboot"))
+		add(fastboot("wipe-super", superEmpty))
+		for _, name := range factoryOSImages {
+			flash(name, true)
+		}
+		add(fastboot("reboot", "bootloader"))
+	} else {
+		for _, name := range factoryOSImages {
+			flash(name, false)
+		}
+	}
+	if wipe {
+		add(&scriptStep{Kind: stepFastboot, Wipe: true})
+	}
+	add(fastboot("reboot"))
+
+	// Whatever else the zip holds is shown, not flashed
+	var rest []string
+	for name := range images {
+		rest = append(rest, name)
+	}
+	slices.Sort(rest)
+	for _, name := range rest {
+		script.Steps = append(script.Steps, &scriptStep{
+			Kind:   stepSkip,
+			Source: fmt.Sprintf("%s.img is not part of the factory flash", name),
+		})
+	}
+	return script, nil
+}
+
+// openFactoryImage shows the package's details and flashes it once the
+// technician has accepted its plan
+func (t *FlashTool) openFactoryImage(f *factoryImage) {
+	t.appendLog("📱 Factory image: " + f.Name())
+	wipe := widget.NewCheck("Wipe data (like flash-all)", nil)
+	wipe.SetChecked(true)
+
+	radio := "none"
+	if f.Radio != "" {
+		radio = filepath.Base(f.Radio)
+	}
+	items := []*widget.FormItem{
+		widget.NewFormItem("Device", widget.NewLabel(f.Product)),
+		widget.NewFormItem("Build", widget.NewLabel(f.Build)),
+		widget.NewFormItem("Bootloader", widget.NewLabel(filepath.Base(f.Bootloader))),
+		widget.NewFormItem("Radio", widget.NewLabel(radio)),
+		widget.NewFormItem("", wipe),
+	}
+	dialog.ShowForm("Flash "+f.Name(), "Next", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		next := func() { t.confirmFactoryPlan(f, wipe.Checked) }
+		if f.Extracted() {
+			next()
+			return
+		}
+		t.appendLog(fmt.Sprintf("📦 Extracting %s into %s", filepath.Base(f.ImageZip), f.ImageDir))
+		t.extractWithProgress(f.ImageZip, f.ImageDir, next)
+	}, t.window)
+}
+
+func (t *FlashTool) confirmFactoryPlan(f *factoryImage, wipe bool) {
+	script, err := f.script(wipe)
+	if err != nil {
+		dialog.ShowError(err, t.window)
+		return
+	}
+	t.showFlashPlan(newFlashPlan(script), func() {
+		t.run(jobDestructive, "Flash Factory Image", func(ctx context.Context) {
+			t.executeScript(ctx, script)
+		})
+	})
+}
+
+// isFactoryFlashAll reports whether path is the flash-all script of a
+// factory image, which ends in a fastboot update we run our own way
+func isFactoryFlashAll(path string) (*factoryImage, bool) {
+	name := strings.ToLower(filepath.Base(path))
+	if name != "flash-all.sh" && name != "flash-all.bat" {
+		return nil, false
+	}
+	f, err := findFactoryImage(filepath.Dir(path))
+	if err != nil || f.Root != filepath.Dir(path) {
+		return nil, false
+	}
+	return f, true
+}
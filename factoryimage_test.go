@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestZip(t *testing.T, path string, members []archiveMember) {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, m := range members {
+		// Stored, so a test can damage the data of one member
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(m.body)
+	}
+	archive.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFactoryImage lays out an oriole factory image under dir, with
+// the image zip extracted when images is not nil
+func writeFactoryImage(t *testing.T, dir string, radio bool, images []archiveMember) string {
+	t.Helper()
+	root := filepath.Join(dir, "oriole-tq3a.230901.001")
+	os.MkdirAll(root, 0o755)
+	os.WriteFile(filepath.Join(root, "flash-all.sh"), []byte("fastboot -w update image-oriole-tq3a.230901.001.zip\n"), 0o644)
+	os.WriteFile(filepath.Join(root, "bootloader-oriole-slider-1.2-9152140.img"), []byte("bootloader"), 0o644)
+	if radio {
+		os.WriteFile(filepath.Join(root, "radio-oriole-g5123b-116954-230511-b-10112789.img"), []byte("radio"), 0o644)
+	}
+	pkg := filepath.Join(root, "image-oriole-tq3a.230901.001.zip")
+	writeTestZip(t, pkg, images)
+	if images != nil {
+		if err := extractZip(context.Background(), pkg, romWorkDir(pkg), func(float64, string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestFactoryImageScript(t *testing.T) {
+	img := func(name string) archiveMember { return archiveMember{name: name, body: []byte(name)} }
+	info := archiveMember{name: "android-info.txt", body: []byte("require board=oriole\nrequire version-bootloader=slider-1.2-9152140\nrequire partition-exists=vendor_dlkm\nbootloader=slider\n")}
+	dynamic := []archiveMember{info, img("boot.img"), img("vendor_boot.img"), img("vbmeta.img"), img("super_empty.img"),
+		img("vendor.img"), img("system.img"), img("system_ext.img"), img("product.img"), img("unknown.img")}
+
+	tests := []struct {
+		name   string
+		radio  bool
+		images []archiveMember
+		wipe   bool
+		steps  []string
+	}{
+		{
+			name:   "wipe",
+			radio:  true,
+			images: dynamic,
+			wipe:   true,
+			steps: []string{
+				"fastboot: flash bootloader bootloader-oriole-slider-1.2-9152140.img <bootloader-oriole-slider-1.2-9152140.img>",
+				"fastboot: reboot bootloader",
+				"fastboot: flash radio radio-oriole-g5123b-116954-230511-b-10112789.img <radio-oriole-g5123b-116954-230511-b-10112789.img>",
+				"fastboot: reboot bootloader",
+				"require: require product=oriole",
+				"require: require version-bootloader=slider-1.2-9152140",
+				"require: require partition-exists=vendor_dlkm",
+				"skip: android-info.txt line 4: not a require or reject line: bootloader=slider",
+				"fastboot: flash boot boot.img <image-oriole-tq3a.230901.001/boot.img>",
+				"fastboot: flash vbmeta vbmeta.img <image-oriole-tq3a.230901.001/vbmeta.img>",
+				"fastboot: flash vendor_boot vendor_boot.img <image-oriole-tq3a.230901.001/vendor_boot.img>",
+				"fastboot: reboot fastboot",
+				"fastboot: wipe-super super_empty.img",
+				"fastboot: flash product product.img <image-oriole-tq3a.230901.001/product.img> resize",
+				"fastboot: flash system system.img <image-oriole-tq3a.230901.001/system.img> resize",
+				"fastboot: flash system_ext system_ext.img <image-oriole-tq3a.230901.001/system_ext.img> resize",
+				"fastboot: flash vendor vendor.img <image-oriole-tq3a.230901.001/vendor.img> resize",
+				"fastboot: reboot bootloader",
+				"fastboot: -w",
+				"fastboot: reboot",
+				"skip: unknown.img is not part of the factory flash",
+			},
+		},
+		{
+			name:   "keep data, no radio, no super",
+			images: []archiveMember{img("system.img"), img("boot.img")},
+			steps: []string{
+				"fastboot: flash bootloader bootloader-oriole-slider-1.2-9152140.img <bootloader-oriole-slider-1.2-9152140.img>",
+				"fastboot: reboot bootloader",
+				"fastboot: flash boot boot.img <image-oriole-tq3a.230901.001/boot.img>",
+				"fastboot: flash system system.img <image-oriole-tq3a.230901.001/system.img>",
+				"fastboot: reboot",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := writeFactoryImage(t, t.TempDir(), test.radio, test.images)
+			f, err := findFactoryImage(filepath.Dir(root))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Root != root || f.Product != "oriole" || f.Build != "tq3a.230901.001" || !f.Extracted() {
+				t.Errorf("image = %+v", f)
+			}
+			script, err := f.script(test.wipe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := describeSteps(root, script.Steps)
+			for i, step := range script.Steps {
+				// Every step stops the flash when it fails
+				got[i] = strings.TrimSuffix(got[i], ` || "" stop`)
+				if step.Resize {
+					got[i] += " resize"
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(test.steps, "\n") {
+				t.Errorf("steps =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.steps, "\n"))
+			}
+		})
+	}
+}
+
+func TestFactoryImageRejectsOtherPackages(t *testing.T) {
+	dir := t.TempDir()
+
+	// A Xiaomi ROM
+	xiaomi := filepath.Join(dir, "lavender_global_images_V12.5.5.0.QFGMIXM_20220712.0000.00_10.0_global")
+	os.MkdirAll(filepath.Join(xiaomi, "images"), 0o755)
+	os.WriteFile(filepath.Join(xiaomi, "flash_all.sh"), []byte("fastboot flash boot images/boot.img\n"), 0o644)
+	os.WriteFile(filepath.Join(xiaomi, "images", "boot.img"), []byte("boot"), 0o644)
+	if f, err := findFactoryImage(xiaomi); err == nil {
+		t.Errorf("Xiaomi ROM found as %+v", f)
+	}
+
+	// flash-all without a bootloader next to it
+	partial := filepath.Join(dir, "partial")
+	os.MkdirAll(partial, 0o755)
+	os.WriteFile(filepath.Join(partial, "flash-all.sh"), []byte("fastboot update image.zip\n"), 0o644)
+	writeTestZip(t, filepath.Join(partial, "image-oriole-tq3a.230901.001.zip"), nil)
+	if _, ok := isFactoryFlashAll(filepath.Join(partial, "flash-all.sh")); ok {
+		t.Error("flash-all without a bootloader is a factory image")
+	}
+
+	// The factory image's own flash-all, but no other script of it
+	root := writeFactoryImage(t, dir, false, nil)
+	if f, ok := isFactoryFlashAll(filepath.Join(root, "flash-all.sh")); !ok || f.Root != root {
+		t.Errorf("flash-all.sh = %+v, %v", f, ok)
+	}
+	os.WriteFile(filepath.Join(root, "flash-base.sh"), nil, 0o644)
+	if _, ok := isFactoryFlashAll(filepath.Join(root, "flash-base.sh")); ok {
+		t.Error("flash-base.sh is taken for flash-all")
+	}
+	// A flash-all one folder down belongs to something else
+	nested := filepath.Join(root, "extra")
+	os.MkdirAll(nested, 0o755)
+	os.WriteFile(filepath.Join(nested, "flash-all.sh"), nil, 0o644)
+	if _, ok := isFactoryFlashAll(filepath.Join(nested, "flash-all.sh")); ok {
+		t.Error("a nested flash-all.sh is taken for the factory one")
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	members := []archiveMember{{name: "android-info.txt", body: []byte("require board=oriole\n")}, {name: "boot.img", body: bytes.Repeat([]byte{1}, 4096)}}
+
+	t.Run("extracts", func(t *testing.T) {
+		pkg := filepath.Join(t.TempDir(), "image-oriole.zip")
+		writeTestZip(t, pkg, members)
+		work := romWorkDir(pkg)
+		var last float64
+		if err := extractPackage(context.Background(), pkg, work, func(fraction float64, _ string) { last = fraction }); err != nil {
+			t.Fatal(err)
+		}
+		if boot, _ := os.ReadFile(filepath.Join(work, "boot.img")); !bytes.Equal(boot, members[1].body) || last != 1 {
+			t.Errorf("boot.img has %d bytes, progress ended at %v", len(boot), last)
+		}
+		if marker, _ := os.ReadFile(filepath.Join(work, romExtractedMarker)); string(marker) != "image-oriole.zip\n" {
+			t.Errorf("marker = %q", marker)
+		}
+	})
+
+	for _, name := range []string{"../evil.img", "images/../../evil.img", "/tmp/evil.img"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			pkg := filepath.Join(dir, "rom", "image-oriole.zip")
+			os.MkdirAll(filepath.Dir(pkg), 0o755)
+			writeTestZip(t, pkg, []archiveMember{members[0], {name: name, body: []byte("x")}})
+			if err := extractZip(context.Background(), pkg, romWorkDir(pkg), func(float64, string) {}); err == nil {
+				t.Error("extracted")
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil.img")); err == nil {
+				t.Error("a file was written outside the work folder")
+			}
+			if _, err := os.Stat(filepath.Join(romWorkDir(pkg), romExtractedMarker)); err == nil {
+				t.Error("the failed extraction was marked complete")
+			}
+		})
+	}
+
+	t.Run("never reuses a partial extraction", func(t *testing.T) {
+		pkg := filepath.Join(t.TempDir(), "image-oriole.zip")
+		writeTestZip(t, pkg, members)
+		work := romWorkDir(pkg)
+		if err := extractZip(context.Background(), pkg, work, func(float64, string) {}); err != nil {
+			t.Fatal(err)
+		}
+		// A damaged member fails its checksum after the marker is gone
+		data, _ := os.ReadFile(pkg)
+		data[bytes.Index(data, members[1].body)] = 2
+		os.WriteFile(pkg, data, 0o644)
+		if err := extractZip(context.Background(), pkg, work, func(float64, string) {}); err == nil {
+			t.Error("a damaged package extracted")
+		}
+		if _, err := os.Stat(filepath.Join(work, romExtractedMarker)); err == nil {
+			t.Error("a damaged extraction was marked complete")
+		}
+
+		writeTestZip(t, pkg, members)
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := extractZip(ctx, pkg, work, func(float64, string) { cancel() }); err != context.Canceled {
+			t.Errorf("err = %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(work, romExtractedMarker)); err == nil {
+			t.Error("a cancelled extraction was marked complete")
+		}
+	})
+}
@@ -1,43 +1,31 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
-    "os/exec"
     "path/filepath"
-    "strings"
     "time"
 )
 
-func (t *FlashTool) getFastbootInfo() {
-    if !t.isDeviceConnected() {
-        t.appendLog("Error: No device connected!")
+// Run fastboot through the configured command runner
+func (t *FlashTool) fastboot(ctx context.Context, timeout time.Duration, args ...string) (*CommandResult, error) {
+    return t.runner.Run(ctx, Command{Name: "fastboot", Args: args, Timeout: timeout})
+}
+
+func (t *FlashTool) getFastbootInfo(ctx context.Context) {
+    conn, err := t.openFastboot(ctx)
+    if err != nil {
+        t.logTargetError(err)
         return
     }
+    defer conn.Close()
 
     startTime := time.Now()
 
     t.appendLog("Read Device Info Result:")
     t.appendLog("========= Device Information =========")
 
-    // Get individual variables
-    getVarInfo := func(varName string) string {
-        cmd := exec.Command("fastboot", "getvar", varName)
-        output, err := cmd.CombinedOutput()
-        if err == nil {
-            lines := strings.Split(string(output), "\n")
-            for _, line := range lines {
-                line = strings.TrimSpace(line)
-                if strings.HasPrefix(line, varName) {
-                    parts := strings.SplitN(line, ":", 2)
-                    if len(parts) == 2 {
-                        return strings.TrimSpace(parts[1])
-                    }
-                }
-            }
-        }
-        return ""
-    }
-
     // Define variables to check
     vars := []struct {
         label    string
@@ -54,9 +42,19 @@ func (t *FlashTool) getFastbootInfo() {
 
     // Get and display information
     for _, v := range vars {
+        if ctx.Err() != nil {
+            return
+        }
+        nextStep(ctx, v.label)
         value := "Unknown"
         for _, varName := range v.varNames {
-            if result := getVarInfo(varName); result != "" {
+            // A FAIL only means this bootloader does not know the name
+            result, err := conn.GetVar(ctx, varName)
+            if err != nil && !isFastbootError(err) {
+                t.appendLog(fmt.Sprintf("❌ getvar %s failed: %v", varName, err))
+                return
+            }
+            if err == nil && result != "" {
                 value = result
                 break
             }
@@ -72,29 +70,53 @@ func (t *FlashTool) getFastbootInfo() {
     t.appendLog(fmt.Sprintf("⏱️ Execution time: %.2fs", executionTime.Seconds()))
 }
 
-func (t *FlashTool) executeBatch() {
-    t.logOutput.SetText("")
-    t.appendLog(fmt.Sprintf("Starting execution of: %s", filepath.Base(t.filePath)))
+func (t *FlashTool) executeBatch(ctx context.Context) {
+    script, err := loadFlashScript(t.filePath)
+    if err != nil {
+        t.appendLog("Error executing batch file")
+        t.appendLog(fmt.Sprintf("Error details: %v", err))
+        return
+    }
+    t.executeScript(ctx, script)
+}
+
+// executeScript flashes the target device with a parsed script
+func (t *FlashTool) executeScript(ctx context.Context, script *flashScript) {
+    t.appendLog(fmt.Sprintf("Starting execution of: %s", filepath.Base(script.Path)))
     
     startTime := time.Now()
     
-    if !t.isDeviceConnected() {
-        t.appendLog("Error: No device connected!")
+    conn, err := t.openFastboot(ctx)
+    if err != nil {
+        t.logTargetError(err)
         return
     }
+    serial := conn.Serial()
+    conn.Close()
     
-    cmd := exec.Command("cmd", "/C", t.filePath)
-    output, err := cmd.CombinedOutput()
+    progress := t.newFlashProgress()
+    progress.setTotals(newFlashPlan(script).Totals())
+    onLine := func(line OutputLine) {
+        t.appendOutput(line)
+        progress.feed(line.Text)
+    }
+
+    err = t.runScript(ctx, script, serial, onLine, t.confirmPreflightOverride)
     
     executionTime := time.Since(startTime)
+    if ctx.Err() != nil {
+        progress.fail()
+        return
+    }
     
     if err != nil {
-        t.appendLog(fmt.Sprintf("Error executing batch file:\n%s", string(output)))
+        progress.fail()
+        t.appendLog("Error executing batch file")
         t.appendLog(fmt.Sprintf("Error details: %v", err))
         t.appendLog("\n=== Operation Status ===")
         t.appendLog("❌ Execution failed")
     } else {
-        t.appendLog(string(output))
+        progress.finish()
         t.appendLog("\n=== Operation Status ===")
         t.appendLog("✅ Completed successfully")
     }
@@ -102,59 +124,56 @@ func (t *FlashTool) executeBatch() {
     t.appendLog(fmt.Sprintf("⏱️ Execution time: %.2fs", executionTime.Seconds()))
 }
 
-func (t *FlashTool) checkFastbootDevice() {
-    cmd := exec.Command("fastboot", "devices")
-    output, err := cmd.CombinedOutput()
-    
-    if err != nil {
-        t.appendLog("=== Device Check ===")
+func (t *FlashTool) checkFastbootDevice(ctx context.Context) {
+    t.appendLog("=== Device Check ===")
+    conn, err := t.openFastboot(ctx)
+    switch {
+    case err == errNoFastbootDevice:
+        t.appendLog("❌ No devices found")
+        return
+    case errors.Is(err, errNoFastbootDevice) || errors.Is(err, errAmbiguousTarget):
+        t.appendLog(fmt.Sprintf("❌ %v", err))
+        return
+    case err != nil:
         t.appendLog("❌ Error checking devices")
         t.appendLog(fmt.Sprintf("Error details: %v", err))
         return
     }
-    
-    if string(output) == "" {
-        t.appendLog("=== Device Check ===")
-        t.appendLog("❌ No devices found")
-        return
-    }
-    
-    t.appendLog("=== Device Check ===")
-    t.appendLog("✅ Device connected")
-    t.appendLog(string(output))
-}
+    conn.Close()
 
-func (t *FlashTool) isDeviceConnected() bool {
-    cmd := exec.Command("fastboot", "devices")
-    output, err := cmd.CombinedOutput()
-    return err == nil && len(output) > 0
+    t.appendLog("✅ Device connected")
+    t.appendLog(conn.Serial() + "\tfastboot")
 }
 
 // Fastboot reboot
-func (t *FlashTool) fastbootReboot() {
-    if !t.isDeviceConnected() {
-        t.appendLog("Error: No device connected!")
+func (t *FlashTool) fastbootReboot(ctx context.Context) {
+    conn, err := t.openFastboot(ctx)
+    if err != nil {
+        t.logTargetError(err)
         return
     }
+    defer conn.Close()
 
-    cmd := exec.Command("fastboot", "reboot")
-    output, err := cmd.CombinedOutput()
+    err = conn.Reboot(ctx, "")
 
     if err != nil {
         t.appendLog("Error rebooting device:")
-        t.appendLog(fmt.Sprintf("%s\nError details: %v", string(output), err))
+        t.appendLog(fmt.Sprintf("Error details: %v", err))
         return
     }
 
     t.appendLog("Device rebooted successfully.")
+    t.waitAfterReboot(ctx, conn.Serial(), modeFastboot, modeBooted)
 }
 
 // Fastboot unlock bootloader
-func (t *FlashTool) fastbootUnlock() {
-    if !t.isDeviceConnected() {
-        t.appendLog("❌ No device connected!")
+func (t *FlashTool) fastbootUnlock(ctx context.Context) {
+    conn, err := t.openFastboot(ctx)
+    if err != nil {
+        t.logTargetError(err)
         return
     }
+    defer conn.Close()
 
     t.appendLog("🔓 Attempting to unlock bootloader...")
     t.appendLog("⚠️ WARNING: This will WIPE ALL DATA on your device!")
@@ -163,26 +182,27 @@ func (t *FlashTool) fastbootUnlock() {
     t.appendLog("\n🔍 Checking unlock status...")
     
     // Check if already unlocked
-    cmd := exec.Command("fastboot", "getvar", "unlocked")
-    output, err := cmd.CombinedOutput()
+    nextStep(ctx, "getvar unlocked")
+    unlocked, err := conn.GetVar(ctx, "unlocked")
     
-    if err == nil {
-        if strings.Contains(string(output), "unlocked: yes") {
-            t.appendLog("✅ Bootloader is already unlocked!")
-            return
-        }
+    if err == nil && unlocked == "yes" {
+        t.appendLog("✅ Bootloader is already unlocked!")
+        return
     }
     
     // Try standard unlock command
     t.appendLog("🚀 Executing unlock command...")
-    cmd = exec.Command("fastboot", "oem", "unlock")
-    output, err = cmd.CombinedOutput()
+    nextStep(ctx, "oem unlock")
+    _, err = conn.OEM(ctx, "unlock")
     
     if err != nil {
+        if ctx.Err() != nil {
+            return
+        }
         t.appendLog("❌ Standard unlock failed, trying alternative...")
+        nextStep(ctx, "flashing unlock")
         // Try alternative unlock command
-        cmd = exec.Command("fastboot", "flashing", "unlock")
-        output, err = cmd.CombinedOutput()
+        _, err = conn.Flashing(ctx, "unlock")
         
         if err != nil {
             t.appendLog("❌ Unlock failed!")
@@ -195,5 +215,4 @@ func (t *FlashTool) fastbootUnlock() {
     t.appendLog("✅ Unlock command sent successfully!")
     t.appendLog("📱 Please check your device screen for confirmation")
     t.appendLog("🔽 Use Volume keys to navigate and Power to confirm")
-    t.appendLog("\n" + string(output))
 }
\ No newline at end of file
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// FakeFastboot is an in-memory bootloader behind the Transport interface,
+// so the protocol flows can be exercised without a device
+type FakeFastboot struct {
+	mu        sync.Mutex
+	vars      map[string]string
+	fails     map[string]string   // command prefix -> FAIL message
+	info      map[string][]string // command prefix -> INFO messages
+	commands  []string
+	flashed   map[string]int64 // partition -> bytes written
+	erased    []string
+	download  []byte
+	remaining int64 // download bytes still expected
+	responses chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFakeFastboot(vars map[string]string) *FakeFastboot {
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	if _, ok := vars["max-download-size"]; !ok {
+		vars["max-download-size"] = "0x10000000"
+	}
+	return &FakeFastboot{
+		vars:      vars,
+		fails:     make(map[string]string),
+		info:      make(map[string][]string),
+		flashed:   make(map[string]int64),
+		responses: make(chan []byte, 256),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Fail makes every command starting with prefix answer FAIL message
+func (f *FakeFastboot) Fail(prefix, message string) *FakeFastboot {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fails[prefix] = message
+	return f
+}
+
+// Info makes commands starting with prefix send INFO messages first
+func (f *FakeFastboot) Info(prefix string, messages ...string) *FakeFastboot {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.info[prefix] = messages
+	return f
+}
+
+// Commands returns every command received, download data excluded
+func (f *FakeFastboot) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// Flashed returns the number of bytes written to each partition
+func (f *FakeFastboot) Flashed() map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flashed := make(map[string]int64, len(f.flashed))
+	for partition, size := range f.flashed {
+		flashed[partition] = size
+	}
+	return flashed
+}
+
+// Erased returns the partitions erased so far
+func (f *FakeFastboot) Erased() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.erased...)
+}
+
+func (f *FakeFastboot) Read(p []byte) (int, error) {
+	select {
+	case packet := <-f.responses:
+		return copy(p, packet), nil
+	case <-f.closed:
+		return 0, errors.New("fake fastboot: closed")
+	}
+}
+
+func (f *FakeFastboot) Write(p []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, errors.New("fake fastboot: closed")
+	default:
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.remaining > 0 {
+		if int64(len(p)) > f.remaining {
+			f.remaining = 0
+			f.reply("FAIL", "too much download data")
+			return len(p), nil
+		}
+		f.download = append(f.download, p...)
+		f.remaining -= int64(len(p))
+		if f.remaining == 0 {
+			f.reply("OKAY", "")
+		}
+		return len(p), nil
+	}
+
+	cmd := string(p)
+	f.commands = append(f.commands, cmd)
+	for prefix, messages := range f.info {
+		if strings.HasPrefix(cmd, prefix) {
+			for _, msg := range messages {
+				f.reply("INFO", msg)
+			}
+		}
+	}
+	for prefix, msg := range f.fails {
+		if strings.HasPrefix(cmd, prefix) {
+			f.reply("FAIL", msg)
+			return len(p), nil
+		}
+	}
+	f.handle(cmd)
+	return len(p), nil
+}
+
+func (f *FakeFastboot) handle(cmd string) {
+	verb, arg, _ := strings.Cut(cmd, ":")
+	switch {
+	case verb == "getvar" && arg == "all":
+		for name, value := range f.vars {
+			f.reply("INFO", name+":"+value)
+		}
+		f.reply("OKAY", "")
+	case verb == "getvar":
+		value, ok := f.vars[arg]
+		if !ok {
+			f.reply("FAIL", "GetVar Variable Not found")
+			return
+		}
+		f.reply("OKAY", value)
+	case verb == "download":
+		var size int64
+		if _, err := fmt.Sscanf(arg, "%x", &size); err != nil || size <= 0 {
+			f.reply("FAIL", "invalid size")
+			return
+		}
+		f.download = f.download[:0]
+		f.remaining = size
+		f.reply("DATA", fmt.Sprintf("%08x", size))
+	case verb == "flash":
+		if len(f.download) == 0 {
+			f.reply("FAIL", "no image downloaded")
+			return
+		}
+		f.flashed[arg] = int64(len(f.download))
+		f.reply("OKAY", "")
+	case verb == "erase":
+		f.erased = append(f.erased, arg)
+		f.reply("OKAY", "")
+	case verb == "set_active":
+		if arg != "a" && arg != "b" {
+			f.reply("FAIL", "invalid slot")
+			return
+		}
+		f.vars["current-slot"] = arg
+		f.reply("OKAY", "")
+	case strings.HasPrefix(cmd, "reboot"), strings.HasPrefix(cmd, "oem "), strings.HasPrefix(cmd, "flashing "):
+		f.reply("OKAY", "")
+	default:
+		f.reply("FAIL", "unknown command")
+	}
+}
+
+func (f *FakeFastboot) reply(status, payload string) {
+	f.responses <- []byte(status + payload)
+}
+
+func (f *FakeFastboot) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Protocols for network fastboot, as used in serials like "udp:host:port"
+const (
+	netTCP = "tcp"
+	netUDP = "udp"
+)
+
+// parseFastbootAddress accepts "host", "host:port" or a full serial such
+// as "udp:host:port" and returns the serial, using proto when the input
+// does not name one
+func parseFastbootAddress(input, proto string) (string, error) {
+	input = strings.TrimSpace(input)
+	for _, p := range []string{netTCP, netUDP} {
+		if rest, ok := strings.CutPrefix(input, p+":"); ok {
+			input, proto = rest, p
+		}
+	}
+	if input == "" {
+		return "", fmt.Errorf("enter an IP address")
+	}
+	host, port, err := net.SplitHostPort(input)
+	if err != nil {
+		// No port given
+		host, port = strings.Trim(input, "[]"), strconv.Itoa(fastbootNetPort)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return proto + ":" + net.JoinHostPort(host, port), nil
+}
+
+// dialFastbootNetwork opens the transport a network serial asks for
+func dialFastbootNetwork(ctx context.Context, serial string) (Transport, error) {
+	proto, addr, _ := strings.Cut(serial, ":")
+	switch proto {
+	case netTCP:
+		return dialFastbootTCP(ctx, addr)
+	case netUDP:
+		return dialFastbootUDP(ctx, addr)
+	}
+	return nil, fmt.Errorf("not a network fastboot serial: %q", serial)
+}
+
+func isNetworkSerial(serial string) bool {
+	return strings.HasPrefix(serial, netTCP+":") || strings.HasPrefix(serial, netUDP+":")
+}
+
+// networkTarget is the fastboot device reached over the network, if any.
+// The serial uses the form the fastboot binary understands.
+type networkTarget struct {
+	mu     sync.Mutex
+	serial string
+}
+
+func (n *networkTarget) get() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.serial
+}
+
+func (n *networkTarget) set(serial string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.serial = serial
+}
+
+// openNetworkFastboot connects to the network target with our protocol
+// client
+func (t *FlashTool) openNetworkFastboot(ctx context.Context, serial string, onLine func(OutputLine)) (fastbootConn, error) {
+	transport, err := dialFastbootNetwork(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+	client := newFastbootClient(transport, serial)
+	client.OnLine = onLine
+	return client, nil
+}
+
+// fastbootConnectIP connects to a device in network fastboot and keeps it
+// as the fastboot target until disconnected
+func (t *FlashTool) fastbootConnectIP(ctx context.Context, serial string) {
+	t.appendLog(fmt.Sprintf("🌐 Connecting to %s...", serial))
+	transport, err := dialFastbootNetwork(ctx, serial)
+	if err != nil {
+		if ctx.Err() == nil {
+			t.appendLog(fmt.Sprintf("❌ Connection failed: %v", err))
+		}
+		return
+	}
+	client := newFastbootClient(transport, serial)
+	defer client.Close()
+
+	product, err := client.GetVar(ctx, "product")
+	if err != nil && !isFastbootError(err) {
+		t.appendLog(fmt.Sprintf("❌ Device did not answer: %v", err))
+		return
+	}
+	t.fastbootNet.set(serial)
+	t.selectTarget(serial)
+	t.appendLog(fmt.Sprintf("✅ Connected to %s (product: %s)", serial, product))
+	t.appendLog("📌 Device Info, FB Reboot and Execute Batch now use this device")
+	t.refreshDeviceStatus()
+}
+
+// fastbootDisconnectIP forgets the network target
+func (t *FlashTool) fastbootDisconnectIP() {
+	if serial := t.fastbootNet.get(); serial != "" {
+		t.fastbootNet.set("")
+		t.appendLog(fmt.Sprintf("⏏ Disconnected from %s", serial))
+		if t.target.get() == serial {
+			t.selectTarget("")
+		} else {
+			t.refreshDeviceStatus()
+		}
+	}
+}
+
+// showConnectIPDialog asks for the address of a network fastboot device
+func (t *FlashTool) showConnectIPDialog() {
+	if t.fastbootNet.get() != "" {
+		t.fastbootDisconnectIP()
+		return
+	}
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder(fmt.Sprintf("192.168.1.20 or 192.168.1.20:%d", fastbootNetPort))
+	protocol := widget.NewRadioGroup([]string{"TCP", "UDP"}, nil)
+	protocol.Horizontal = true
+	protocol.SetSelected("TCP")
+	dialog.ShowForm("Connect by IP", "Connect", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Address", entry),
+			widget.NewFormItem("Protocol", protocol),
+		},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			serial, err := parseFastbootAddress(entry.Text, strings.ToLower(protocol.Selected))
+			if err != nil {
+				dialog.ShowError(err, t.window)
+				return
+			}
+			t.run(jobControl, "Connect by IP", func(ctx context.Context) {
+				t.fastbootConnectIP(ctx, serial)
+			})
+		}, t.window)
+}
+
+// updateConnectIPButton shows whether a network target is connected
+func (t *FlashTool) updateConnectIPButton() {
+	label := "Connect by IP"
+	if serial := t.fastbootNet.get(); serial != "" {
+		label = "Disconnect " + serial
+	}
+	fyne.Do(func() {
+		t.connectIPButton.SetText(label)
+	})
+}
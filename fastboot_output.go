@@ -0,0 +1,45 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// fastbootAction is what a line of fastboot output says is happening
+type fastbootAction struct {
+	Verb      string // "flash", "erase", "set_active", "reboot"
+	Partition string
+}
+
+var (
+	fbPartitionLine = regexp.MustCompile(`(?i)^(sending|writing|erasing)(?: sparse)? '([^']+)'`)
+	fbSlotLine      = regexp.MustCompile(`(?i)^setting current slot to '([^']+)'`)
+	fbRebootLine    = regexp.MustCompile(`(?i)^rebooting`)
+)
+
+// parseFastbootAction recognises the lines fastboot prints when it starts
+// working on a partition, so long scripts can be followed step by step
+func parseFastbootAction(line string) (fastbootAction, bool) {
+	line = strings.TrimSpace(line)
+	if m := fbPartitionLine.FindStringSubmatch(line); m != nil {
+		verb := "flash"
+		if strings.EqualFold(m[1], "erasing") {
+			verb = "erase"
+		}
+		return fastbootAction{Verb: verb, Partition: m[2]}, true
+	}
+	if m := fbSlotLine.FindStringSubmatch(line); m != nil {
+		return fastbootAction{Verb: "set_active", Partition: m[1]}, true
+	}
+	if fbRebootLine.MatchString(line) {
+		return fastbootAction{Verb: "reboot"}, true
+	}
+	return fastbootAction{}, false
+}
+
+func (a fastbootAction) String() string {
+	if a.Partition == "" {
+		return a.Verb
+	}
+	return a.Verb + " " + a.Partition
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	fastbootNetPort     = 5554 // the same for TCP and UDP
+	fastbootTCPVersion  = 1
+	fastbootDialTimeout = 5 * time.Second
+)
+
+// tcpTransport is fastboot over TCP: an "FBxx" version handshake, then
+// every packet is prefixed with its length as 8 big-endian bytes
+type tcpTransport struct {
+	conn    net.Conn
+	pending int64 // bytes of the current packet not read yet
+}
+
+// dialFastbootTCP connects to host:port and does the handshake
+func dialFastbootTCP(ctx context.Context, address string) (*tcpTransport, error) {
+	d := net.Dialer{Timeout: fastbootDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(fastbootDialTimeout))
+
+	if _, err := fmt.Fprintf(conn, "FB%02d", fastbootTCPVersion); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot tcp handshake: %w", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot tcp handshake: %w", err)
+	}
+	version, err := strconv.Atoi(string(reply[2:]))
+	if string(reply[:2]) != "FB" || err != nil || version < 1 {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot tcp handshake: unexpected reply %q", reply)
+	}
+	conn.SetDeadline(time.Time{})
+	return &tcpTransport{conn: conn}, nil
+}
+
+func (t *tcpTransport) Read(p []byte) (int, error) {
+	if t.pending == 0 {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(t.conn, header); err != nil {
+			return 0, err
+		}
+		// The device only ever answers with responses, anything longer
+		// is a broken or hostile peer
+		size := binary.BigEndian.Uint64(header)
+		if size > fastbootMaxResponse {
+			t.conn.Close()
+			return 0, fmt.Errorf("fastboot tcp: packet of %d bytes is too long", size)
+		}
+		t.pending = int64(size)
+		if t.pending == 0 {
+			return 0, nil
+		}
+	}
+	n, err := io.ReadFull(t.conn, p[:min(int64(len(p)), t.pending)])
+	t.pending -= int64(n)
+	return n, err
+}
+
+func (t *tcpTransport) Write(p []byte) (int, error) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(len(p)))
+	if _, err := t.conn.Write(header); err != nil {
+		return 0, err
+	}
+	return t.conn.Write(p)
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
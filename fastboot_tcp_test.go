@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listenFastbootTCP accepts one connection and hands it to serve
+func listenFastbootTCP(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+// serveFastbootTCP does the device side of the handshake and framing in
+// front of dev. Every packet the host sends goes to packets.
+func serveFastbootTCP(t *testing.T, dev *FakeFastboot, packets chan<- []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		handshake := make([]byte, 4)
+		if _, err := io.ReadFull(conn, handshake); err != nil || string(handshake) != "FB01" {
+			t.Errorf("handshake = %q, %v", handshake, err)
+			return
+		}
+		io.WriteString(conn, "FB01")
+		go func() {
+			buf := make([]byte, fastbootMaxResponse)
+			for {
+				n, err := dev.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+				conn.Write(buf[:n])
+			}
+		}()
+		defer dev.Close()
+		header := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			packet := make([]byte, binary.BigEndian.Uint64(header))
+			if _, err := io.ReadFull(conn, packet); err != nil {
+				t.Errorf("packet of %d bytes: %v", len(packet), err)
+				return
+			}
+			if packets != nil {
+				packets <- packet
+			}
+			dev.Write(packet)
+		}
+	}
+}
+
+func TestFastbootTCP(t *testing.T) {
+	dev := NewFakeFastboot(map[string]string{"product": "cheetah"})
+	packets := make(chan []byte, 16)
+	addr := listenFastbootTCP(t, serveFastbootTCP(t, dev, packets))
+	transport, err := dialFastbootTCP(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFastbootClient(transport, "tcp:"+addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	if product, err := c.GetVar(ctx, "product"); product != "cheetah" || err != nil {
+		t.Errorf("product = %q, %v", product, err)
+	}
+	if packet := <-packets; string(packet) != "getvar:product" {
+		t.Errorf("packet = %q", packet)
+	}
+
+	image := filepath.Join(t.TempDir(), "boot.img")
+	os.WriteFile(image, bytes.Repeat([]byte{7}, fastbootChunkSize+100), 0o644)
+	if err := c.Flash(ctx, "boot", image); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Flashed()["boot"] != fastbootChunkSize+100 {
+		t.Errorf("flashed = %v", dev.Flashed())
+	}
+	// Download data keeps the framing of the writes it was sent in
+	for _, want := range []string{"getvar:max-download-size", "download:00100064"} {
+		if packet := <-packets; string(packet) != want {
+			t.Errorf("packet = %q, want %q", packet, want)
+		}
+	}
+	for _, want := range []int{fastbootChunkSize, 100} {
+		if packet := <-packets; len(packet) != want {
+			t.Errorf("data packet of %d bytes, want %d", len(packet), want)
+		}
+	}
+}
+
+func TestFastbootTCPReadsAcrossPackets(t *testing.T) {
+	addr := listenFastbootTCP(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 4))
+		io.WriteString(conn, "FB01")
+		for _, packet := range []string{"OKAYlong answer", "", "INFO"} {
+			conn.Write(binary.BigEndian.AppendUint64(nil, uint64(len(packet))))
+			io.WriteString(conn, packet)
+		}
+		io.ReadAll(conn)
+	})
+	transport, err := dialFastbootTCP(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	// A small buffer gets the packet in pieces, never the next packet
+	var reads []string
+	buf := make([]byte, 6)
+	for range 5 {
+		n, err := transport.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads = append(reads, string(buf[:n]))
+	}
+	if got := strings.Join(reads, "|"); got != "OKAYlo|ng ans|wer||INFO" {
+		t.Errorf("reads = %q", got)
+	}
+}
+
+func TestFastbootTCPRejectsLongPackets(t *testing.T) {
+	for name, size := range map[string]uint64{
+		"negative": 0x8000000000000001,
+		"too long": fastbootMaxResponse + 1,
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr := listenFastbootTCP(t, func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 4))
+				io.WriteString(conn, "FB01")
+				conn.Write(binary.BigEndian.AppendUint64(nil, size))
+				io.WriteString(conn, "OKAY")
+				io.ReadAll(conn)
+			})
+			transport, err := dialFastbootTCP(context.Background(), addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+			if _, err := transport.Read(make([]byte, fastbootMaxResponse)); err == nil || !strings.Contains(err.Error(), "too long") {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestFastbootTCPHandshake(t *testing.T) {
+	for _, reply := range []string{"XX01", "FB00", "FB"} {
+		addr := listenFastbootTCP(t, func(conn net.Conn) {
+			io.ReadFull(conn, make([]byte, 4))
+			io.WriteString(conn, reply)
+		})
+		transport, err := dialFastbootTCP(context.Background(), addr)
+		if err == nil {
+			transport.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "fastboot tcp handshake") {
+			t.Errorf("reply %q: err = %v", reply, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Fastboot over UDP packet ids and flags. Every packet starts with
+// id (1 byte), flags (1 byte) and a big-endian 16-bit sequence number.
+const (
+	udpIDError    = 0x00
+	udpIDQuery    = 0x01
+	udpIDInit     = 0x02
+	udpIDFastboot = 0x03
+
+	udpFlagContinuation = 0x01
+
+	udpHeaderSize    = 4
+	udpVersion       = 1
+	udpHostMaxPacket = 8192
+	udpMinPacket     = 512
+
+	udpReceiveTimeout = 500 * time.Millisecond
+	udpMaxAttempts    = 5
+	udpIdlePoll       = 50 * time.Millisecond
+)
+
+// errUDPTimeout is returned when the device stops answering a packet
+var errUDPTimeout = errors.New("no response from device")
+
+// udpTransport is fastboot over UDP. Host and device take turns: every
+// packet we send is answered by exactly one packet with the same sequence
+// number, and we resend until that answer arrives.
+type udpTransport struct {
+	conn       net.Conn
+	seq        uint16
+	maxPacket  int
+	timeout    time.Duration
+	maxRetries int
+	pending    []byte // rest of a response that did not fit into Read
+}
+
+// dialFastbootUDP finds the device's starting sequence number and agrees
+// on a packet size
+func dialFastbootUDP(ctx context.Context, address string) (*udpTransport, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTransport{conn: conn, maxPacket: udpMinPacket, timeout: udpReceiveTimeout, maxRetries: udpMaxAttempts}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Query: the answer carries the sequence number to continue with
+	query, err := t.exchange(udpIDQuery, 0, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot udp query: %w", err)
+	}
+	if len(query.data) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot udp query: short answer")
+	}
+	t.seq = binary.BigEndian.Uint16(query.data)
+
+	// Init: both sides announce their version and largest packet
+	init := make([]byte, 4)
+	binary.BigEndian.PutUint16(init, udpVersion)
+	binary.BigEndian.PutUint16(init[2:], udpHostMaxPacket)
+	answer, err := t.exchange(udpIDInit, 0, init)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot udp init: %w", err)
+	}
+	if len(answer.data) < 4 {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot udp init: short answer")
+	}
+	version := binary.BigEndian.Uint16(answer.data)
+	size := int(binary.BigEndian.Uint16(answer.data[2:]))
+	if version < 1 || size < udpMinPacket {
+		conn.Close()
+		return nil, fmt.Errorf("fastboot udp init: unsupported version %d, packet size %d", version, size)
+	}
+	t.maxPacket = min(size, udpHostMaxPacket)
+	return t, nil
+}
+
+type udpPacket struct {
+	id    byte
+	flags byte
+	seq   uint16
+	data  []byte
+}
+
+// exchange sends one packet and returns the device's answer, resending
+// on timeouts. Answers to older packets are dropped.
+func (t *udpTransport) exchange(id, flags byte, data []byte) (udpPacket, error) {
+	packet := make([]byte, udpHeaderSize+len(data))
+	packet[0], packet[1] = id, flags
+	binary.BigEndian.PutUint16(packet[2:], t.seq)
+	copy(packet[udpHeaderSize:], data)
+
+	buf := make([]byte, udpHostMaxPacket)
+	for attempt := 0; attempt < t.maxRetries; attempt++ {
+		if _, err := t.conn.Write(packet); err != nil {
+			return udpPacket{}, err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			t.conn.SetReadDeadline(deadline)
+			n, err := t.conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break // resend
+			}
+			if err != nil {
+				return udpPacket{}, err
+			}
+			if n < udpHeaderSize {
+				continue
+			}
+			answer := udpPacket{id: buf[0], flags: buf[1], seq: binary.BigEndian.Uint16(buf[2:]), data: append([]byte(nil), buf[udpHeaderSize:n]...)}
+			if answer.seq != t.seq {
+				// A late answer to a packet we already resent
+				continue
+			}
+			if answer.id == udpIDError {
+				return answer, fmt.Errorf("device error: %s", answer.data)
+			}
+			if answer.id != id {
+				return answer, fmt.Errorf("answer id %d to packet id %d", answer.id, id)
+			}
+			// Query does not advance the sequence, everything else does
+			if id != udpIDQuery {
+				t.seq++
+			}
+			return answer, nil
+		}
+	}
+	return udpPacket{}, errUDPTimeout
+}
+
+// Write sends one fastboot message, split into packets with the
+// continuation flag on all but the last
+func (t *udpTransport) Write(p []byte) (int, error) {
+	chunk := t.maxPacket - udpHeaderSize
+	sent := 0
+	for {
+		n := min(chunk, len(p)-sent)
+		var flags byte
+		if sent+n < len(p) {
+			flags = udpFlagContinuation
+		}
+		if _, err := t.exchange(udpIDFastboot, flags, p[sent:sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+		if sent == len(p) {
+			return sent, nil
+		}
+	}
+}
+
+// Read polls the device with empty packets until it answers with a
+// message, collecting continued packets into one
+func (t *udpTransport) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		var message []byte
+		for {
+			answer, err := t.exchange(udpIDFastboot, 0, nil)
+			if err != nil {
+				return 0, err
+			}
+			message = append(message, answer.data...)
+			if answer.flags&udpFlagContinuation != 0 {
+				continue
+			}
+			if len(message) > 0 {
+				break
+			}
+			// Nothing to say yet, e.g. while a partition is being written
+			time.Sleep(udpIdlePoll)
+		}
+		t.pending = message
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPDevice is the device side of fastboot over UDP in front of a
+// FakeFastboot. It answers every packet once and repeats its last answer
+// when the host resends.
+type fakeUDPDevice struct {
+	conn      net.PacketConn
+	dev       *FakeFastboot
+	dropEvery int // drop every nth packet received, 0 drops none
+	split     int // answer in continued packets of this size, 0 does not split
+
+	mu       sync.Mutex
+	received []udpPacket
+}
+
+func newFakeUDPDevice(t *testing.T, dev *FakeFastboot) *fakeUDPDevice {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(); dev.Close() })
+	return &fakeUDPDevice{conn: conn, dev: dev}
+}
+
+func (d *fakeUDPDevice) addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+func (d *fakeUDPDevice) packets() []udpPacket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]udpPacket(nil), d.received...)
+}
+
+func (d *fakeUDPDevice) serve() {
+	// Messages from the fastboot side, waiting for the host to poll
+	var queue [][]byte
+	var queueMu sync.Mutex
+	go func() {
+		buf := make([]byte, fastbootMaxResponse)
+		for {
+			n, err := d.dev.Read(buf)
+			if err != nil {
+				return
+			}
+			queueMu.Lock()
+			queue = append(queue, append([]byte(nil), buf[:n]...))
+			queueMu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, udpHostMaxPacket)
+	var last []byte
+	var lastSeq uint16
+	var message, answer []byte
+	count := 0
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		count++
+		if d.dropEvery > 0 && count%d.dropEvery == 0 {
+			continue
+		}
+		packet := udpPacket{id: buf[0], flags: buf[1], seq: binary.BigEndian.Uint16(buf[2:]), data: append([]byte(nil), buf[udpHeaderSize:n]...)}
+		d.mu.Lock()
+		d.received = append(d.received, packet)
+		d.mu.Unlock()
+		if last != nil && packet.seq == lastSeq && packet.id != udpIDQuery {
+			d.conn.WriteTo(last, addr)
+			continue
+		}
+
+		reply := []byte{packet.id, 0, 0, 0}
+		binary.BigEndian.PutUint16(reply[2:], packet.seq)
+		switch packet.id {
+		case udpIDQuery:
+			d.conn.WriteTo(append(reply, 0x12, 0x34), addr)
+			continue
+		case udpIDInit:
+			reply = append(reply, 0, 1, 0x02, 0x00) // version 1, 512 bytes
+		case udpIDFastboot:
+			if len(packet.data) > 0 {
+				message = append(message, packet.data...)
+				if packet.flags&udpFlagContinuation == 0 {
+					d.dev.Write(message)
+					message = nil
+				}
+				break
+			}
+			if len(answer) == 0 {
+				time.Sleep(time.Millisecond)
+				queueMu.Lock()
+				if len(queue) > 0 {
+					answer, queue = queue[0], queue[1:]
+				}
+				queueMu.Unlock()
+			}
+			part := answer
+			if d.split > 0 && len(part) > d.split {
+				part = part[:d.split]
+				reply[1] = udpFlagContinuation
+			}
+			reply = append(reply, part...)
+			answer = answer[len(part):]
+		}
+		last, lastSeq = reply, packet.seq
+		d.conn.WriteTo(reply, addr)
+	}
+}
+
+func TestFastbootUDPHandshake(t *testing.T) {
+	device := newFakeUDPDevice(t, NewFakeFastboot(map[string]string{"product": "cheetah"}))
+	go device.serve()
+	transport, err := dialFastbootUDP(context.Background(), device.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if transport.maxPacket != 512 || transport.seq != 0x1235 {
+		t.Errorf("max packet %d, sequence %#x", transport.maxPacket, transport.seq)
+	}
+	if _, err := newFastbootClient(transport, "udp").GetVar(context.Background(), "product"); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := device.packets()
+	if len(packets) < 4 {
+		t.Fatalf("packets = %+v", packets)
+	}
+	query, init, command := packets[0], packets[1], packets[2]
+	if query.id != udpIDQuery || query.seq != 0 || len(query.data) != 0 {
+		t.Errorf("query = %+v", query)
+	}
+	if init.id != udpIDInit || init.seq != 0x1234 || !bytes.Equal(init.data, []byte{0, 1, 0x20, 0}) {
+		t.Errorf("init = %+v", init)
+	}
+	if command.id != udpIDFastboot || command.seq != 0x1235 || string(command.data) != "getvar:product" {
+		t.Errorf("command = %+v", command)
+	}
+	// Every poll for the answer takes the next sequence number
+	for i, packet := range packets[3:] {
+		if packet.seq != 0x1236+uint16(i) || len(packet.data) != 0 {
+			t.Errorf("poll %d = %+v", i, packet)
+		}
+	}
+}
+
+func TestFastbootUDPContinuation(t *testing.T) {
+	dev := NewFakeFastboot(map[string]string{"product": "cheetah"})
+	dev.Info("oem ", strings.Repeat("x", 200))
+	device := newFakeUDPDevice(t, dev)
+	device.split = 30
+	go device.serve()
+	transport, err := dialFastbootUDP(context.Background(), device.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	c := newFastbootClient(transport, "udp")
+
+	// A long command goes out in continued packets, a long answer comes
+	// back in them
+	command := "oem " + strings.Repeat("a", 1200)
+	info, err := c.OEM(context.Background(), strings.TrimPrefix(command, "oem "))
+	if err != nil || len(info) != 1 || info[0] != strings.Repeat("x", 200) {
+		t.Fatalf("info = %q, %v", info, err)
+	}
+	var sizes []int
+	var flags []byte
+	for _, packet := range device.packets() {
+		if packet.id == udpIDFastboot && len(packet.data) > 0 {
+			sizes = append(sizes, len(packet.data))
+			flags = append(flags, packet.flags)
+		}
+	}
+	if len(sizes) != 3 || sizes[0] != 508 || sizes[1] != 508 || sizes[2] != len(command)-1016 || !bytes.Equal(flags, []byte{1, 1, 0}) {
+		t.Errorf("sizes = %v, flags = %v", sizes, flags)
+	}
+}
+
+func TestFastbootUDPResends(t *testing.T) {
+	dev := NewFakeFastboot(nil)
+	device := newFakeUDPDevice(t, dev)
+	device.dropEvery = 4
+	go device.serve()
+	transport, err := dialFastbootUDP(context.Background(), device.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	transport.timeout = 20 * time.Millisecond
+	c := newFastbootClient(transport, "udp")
+
+	image := filepath.Join(t.TempDir(), "boot.img")
+	os.WriteFile(image, bytes.Repeat([]byte{3}, 20000), 0o644)
+	if err := c.Flash(context.Background(), "boot", image); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Flashed()["boot"] != 20000 {
+		t.Errorf("flashed = %v", dev.Flashed())
+	}
+}
+
+func TestFastbootUDPTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := net.Dial("udp", silent.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &udpTransport{conn: conn, maxPacket: udpMinPacket, timeout: 10 * time.Millisecond, maxRetries: 3}
+	defer transport.Close()
+	if _, err := transport.Write([]byte("getvar:product")); err != errUDPTimeout {
+		t.Errorf("err = %v", err)
+	}
+	buf := make([]byte, 4096)
+	n, _, _ := silent.ReadFrom(buf)
+	for range 2 {
+		// The same packet is sent on every attempt
+		m, _, _ := silent.ReadFrom(buf[n:])
+		if !bytes.Equal(buf[:n], buf[n:n+m]) {
+			t.Errorf("resent %q, first %q", buf[n:n+m], buf[:n])
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fastbootConn is a device in fastboot mode. The protocol client talks to
+// it directly; cliFastboot goes through the fastboot binary for devices we
+// have no transport for.
+type fastbootConn interface {
+	Serial() string
+	GetVar(ctx context.Context, name string) (string, error)
+	Flash(ctx context.Context, partition, image string) error
+	Erase(ctx context.Context, partition string) error
+	SetActive(ctx context.Context, slot string) error
+	Reboot(ctx context.Context, target string) error
+	OEM(ctx context.Context, args ...string) ([]string, error)
+	Flashing(ctx context.Context, action string) ([]string, error)
+	WipeSuper(ctx context.Context, image string) error
+	ResizeLogicalPartition(ctx context.Context, partition string, size int64) error
+	Close() error
+}
+
+var (
+	_ fastbootConn = (*fastbootClient)(nil)
+	_ fastbootConn = (*cliFastboot)(nil)
+)
+
+// cliFastboot runs the fastboot binary for every command
+type cliFastboot struct {
+	runner CommandRunner
+	serial string
+	OnLine func(OutputLine)
+}
+
+var fbRemoteFailLine = regexp.MustCompile(`FAILED \(remote: '(.*)'\)`)
+
+func (c *cliFastboot) Serial() string {
+	return c.serial
+}
+
+func (c *cliFastboot) Close() error {
+	return nil
+}
+
+// run calls fastboot on our device and turns "FAILED (remote: ...)" into
+// the same FastbootError the protocol client returns
+func (c *cliFastboot) run(ctx context.Context, command string, args ...string) (*CommandResult, error) {
+	if c.serial != "" {
+		args = append([]string{"-s", c.serial}, args...)
+	}
+	timeout := quickTimeout
+	switch command {
+	case "flash", "erase", "wipe-super":
+		timeout = batchTimeout
+	case "reboot":
+		timeout = rebootTimeout
+	}
+	onLine := c.OnLine
+	if strings.HasPrefix(command, "getvar:") {
+		// Variables are shown by the caller, not as raw output
+		onLine = nil
+	}
+	result, err := c.runner.Run(ctx, Command{Name: "fastboot", Args: args, Timeout: timeout, OnLine: onLine})
+	if m := fbRemoteFailLine.FindStringSubmatch(result.Output()); m != nil && ctx.Err() == nil {
+		return result, &FastbootError{Command: command, Message: m[1]}
+	}
+	return result, err
+}
+
+// bootloaderInfo returns the "(bootloader) ..." lines of fastboot output
+func bootloaderInfo(output string) []string {
+	var info []string
+	for _, line := range strings.Split(output, "\n") {
+		if msg, ok := strings.CutPrefix(strings.TrimSpace(line), "(bootloader) "); ok {
+			info = append(info, msg)
+		}
+	}
+	return info
+}
+
+// GetVar reads the "name: value" line fastboot prints for getvar
+func (c *cliFastboot) GetVar(ctx context.Context, name string) (string, error) {
+	result, err := c.run(ctx, "getvar:"+name, "getvar", name)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(result.Output(), "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("fastboot getvar %s: no value in output", name)
+}
+
+func (c *cliFastboot) Flash(ctx context.Context, partition, image string) error {
+	_, err := c.run(ctx, "flash", "flash", partition, image)
+	return err
+}
+
+func (c *cliFastboot) Erase(ctx context.Context, partition string) error {
+	_, err := c.run(ctx, "erase", "erase", partition)
+	return err
+}
+
+func (c *cliFastboot) SetActive(ctx context.Context, slot string) error {
+	_, err := c.run(ctx, "set_active", "set_active", slot)
+	return err
+}
+
+func (c *cliFastboot) Reboot(ctx context.Context, target string) error {
+	args := []string{"reboot"}
+	if target != "" {
+		args = append(args, target)
+	}
+	_, err := c.run(ctx, "reboot", args...)
+	return err
+}
+
+func (c *cliFastboot) OEM(ctx context.Context, args ...string) ([]string, error) {
+	result, err := c.run(ctx, "oem", append([]string{"oem"}, args...)...)
+	return bootloaderInfo(result.Output()), err
+}
+
+func (c *cliFastboot) Flashing(ctx context.Context, action string) ([]string, error) {
+	result, err := c.run(ctx, "flashing", "flashing", action)
+	return bootloaderInfo(result.Output()), err
+}
+
+func (c *cliFastboot) WipeSuper(ctx context.Context, image string) error {
+	_, err := c.run(ctx, "wipe-super", "wipe-super", image)
+	return err
+}
+
+func (c *cliFastboot) ResizeLogicalPartition(ctx context.Context, partition string, size int64) error {
+	_, err := c.run(ctx, "resize-logical-partition", "resize-logical-partition", partition, strconv.FormatInt(size, 10))
+	return err
+}
+
+var errNoFastbootDevice = errors.New("no device in fastboot mode")
+
+// openFastboot returns the device in fastboot mode, with its output going
+// to the log
+func (t *FlashTool) openFastboot(ctx context.Context) (fastbootConn, error) {
+	var candidates []string
+	entries, err := t.fastbootDevices(ctx)
+	if err == nil {
+		for _, entry := range entries {
+			candidates = append(candidates, entry.Serial)
+		}
+	}
+	if serial := t.fastbootNet.get(); serial != "" {
+		candidates = append(candidates, serial)
+	} else if err != nil {
+		return nil, err
+	}
+
+	serial, err := pickTarget(targetFrom(ctx), candidates, errNoFastbootDevice)
+	if err != nil {
+		return nil, err
+	}
+	return t.dialFastboot(ctx, serial, t.appendOutput)
+}
+
+// dialFastboot opens serial without looking it up, with its output going
+// to onLine
+func (t *FlashTool) dialFastboot(ctx context.Context, serial string, onLine func(OutputLine)) (fastbootConn, error) {
+	var conn fastbootConn = &cliFastboot{runner: t.runner, serial: serial, OnLine: onLine}
+	if isNetworkSerial(serial) {
+		var err error
+		if conn, err = t.openNetworkFastboot(ctx, serial, onLine); err != nil {
+			return nil, err
+		}
+	}
+	return varRecorder{fastbootConn: conn, devices: &t.devices}, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transport carries fastboot packets between us and a device. Every Write
+// is one command or one piece of download data, every Read returns one
+// response packet. USB, TCP and UDP each frame packets their own way.
+type Transport interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+// Fastboot protocol limits
+const (
+	fastbootMaxCommand  = 4096
+	fastbootMaxResponse = 256
+	fastbootChunkSize   = 1024 * 1024
+)
+
+// FastbootError is a FAIL answer from the bootloader
+type FastbootError struct {
+	Command string
+	Message string
+}
+
+func (e *FastbootError) Error() string {
+	return fmt.Sprintf("fastboot %s: %s", e.Command, e.Message)
+}
+
+// isFastbootError reports whether err is a FAIL answer from the device
+func isFastbootError(err error) bool {
+	var fbErr *FastbootError
+	return errors.As(err, &fbErr)
+}
+
+// fastbootResponse is everything the device answered to one command
+type fastbootResponse struct {
+	Message  string   // text after OKAY
+	Info     []string // INFO messages, in order
+	Text     string   // TEXT payloads joined together
+	DataSize int64    // size announced by DATA, download only
+}
+
+// fastbootClient speaks the fastboot protocol over a Transport
+type fastbootClient struct {
+	transport Transport
+	serial    string
+
+	// OnLine receives the same lines the fastboot binary would print, so
+	// the log and the progress tracker work the same for both
+	OnLine func(OutputLine)
+	// OnBytes receives the size of every piece of download data sent
+	OnBytes func(n int64)
+
+	maxDownload int64
+}
+
+func newFastbootClient(transport Transport, serial string) *fastbootClient {
+	return &fastbootClient{transport: transport, serial: serial}
+}
+
+func (c *fastbootClient) Serial() string {
+	return c.serial
+}
+
+func (c *fastbootClient) Close() error {
+	return c.transport.Close()
+}
+
+func (c *fastbootClient) print(format string, args ...any) {
+	if c.OnLine != nil {
+		c.OnLine(OutputLine{Time: time.Now(), Stream: streamStderr, Text: fmt.Sprintf(format, args...)})
+	}
+}
+
+// printResult finishes a "Sending 'x'" style line the way fastboot does
+func (c *fastbootClient) printResult(start time.Time, err error) {
+	var fbErr *FastbootError
+	switch {
+	case err == nil:
+		c.print("OKAY [%7.3fs]", time.Since(start).Seconds())
+	case errors.As(err, &fbErr):
+		c.print("FAILED (remote: '%s')", fbErr.Message)
+	default:
+		c.print("FAILED (%v)", err)
+	}
+}
+
+// watch closes the transport when ctx ends so a blocked Read returns
+func (c *fastbootClient) watch(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() { c.transport.Close() })
+}
+
+func (c *fastbootClient) ctxErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// command sends one command and reads responses until OKAY, FAIL or DATA
+func (c *fastbootClient) command(ctx context.Context, cmd string) (*fastbootResponse, error) {
+	if len(cmd) > fastbootMaxCommand {
+		return nil, fmt.Errorf("fastboot %s: command too long", cmd)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer c.watch(ctx)()
+	if _, err := c.transport.Write([]byte(cmd)); err != nil {
+		return nil, c.ctxErr(ctx, fmt.Errorf("fastboot %s: %w", cmd, err))
+	}
+	return c.readResponse(ctx, cmd)
+}
+
+func (c *fastbootClient) readResponse(ctx context.Context, cmd string) (*fastbootResponse, error) {
+	response := &fastbootResponse{}
+	buf := make([]byte, fastbootMaxResponse)
+	for {
+		n, err := c.transport.Read(buf)
+		if err != nil {
+			return response, c.ctxErr(ctx, fmt.Errorf("fastboot %s: %w", cmd, err))
+		}
+		if n < 4 {
+			return response, fmt.Errorf("fastboot %s: short response %q", cmd, buf[:n])
+		}
+		status, payload := string(buf[:4]), string(buf[4:n])
+		switch status {
+		case "INFO":
+			response.Info = append(response.Info, payload)
+			c.print("(bootloader) %s", payload)
+		case "TEXT":
+			response.Text += payload
+		case "OKAY":
+			response.Message = payload
+			return response, nil
+		case "FAIL":
+			return response, &FastbootError{Command: cmd, Message: payload}
+		case "DATA":
+			size, err := strconv.ParseInt(payload, 16, 64)
+			if err != nil {
+				return response, fmt.Errorf("fastboot %s: bad DATA size %q", cmd, payload)
+			}
+			response.DataSize = size
+			return response, nil
+		default:
+			return response, fmt.Errorf("fastboot %s: unknown response %q", cmd, buf[:n])
+		}
+	}
+}
+
+// GetVar reads one bootloader variable
+func (c *fastbootClient) GetVar(ctx context.Context, name string) (string, error) {
+	response, err := c.command(ctx, "getvar:"+name)
+	if err != nil {
+		return "", err
+	}
+	return response.Message, nil
+}
+
+// GetVarAll reads every variable the bootloader reports for "getvar:all".
+// Names keep their qualifier, e.g. "partition-size:boot_a".
+func (c *fastbootClient) GetVarAll(ctx context.Context) (map[string]string, error) {
+	response, err := c.command(ctx, "getvar:all")
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for _, info := range response.Info {
+		if i := strings.LastIndex(info, ":"); i > 0 {
+			vars[strings.TrimSpace(info[:i])] = strings.TrimSpace(info[i+1:])
+		}
+	}
+	return vars, nil
+}
+
+// MaxDownloadSize returns how much the device accepts in one download
+func (c *fastbootClient) MaxDownloadSize(ctx context.Context) (int64, error) {
+	if c.maxDownload > 0 {
+		return c.maxDownload, nil
+	}
+	value, err := c.GetVar(ctx, "max-download-size")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("fastboot: bad max-download-size %q", value)
+	}
+	c.maxDownload = size
+	return size, nil
+}
+
+// Download sends size bytes from r into the device's download buffer
+func (c *fastbootClient) Download(ctx context.Context, r io.Reader, size int64) error {
+	cmd := fmt.Sprintf("download:%08x", size)
+	response, err := c.command(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if response.DataSize != size {
+		return fmt.Errorf("fastboot %s: device wants %d bytes", cmd, response.DataSize)
+	}
+
+	defer c.watch(ctx)()
+	buf := make([]byte, fastbootChunkSize)
+	for sent := int64(0); sent < size; {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), size-sent)])
+		if err != nil {
+			return fmt.Errorf("fastboot %s: reading image: %w", cmd, err)
+		}
+		if _, err := c.transport.Write(buf[:n]); err != nil {
+			return c.ctxErr(ctx, fmt.Errorf("fastboot %s: %w", cmd, err))
+		}
+		sent += int64(n)
+		if c.OnBytes != nil {
+			c.OnBytes(int64(n))
+		}
+	}
+	_, err = c.readResponse(ctx, cmd)
+	return err
+}
+
+// Flash downloads an image file and writes it to partition
+func (c *fastbootClient) Flash(ctx context.Context, partition, image string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	maxSize, err := c.MaxDownloadSize(ctx)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= maxSize {
+		start := time.Now()
+		c.print("Sending '%s' (%d KB)", partition, info.Size()/1024)
+		err = c.Download(ctx, f, info.Size())
+		c.printResult(start, err)
+		if err != nil {
+			return err
+		}
+		return c.write(ctx, partition)
+	}
+
+	// Too big for one download: resparse it like the fastboot binary
+	sparse, err := readSparseImage(f)
+	if err != nil {
+		return fmt.Errorf("fastboot flash %s: %w", partition, err)
+	}
+	pieces, err := sparse.split(maxSize)
+	if err != nil {
+		return fmt.Errorf("fastboot flash %s: %s: %w", partition, filepath.Base(image), err)
+	}
+	for i, piece := range pieces {
+		r, size := piece.reader()
+		start := time.Now()
+		c.print("Sending sparse '%s' %d/%d (%d KB)", partition, i+1, len(pieces), size/1024)
+		err = c.Download(ctx, r, size)
+		c.printResult(start, err)
+		if err != nil {
+			return err
+		}
+		if err := c.write(ctx, partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write flashes the downloaded data to partition
+func (c *fastbootClient) write(ctx context.Context, partition string) error {
+	start := time.Now()
+	c.print("Writing '%s'", partition)
+	_, err := c.command(ctx, "flash:"+partition)
+	c.printResult(start, err)
+	return err
+}
+
+// WipeSuper rebuilds the super partition's metadata from a super_empty
+// image, dropping every logical partition. Userspace fastboot only.
+func (c *fastbootClient) WipeSuper(ctx context.Context, image string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	c.print("Sending 'super' (%d KB)", info.Size()/1024)
+	err = c.Download(ctx, f, info.Size())
+	c.printResult(start, err)
+	if err != nil {
+		return err
+	}
+
+	start = time.Now()
+	c.print("Updating super partition")
+	_, err = c.command(ctx, "update-super:super:wipe")
+	c.printResult(start, err)
+	return err
+}
+
+// ResizeLogicalPartition sets the size of a partition inside super.
+// Userspace fastboot only.
+func (c *fastbootClient) ResizeLogicalPartition(ctx context.Context, partition string, size int64) error {
+	start := time.Now()
+	c.print("Resizing '%s'", partition)
+	_, err := c.command(ctx, fmt.Sprintf("resize-logical-partition:%s:%d", partition, size))
+	c.printResult(start, err)
+	return err
+}
+
+// Erase wipes a partition
+func (c *fastbootClient) Erase(ctx context.Context, partition string) error {
+	start := time.Now()
+	c.print("Erasing '%s'", partition)
+	_, err := c.command(ctx, "erase:"+partition)
+	c.printResult(start, err)
+	return err
+}
+
+// SetActive switches the active slot, "a" or "b"
+func (c *fastbootClient) SetActive(ctx context.Context, slot string) error {
+	start := time.Now()
+	c.print("Setting current slot to '%s'", slot)
+	_, err := c.command(ctx, "set_active:"+slot)
+	c.printResult(start, err)
+	return err
+}
+
+// Reboot restarts the device: "" boots Android, otherwise "bootloader",
+// "recovery" or "fastboot"
+func (c *fastbootClient) Reboot(ctx context.Context, target string) error {
+	cmd := "reboot"
+	start := time.Now()
+	if target == "" {
+		c.print("Rebooting")
+	} else {
+		cmd += "-" + target
+		c.print("Rebooting into %s", target)
+	}
+	_, err := c.command(ctx, cmd)
+	c.printResult(start, err)
+	return err
+}
+
+// OEM runs a vendor command and returns its INFO messages
+func (c *fastbootClient) OEM(ctx context.Context, args ...string) ([]string, error) {
+	response, err := c.command(ctx, "oem "+strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	return response.Info, nil
+}
+
+// Flashing runs "flashing unlock", "flashing lock" and friends
+func (c *fastbootClient) Flashing(ctx context.Context, action string) ([]string, error) {
+	response, err := c.command(ctx, "flashing "+action)
+	if err != nil {
+		return nil, err
+	}
+	return response.Info, nil
+}
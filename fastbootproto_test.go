@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFastbootCommands(t *testing.T) {
+	dev := NewFakeFastboot(map[string]string{"product": "lavender", "partition-size:boot_a": "0x4000000"})
+	dev.Fail("erase:userdata", "Erase not allowed")
+	dev.Info("oem device-info", "Device unlocked: true", "Charger screen enabled: false")
+	c := newFastbootClient(dev, "X")
+	var lines []string
+	c.OnLine = func(line OutputLine) { lines = append(lines, line.Text) }
+	ctx := context.Background()
+
+	if product, err := c.GetVar(ctx, "product"); product != "lavender" || err != nil {
+		t.Errorf("product = %q, %v", product, err)
+	}
+	_, err := c.GetVar(ctx, "anti")
+	var fbErr *FastbootError
+	if !errors.As(err, &fbErr) || fbErr.Message != "GetVar Variable Not found" || fbErr.Command != "getvar:anti" {
+		t.Errorf("err = %v", err)
+	}
+	if err := c.Erase(ctx, "userdata"); !isFastbootError(err) {
+		t.Errorf("erase: %v", err)
+	}
+	info, err := c.OEM(ctx, "device-info")
+	if err != nil || strings.Join(info, "|") != "Device unlocked: true|Charger screen enabled: false" {
+		t.Errorf("info = %q, %v", info, err)
+	}
+	if err := c.SetActive(ctx, "b"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Reboot(ctx, "bootloader"); err != nil {
+		t.Error(err)
+	}
+
+	want := []string{"getvar:product", "getvar:anti", "erase:userdata", "oem device-info", "set_active:b", "reboot-bootloader"}
+	if got := dev.Commands(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q", got)
+	}
+	for _, line := range []string{"Erasing 'userdata'", "FAILED (remote: 'Erase not allowed')", "(bootloader) Device unlocked: true", "Rebooting into bootloader"} {
+		if !strings.Contains(strings.Join(lines, "\n"), line) {
+			t.Errorf("output is missing %q:\n%s", line, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestFastbootGetVarAll(t *testing.T) {
+	dev := NewFakeFastboot(map[string]string{"partition-size:boot_a": "0x4000000", "current-slot": "a"})
+	vars, err := newFastbootClient(dev, "X").GetVarAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["partition-size:boot_a"] != "0x4000000" || vars["current-slot"] != "a" || vars["max-download-size"] != "0x10000000" {
+		t.Errorf("vars = %v", vars)
+	}
+}
+
+func TestFastbootDownload(t *testing.T) {
+	dev := NewFakeFastboot(nil)
+	c := newFastbootClient(dev, "X")
+	var sent int64
+	c.OnBytes = func(n int64) { sent += n }
+	data := bytes.Repeat([]byte("fastboot"), 300000)
+	if err := c.Download(context.Background(), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dev.download, data) || sent != int64(len(data)) {
+		t.Errorf("device got %d bytes, %d reported", len(dev.download), sent)
+	}
+	if got := dev.Commands(); len(got) != 1 || got[0] != "download:00249f00" {
+		t.Errorf("commands = %q", got)
+	}
+
+	// A short image is an error, not a hang
+	err := c.Download(context.Background(), bytes.NewReader(data[:10]), int64(len(data)))
+	if err == nil || !strings.Contains(err.Error(), "reading image") {
+		t.Errorf("short reader: %v", err)
+	}
+}
+
+// fakeFastbootReplies is a transport that answers from a fixed list
+type fakeFastbootReplies []string
+
+func (r *fakeFastbootReplies) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*r)[0])
+	*r = (*r)[1:]
+	return n, nil
+}
+
+func (r *fakeFastbootReplies) Write(p []byte) (int, error) { return len(p), nil }
+func (r *fakeFastbootReplies) Close() error                { return nil }
+
+func TestFastbootResponses(t *testing.T) {
+	tests := []struct {
+		replies []string
+		want    string
+		err     string
+	}{
+		{[]string{"OKAY0x1000"}, "0x1000", ""},
+		{[]string{"INFOone", "TEXTtwo", "OKAY"}, "", ""},
+		{[]string{"FAILno"}, "", "fastboot getvar:x: no"},
+		{[]string{"DATA0000zz"}, "", "bad DATA size"},
+		{[]string{"OK"}, "", "short response"},
+		{[]string{"WHAT"}, "", "unknown response"},
+		{nil, "", "EOF"},
+	}
+	for _, test := range tests {
+		replies := fakeFastbootReplies(test.replies)
+		value, err := newFastbootClient(&replies, "X").GetVar(context.Background(), "x")
+		if test.err == "" && (err != nil || value != test.want) || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: value = %q, err = %v", test.replies, value, err)
+		}
+	}
+}
+
+// buildSparse writes a sparse image of blockSize 16 from chunks of
+// {type, blocks, data}
+func buildSparse(t *testing.T, blocks uint32, chunks ...any) string {
+	t.Helper()
+	var body bytes.Buffer
+	count := 0
+	for i := 0; i < len(chunks); i += 3 {
+		kind, n, data := chunks[i].(int), chunks[i+1].(int), chunks[i+2].(string)
+		header := make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(header, uint16(kind))
+		binary.LittleEndian.PutUint32(header[4:], uint32(n))
+		binary.LittleEndian.PutUint32(header[8:], uint32(sparseChunkHeaderSize+len(data)))
+		body.Write(header)
+		body.WriteString(data)
+		count++
+	}
+	header := make([]byte, sparseHeaderSize)
+	binary.LittleEndian.PutUint32(header, sparseMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1)
+	binary.LittleEndian.PutUint16(header[8:], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], 16)
+	binary.LittleEndian.PutUint32(header[16:], blocks)
+	binary.LittleEndian.PutUint32(header[20:], uint32(count))
+	path := filepath.Join(t.TempDir(), "sparse.img")
+	if err := os.WriteFile(path, append(header, body.Bytes()...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// expandSparse writes a sparse image over disk the way the bootloader
+// does, leaving don't care blocks alone
+func expandSparse(t *testing.T, image []byte, disk []byte) {
+	t.Helper()
+	if binary.LittleEndian.Uint32(image) != sparseMagic {
+		t.Fatal("not a sparse image")
+	}
+	blockSize := int(binary.LittleEndian.Uint32(image[12:]))
+	if total := int(binary.LittleEndian.Uint32(image[16:])) * blockSize; total != len(disk) {
+		t.Fatalf("image covers %d bytes, the partition is %d", total, len(disk))
+	}
+	count := int(binary.LittleEndian.Uint32(image[20:]))
+	rest, at := image[sparseHeaderSize:], 0
+	for i := 0; i < count; i++ {
+		kind := binary.LittleEndian.Uint16(rest)
+		n := int(binary.LittleEndian.Uint32(rest[4:])) * blockSize
+		data := rest[sparseChunkHeaderSize:binary.LittleEndian.Uint32(rest[8:])]
+		switch kind {
+		case sparseRaw:
+			copy(disk[at:at+n], data)
+		case sparseFill:
+			for j := at; j < at+n; j += 4 {
+				copy(disk[j:], data)
+			}
+		}
+		at += n
+		rest = rest[sparseChunkHeaderSize+len(data):]
+	}
+	if at != len(disk) || len(rest) != 0 {
+		t.Fatalf("image ends at %d with %d bytes left", at, len(rest))
+	}
+}
+
+func TestSparseSplit(t *testing.T) {
+	raw := func(blocks int, b byte) string { return strings.Repeat(string(b), blocks*16) }
+	sparse := buildSparse(t, 20,
+		sparseRaw, 3, raw(3, 'a'),
+		sparseDontCare, 2, "",
+		sparseFill, 5, "fill",
+		sparseCRC32, 0, "crc!",
+		sparseRaw, 6, raw(6, 'b'),
+		sparseDontCare, 4, "",
+	)
+	plain := filepath.Join(t.TempDir(), "raw.img")
+	os.WriteFile(plain, []byte(strings.Repeat("0123456789", 1000)), 0o644)
+
+	limits := map[string][]int64{
+		sparse: {120, 200, 1000, 5000},
+		plain:  {4200, 9000, 20000}, // raw images are wrapped in 4 KB blocks
+	}
+	for path, limits := range limits {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		image, err := readSparseImage(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk := make([]byte, int(image.blocks)*int(image.blockSize))
+		whole, _ := (&sparsePiece{image: image, chunks: image.chunks}).reader()
+		data, _ := io.ReadAll(whole)
+		expandSparse(t, data, disk)
+
+		for _, limit := range limits {
+			pieces, err := image.split(limit)
+			if err != nil {
+				t.Fatalf("%s, limit %d: %v", filepath.Base(path), limit, err)
+			}
+			split := make([]byte, len(disk))
+			for _, piece := range pieces {
+				r, size := piece.reader()
+				data, _ := io.ReadAll(r)
+				if int64(len(data)) != size || size > limit {
+					t.Errorf("%s, limit %d: piece of %d bytes, %d announced", filepath.Base(path), limit, len(data), size)
+				}
+				expandSparse(t, data, split)
+			}
+			if !bytes.Equal(split, disk) {
+				t.Errorf("%s, limit %d: %d pieces write something else", filepath.Base(path), limit, len(pieces))
+			}
+		}
+	}
+
+	f, _ := os.Open(sparse)
+	defer f.Close()
+	image, _ := readSparseImage(f)
+	if _, err := image.split(60); err == nil {
+		t.Error("a limit below one block was accepted")
+	}
+}
+
+func TestFastbootFlashSparse(t *testing.T) {
+	dev := NewFakeFastboot(map[string]string{"max-download-size": "0x2000"})
+	c := newFastbootClient(dev, "X")
+	var lines []string
+	c.OnLine = func(line OutputLine) { lines = append(lines, line.Text) }
+	image := filepath.Join(t.TempDir(), "system.img")
+	os.WriteFile(image, bytes.Repeat([]byte{1}, 5*4096+100), 0o644)
+
+	if err := c.Flash(context.Background(), "system", image); err != nil {
+		t.Fatal(err)
+	}
+	flashes := 0
+	for _, cmd := range dev.Commands() {
+		if cmd == "flash:system" {
+			flashes++
+		}
+	}
+	output := strings.Join(lines, "\n")
+	if flashes != 6 || !strings.Contains(output, "Sending sparse 'system' 1/6 (4 KB)") || !strings.Contains(output, "Sending sparse 'system' 6/6") {
+		t.Errorf("%d flashes:\n%s", flashes, output)
+	}
+
+	// Images that fit are sent as they are
+	small := filepath.Join(t.TempDir(), "boot.img")
+	os.WriteFile(small, make([]byte, 4000), 0o644)
+	if err := c.Flash(context.Background(), "boot", small); err != nil || dev.Flashed()["boot"] != 4000 {
+		t.Errorf("boot: %v, %d bytes", err, dev.Flashed()["boot"])
+	}
+}
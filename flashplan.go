@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// planEntry is one step of a flash script as the preview shows it
+type planEntry struct {
+	Step      *scriptStep
+	Action    string
+	Partition string
+	Slot      string
+	Image     string // absolute path, empty when the step sends no image
+	Size      int64
+	SizeErr   error
+	Danger    string // why the step destroys user data, empty when it does not
+}
+
+// flashPlan is what a script will do to the phone, read without running it
+type flashPlan struct {
+	Script  *flashScript
+	Entries []planEntry
+	Skipped []*scriptStep
+}
+
+// Partitions whose erase loses the user's data
+var userDataPartitions = []string{"userdata", "metadata", "data"}
+
+func newFlashPlan(script *flashScript) *flashPlan {
+	plan := &flashPlan{Script: script}
+	for _, step := range script.Steps {
+		switch {
+		case step.Kind == stepSkip:
+			plan.Skipped = append(plan.Skipped, step)
+		case step.command():
+			plan.Entries = append(plan.Entries, planStep(step))
+		}
+	}
+	return plan
+}
+
+func planStep(step *scriptStep) planEntry {
+	entry := planEntry{Step: step, Action: step.String()}
+	switch step.Kind {
+	case stepGuard:
+		entry.Action = "check " + step.Var
+	case stepAnti:
+		entry.Action = "check anti-rollback"
+	case stepRequire:
+		entry.Action = "check " + step.Require.Var
+		entry.Partition = "android-info.txt"
+	}
+	if step.Wipe {
+		entry.Danger = "-w wipes userdata"
+	}
+	if step.Kind != stepFastboot || len(step.Args) == 0 {
+		if step.Wipe {
+			entry.Action = "wipe (-w)"
+		}
+		return entry
+	}
+
+	args := step.Args
+	entry.Action = args[0]
+	if step.Wipe {
+		entry.Action = "-w " + entry.Action
+	}
+	switch args[0] {
+	case "flash", "erase":
+		entry.Partition = args[1]
+		switch entry.Slot = step.Slot; entry.Slot {
+		case "":
+			entry.Slot = partitionSlot(args[1])
+		case "all":
+			entry.Slot = "both"
+		}
+		if args[0] == "erase" && isUserData(args[1]) {
+			entry.Danger = "erases user data"
+		}
+		if args[0] == "flash" {
+			entry.Image = args[2]
+			info, err := os.Stat(args[2])
+			if err == nil {
+				entry.Size = info.Size()
+			}
+			entry.SizeErr = err
+			if isUserData(args[1]) {
+				entry.Danger = "overwrites user data"
+			}
+		}
+	case "wipe-super":
+		entry.Partition = "super"
+		entry.Image = args[1]
+		info, err := os.Stat(args[1])
+		if err == nil {
+			entry.Size = info.Size()
+		}
+		entry.SizeErr = err
+	case "set_active":
+		entry.Slot = strings.TrimPrefix(args[1], "_")
+	case "flashing", "oem":
+		entry.Partition = strings.Join(args[1:], " ")
+		switch action := strings.ToLower(args[len(args)-1]); {
+		case strings.HasPrefix(action, "lock"):
+			entry.Danger = "locks the bootloader, wipes user data"
+		case strings.HasPrefix(action, "unlock"):
+			entry.Danger = "unlocks the bootloader, wipes user data"
+		}
+	case "reboot":
+		entry.Partition = strings.Join(args[1:], " ")
+	}
+	return entry
+}
+
+// partitionSlot is the slot of an "_a"/"_b" partition name, "both" for
+// Xiaomi's "_ab"
+func partitionSlot(partition string) string {
+	switch {
+	case strings.HasSuffix(partition, "_ab"):
+		return "both"
+	case strings.HasSuffix(partition, "_a"):
+		return "a"
+	case strings.HasSuffix(partition, "_b"):
+		return "b"
+	}
+	return ""
+}
+
+func isUserData(partition string) bool {
+	for _, name := range userDataPartitions {
+		if partition == name || strings.TrimSuffix(strings.TrimSuffix(partition, "_a"), "_b") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Totals returns how many partitions the plan writes or erases and how
+// many bytes it sends
+func (p *flashPlan) Totals() (int, int64) {
+	steps := 0
+	var bytes int64
+	for _, entry := range p.Entries {
+		if entry.Step.Kind == stepFastboot && len(entry.Step.Args) > 0 && (entry.Step.Args[0] == "flash" || entry.Step.Args[0] == "erase") {
+			steps++
+		}
+		bytes += entry.Size
+	}
+	return steps, bytes
+}
+
+// Destructive returns the entries that lose user data
+func (p *flashPlan) Destructive() []planEntry {
+	var entries []planEntry
+	for _, entry := range p.Entries {
+		if entry.Danger != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (p *flashPlan) Summary() string {
+	steps, bytes := p.Totals()
+	text := fmt.Sprintf("%d steps, %d partitions, %s of images", len(p.Entries), steps, formatBytes(bytes))
+	if n := len(p.Destructive()); n > 0 {
+		text += fmt.Sprintf(", ⚠️ %d steps destroy user data", n)
+	}
+	if len(p.Skipped) > 0 {
+		text += fmt.Sprintf(", lines skipped: %d", len(p.Skipped))
+	}
+	return text
+}
+
+var planColumns = []string{"#", "Line", "Action", "Partition", "Image", "Size", "Slot", "User data"}
+
+func (e planEntry) row(n int) []string {
+	size := ""
+	switch {
+	case e.SizeErr != nil:
+		size = "❌ missing"
+	case e.Image != "":
+		size = formatBytes(e.Size)
+	}
+	danger := ""
+	if e.Danger != "" {
+		danger = "⚠️ " + e.Danger
+	}
+	image := ""
+	if e.Image != "" {
+		image = filepath.Base(e.Image)
+	}
+	line := ""
+	if e.Step.Line > 0 {
+		line = strconv.Itoa(e.Step.Line)
+	}
+	return []string{strconv.Itoa(n), line, e.Action, e.Partition, image, size, e.Slot, danger}
+}
+
+// showFlashPlan shows what the script will do and calls onConfirm when
+// the technician accepts it
+func (t *FlashTool) showFlashPlan(plan *flashPlan, onConfirm func()) {
+	table := widget.NewTable(
+		func() (int, int) {
+			return len(plan.Entries) + 1, len(planColumns)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.TableCellID, cell fyne.CanvasObject) {
+			label := cell.(*widget.Label)
+			if id.Row == 0 {
+				label.TextStyle = fyne.TextStyle{Bold: true}
+				label.Importance = widget.MediumImportance
+				label.SetText(planColumns[id.Col])
+				return
+			}
+			entry := plan.Entries[id.Row-1]
+			label.TextStyle = fyne.TextStyle{}
+			label.Importance = widget.MediumImportance
+			switch {
+			case entry.Danger != "":
+				label.Importance = widget.DangerImportance
+			case entry.SizeErr != nil:
+				label.Importance = widget.WarningImportance
+			}
+			label.SetText(entry.row(id.Row)[id.Col])
+		},
+	)
+	for col, width := range []float32{40, 50, 170, 130, 200, 90, 50, 260} {
+		table.SetColumnWidth(col, width)
+	}
+
+	summary := widget.NewLabel(plan.Summary())
+	summary.Wrapping = fyne.TextWrapWord
+	top := container.NewVBox(widget.NewLabel("Script: "+filepath.Base(plan.Script.Path)), summary)
+	var bottom fyne.CanvasObject
+	if len(plan.Skipped) > 0 {
+		var lines []string
+		for _, step := range plan.Skipped {
+			if step.Line > 0 {
+				lines = append(lines, fmt.Sprintf("line %d: %s", step.Line, step.Source))
+			} else {
+				lines = append(lines, step.Source)
+			}
+		}
+		skipped := widget.NewLabel("Not run:\n" + strings.Join(lines, "\n"))
+		skipped.Wrapping = fyne.TextWrapWord
+		bottom = skipped
+	}
+	content := container.NewBorder(top, bottom, nil, nil, table)
+
+	d := dialog.NewCustomConfirm("Flash plan", "Flash", "Cancel", content, func(ok bool) {
+		if ok {
+			onConfirm()
+		}
+	}, t.window)
+	d.Resize(fyne.NewSize(1000, 600))
+	d.Show()
+}
+
+// confirmFlashPlan reads the script at path and runs onConfirm once the
+// technician has accepted its plan
+func (t *FlashTool) confirmFlashPlan(path string, onConfirm func()) {
+	script, err := loadFlashScript(path)
+	if err != nil {
+		dialog.ShowError(err, t.window)
+		return
+	}
+	plan := newFlashPlan(script)
+	if len(plan.Entries) == 0 {
+		dialog.ShowError(fmt.Errorf("%s has no fastboot steps", filepath.Base(path)), t.window)
+		return
+	}
+	t.showFlashPlan(plan, onConfirm)
+}
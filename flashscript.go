@@ -0,0 +1,1141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Vendor flash scripts (flash_all.bat, flash_all.sh, flash-all.sh) are not
+// handed to a shell: we read them and run every fastboot line as a step on
+// our own fastboot connection, so the same script works on every OS. Only
+// what these scripts use is understood. A fastboot line we cannot follow
+// fails the whole script before anything is sent to the phone.
+
+// Kinds of script steps
+const (
+	stepFastboot = "fastboot"
+	stepGuard    = "guard"   // getvar piped into findstr/grep
+	stepAnti     = "anti"    // Xiaomi anti-rollback check
+	stepRequire  = "require" // android-info.txt line
+	stepEcho     = "echo"
+	stepSleep    = "sleep"
+	stepLabel    = "label"
+	stepGoto     = "goto"
+	stepExit     = "exit"
+	stepSkip     = "skip" // line we do not understand, shown and ignored
+)
+
+const (
+	// Stands in for the script's folder until words are split, it may
+	// contain spaces the script never quoted
+	scriptDirMark = "\x00"
+	// How long a phone may take to come back after reboot-bootloader
+	scriptRebootTimeout = 2 * time.Minute
+	scriptRebootSettle  = 5 * time.Second
+)
+
+// errorCheck is what the script does when a step fails
+type errorCheck struct {
+	Message string // echoed first
+	Goto    string // label to continue at
+	Stop    bool   // exit the script
+}
+
+// scriptStep is one thing a flash script does
+type scriptStep struct {
+	Line   int
+	Source string
+	Kind   string
+
+	Args   []string // fastboot command and arguments, image paths resolved
+	Wipe   bool     // fastboot -w
+	Slot   string   // fastboot --slot: "a", "b" or "all"
+	Resize bool     // flash: size the logical partition to the image first
+
+	Var     string         // guard: variable read
+	Pattern *regexp.Regexp // guard: what findstr/grep looks for in "name: value"
+
+	Require *infoRequirement // require: the android-info.txt line
+
+	Value string // echo text, label, goto target, exit code, seconds, anti version
+	Check *errorCheck
+}
+
+func (s *scriptStep) String() string {
+	switch s.Kind {
+	case stepFastboot:
+		var words []string
+		if s.Wipe {
+			words = append(words, "-w")
+		}
+		if s.Slot != "" {
+			words = append(words, "--slot="+s.Slot)
+		}
+		for i, arg := range s.Args {
+			if (i == 2 && s.Args[0] == "flash") || (i == 1 && s.Args[0] == "wipe-super") {
+				arg = filepath.Base(arg)
+			}
+			words = append(words, arg)
+		}
+		return strings.Join(words, " ")
+	case stepGuard:
+		return fmt.Sprintf("check %s matches %s", s.Var, s.Pattern)
+	case stepAnti:
+		return "check anti-rollback version ≤ " + s.Value
+	case stepRequire:
+		return s.Require.String()
+	case stepSleep:
+		return "wait " + s.Value + "s"
+	case stepEcho, stepLabel, stepGoto:
+		return s.Value
+	}
+	return s.Source
+}
+
+// command reports whether the step talks to the phone
+func (s *scriptStep) command() bool {
+	return s.Kind == stepFastboot || s.Kind == stepGuard || s.Kind == stepAnti || s.Kind == stepRequire
+}
+
+// flashScript is a parsed flash script
+type flashScript struct {
+	Path        string
+	Dir         string
+	Steps       []*scriptStep
+	StopOnError bool // "set -e"
+}
+
+// Commands returns the steps that talk to the phone
+func (s *flashScript) Commands() []*scriptStep {
+	var steps []*scriptStep
+	for _, step := range s.Steps {
+		if step.command() {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func (s *flashScript) label(name string) int {
+	return slices.IndexFunc(s.Steps, func(step *scriptStep) bool {
+		return step.Kind == stepLabel && step.Value == name
+	})
+}
+
+// scriptError is a line of a flash script we refuse to run
+type scriptError struct {
+	Line   int
+	Source string
+	Reason string
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Reason, e.Source)
+}
+
+var (
+	batDirVar   = regexp.MustCompile(`(?i)%~dp0`)
+	shDirVar    = regexp.MustCompile("\\$\\(\\s*dirname\\s+\"?\\$0\"?\\s*\\)|`\\s*dirname\\s+\"?\\$0\"?\\s*`|\\$\\{0%/\\*\\}")
+	batVar      = regexp.MustCompile(`%([A-Za-z_]\w*)%`)
+	shVar       = regexp.MustCompile(`\$\{([A-Za-z_]\w*)\}|\$([A-Za-z_]\w*)`)
+	batAssign   = regexp.MustCompile(`(?i)^set\s+"?([A-Za-z_]\w*)=(.*?)"?$`)
+	shAssign    = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_]\w*)=(.*)$`)
+	antiVarSet  = regexp.MustCompile(`(?i)set\s+"?([A-Za-z_]\w*)=%%`)
+	batErrCheck = regexp.MustCompile(`(?i)^if\s+(errorlevel\s+1\b|not\s+errorlevel\s+0\b|"?%errorlevel%"?\s*(neq|gtr|geq|!=)\s*"?[01]"?|not\s+"?%errorlevel%"?\s*==\s*"?0"?)`)
+	shErrCheck  = regexp.MustCompile(`^if\s+\[+\s*"?\$\?"?\s*(-ne|!=|-gt)\s*"?0"?\s*\]+`)
+	pingSleep   = regexp.MustCompile(`(?i)^ping\s+(?:-n\s+(\d+)\s+)?(?:127\.0\.0\.1|localhost)(?:\s+-n\s+(\d+))?`)
+	redirection = regexp.MustCompile(`^\d?(>>?|<)(&\d|.+)?$`)
+	scriptArgs  = regexp.MustCompile(`^(%\*|\$[*@]|%[1-9]|\$[1-9])$`)
+)
+
+// Lines scripts use to set up a console, nothing to do for us
+var scriptNoise = []string{"echo off", "setlocal", "endlocal", "cls", "title", "color", "chcp", "pause", "cd", "pushd", "popd", "read", "set -x", "set +x", "set -u", "set -o", "mode"}
+
+// loadFlashScript reads and parses a flash script
+func loadFlashScript(path string) (*flashScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFlashScript(path, string(data))
+}
+
+// scriptParser turns script lines into steps
+type scriptParser struct {
+	script  *flashScript
+	batch   bool
+	vars    map[string]string
+	antiVar string
+	last    *scriptStep // last step whose result a check looks at
+}
+
+// parseFlashScript reads a .bat/.cmd script with cmd rules, anything else
+// as a shell script
+func parseFlashScript(path, text string) (*flashScript, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	p := &scriptParser{
+		script: &flashScript{Path: path, Dir: filepath.Dir(path)},
+		batch:  ext == ".bat" || ext == ".cmd",
+		vars:   map[string]string{},
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimSpace(lines[i])
+		for i+1 < len(lines) && (p.batch && strings.HasSuffix(line, "^") || !p.batch && strings.HasSuffix(line, "\\")) {
+			i++
+			line = line[:len(line)-1] + " " + strings.TrimSpace(lines[i])
+		}
+		if end := p.blockEnd(lines, i); end > i {
+			for _, next := range lines[i+1 : end+1] {
+				line += "\n" + strings.TrimSpace(next)
+			}
+			i = end
+		}
+		if err := p.parseLine(number, line); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, step := range p.script.Steps {
+		target := step.Value
+		if step.Kind != stepGoto {
+			if step.Check == nil || step.Check.Goto == "" {
+				continue
+			}
+			target = step.Check.Goto
+		}
+		if p.script.label(target) < 0 {
+			return nil, &scriptError{Line: step.Line, Source: step.Source, Reason: "no label " + target}
+		}
+	}
+	return p.script, nil
+}
+
+// blockEnd finds the last line of an if block opened on line i, i when
+// the line does not open one
+func (p *scriptParser) blockEnd(lines []string, i int) int {
+	line := strings.TrimSpace(lines[i])
+	lower := strings.ToLower(line)
+	if !strings.HasPrefix(lower, "if ") && !strings.HasPrefix(lower, "@if ") {
+		return i
+	}
+	if p.batch {
+		if !strings.HasSuffix(line, "(") {
+			return i
+		}
+		depth := 1
+		for j := i + 1; j < len(lines); j++ {
+			next := strings.TrimSpace(lines[j])
+			if strings.HasSuffix(next, "(") {
+				depth++
+			}
+			if strings.HasPrefix(next, ")") {
+				if depth--; depth == 0 {
+					return j
+				}
+			}
+		}
+		return len(lines) - 1
+	}
+
+	words := strings.Fields(strings.ReplaceAll(line, ";", " "))
+	if words[len(words)-1] == "fi" {
+		return i
+	}
+	depth := 1
+	for j := i + 1; j < len(lines); j++ {
+		words := strings.Fields(strings.ReplaceAll(strings.TrimSpace(lines[j]), ";", " "))
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "if" {
+			depth++
+		}
+		if words[len(words)-1] == "fi" {
+			if depth--; depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(lines) - 1
+}
+
+func (p *scriptParser) add(step *scriptStep) {
+	p.script.Steps = append(p.script.Steps, step)
+	if step.command() {
+		p.last = step
+	}
+}
+
+func (p *scriptParser) parseLine(number int, line string) error {
+	line = strings.TrimPrefix(line, "@")
+	lower := strings.ToLower(line)
+	switch {
+	case line == "":
+		return nil
+	case p.batch && (strings.HasPrefix(lower, "rem ") || lower == "rem" || strings.HasPrefix(line, "::")):
+		return nil
+	case !p.batch && strings.HasPrefix(line, "#"):
+		return nil
+	case !p.batch && (lower == "set -e" || strings.HasPrefix(lower, "set -e ") || lower == "set -o errexit"):
+		p.script.StopOnError = true
+		return nil
+	case strings.HasPrefix(lower, "if "):
+		return p.parseIf(number, line)
+	case p.batch && strings.HasPrefix(line, ":"):
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepLabel, Value: strings.ToLower(strings.TrimSpace(line[1:]))})
+		return nil
+	}
+	for _, noise := range scriptNoise {
+		if lower == noise || strings.HasPrefix(lower, noise+" ") {
+			return nil
+		}
+	}
+
+	// Xiaomi anti-rollback check: the version the package allows is set,
+	// then compared with getvar anti over several lines
+	if name, value, ok := p.assignment(line); ok {
+		switch {
+		case strings.EqualFold(name, "CURRENT_ANTI_VER"):
+			p.add(&scriptStep{Line: number, Source: line, Kind: stepAnti, Value: strings.TrimSpace(value), Check: &errorCheck{Stop: true}})
+		case strings.Contains(strings.ToLower(value), "getvar anti"):
+			p.antiVar = name
+		default:
+			p.vars[name] = p.expand(value)
+		}
+		return nil
+	}
+	if strings.Contains(lower, "getvar anti") {
+		if m := antiVarSet.FindStringSubmatch(line); m != nil {
+			p.antiVar = m[1]
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(lower, "echo ") || lower == "echo." || lower == "echo" {
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepEcho, Value: unquote(strings.TrimSpace(line[min(len(line), 5):]))})
+		return nil
+	}
+	return p.parseCommand(number, line)
+}
+
+// assignment recognises "set NAME=value" and "NAME=value"
+func (p *scriptParser) assignment(line string) (string, string, bool) {
+	re := shAssign
+	if p.batch {
+		re = batAssign
+	}
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], unquote(m[2]), true
+}
+
+// parseIf handles error checks after a command; anything else is skipped
+func (p *scriptParser) parseIf(number int, line string) error {
+	re := shErrCheck
+	if p.batch {
+		re = batErrCheck
+	}
+	lower := strings.ToLower(line)
+	switch {
+	case re.MatchString(line):
+		if p.last == nil {
+			break
+		}
+		check := p.parseCheck(line[len(re.FindString(line)):])
+		if check.Message != "" || check.Stop || check.Goto != "" {
+			p.last.Check = check
+		}
+		return nil
+	case p.antiVar != "" && strings.Contains(line, p.antiVar) || strings.Contains(lower, "current_anti_ver"):
+		// Part of the anti-rollback check
+		return nil
+	case strings.Contains(lower, "fastboot") && strings.Contains(lower, "--version"):
+		// Checks the fastboot binary is recent enough, we are the binary
+		return nil
+	case mentionsFastboot(line):
+		return &scriptError{Line: number, Source: firstLine(line), Reason: "fastboot inside a condition is not supported"}
+	}
+	p.add(&scriptStep{Line: number, Source: firstLine(line), Kind: stepSkip})
+	return nil
+}
+
+// parseCheck reads what runs when a command fails: the part after "||"
+// or the body of an error check
+func (p *scriptParser) parseCheck(body string) *errorCheck {
+	check := &errorCheck{}
+	for _, part := range p.split(body, "&&", "&", ";", "\n") {
+		part = strings.TrimSpace(part)
+		part = strings.TrimSpace(strings.Trim(part, "()"))
+		for _, keyword := range []string{"then ", "do ", "else "} {
+			part = strings.TrimPrefix(part, keyword)
+		}
+		part = strings.TrimPrefix(strings.TrimSpace(part), "@")
+		words := strings.Fields(part)
+		if len(words) == 0 {
+			continue
+		}
+		switch strings.ToLower(words[0]) {
+		case "echo":
+			if check.Message == "" {
+				check.Message = unquote(strings.TrimSpace(part[4:]))
+			}
+		case "exit":
+			check.Stop = true
+		case "goto":
+			if len(words) > 1 {
+				target := strings.ToLower(strings.TrimPrefix(words[1], ":"))
+				if target == "eof" {
+					check.Stop = true
+				} else {
+					check.Goto = target
+				}
+			}
+		}
+	}
+	return check
+}
+
+// parseCommand handles fastboot lines with their "||" handlers and
+// findstr/grep guards, plus the few other commands scripts run
+func (p *scriptParser) parseCommand(number int, line string) error {
+	fail := func(reason string) error {
+		return &scriptError{Line: number, Source: line, Reason: reason}
+	}
+	var check *errorCheck
+	parts := p.split(line, "||")
+	if len(parts) > 2 {
+		return fail("more than one || is not supported")
+	}
+	if len(parts) == 2 {
+		check = p.parseCheck(parts[1])
+	}
+	if len(p.split(parts[0], "&&", "&", ";")) > 1 {
+		if mentionsFastboot(parts[0]) {
+			return fail("chained commands are not supported")
+		}
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepSkip})
+		return nil
+	}
+	pipeline := p.split(parts[0], "|")
+
+	words := p.words(pipeline[0])
+	if len(words) == 0 {
+		return nil
+	}
+	name := strings.ToLower(words[0])
+	switch {
+	case name == "exit":
+		code := "0"
+		for _, word := range words[1:] {
+			if !strings.EqualFold(word, "/b") {
+				code = word
+				break
+			}
+		}
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepExit, Value: code})
+		return nil
+	case name == "goto":
+		if len(words) < 2 {
+			return fail("goto without a label")
+		}
+		target := strings.ToLower(strings.TrimPrefix(words[1], ":"))
+		if target == "eof" {
+			p.add(&scriptStep{Line: number, Source: line, Kind: stepExit, Value: "0"})
+		} else {
+			p.add(&scriptStep{Line: number, Source: line, Kind: stepGoto, Value: target})
+		}
+		return nil
+	case name == "sleep" && len(words) == 2:
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepSleep, Value: strings.TrimSuffix(words[1], "s")})
+		return nil
+	case name == "timeout":
+		for i, word := range words[:len(words)-1] {
+			if strings.EqualFold(word, "/t") {
+				p.add(&scriptStep{Line: number, Source: line, Kind: stepSleep, Value: words[i+1]})
+				return nil
+			}
+		}
+	case name == "ping":
+		if m := pingSleep.FindStringSubmatch(strings.Join(words, " ")); m != nil {
+			count, _ := strconv.Atoi(m[1] + m[2])
+			p.add(&scriptStep{Line: number, Source: line, Kind: stepSleep, Value: strconv.Itoa(max(count-1, 0))})
+			return nil
+		}
+	}
+
+	if !isFastbootWord(words[0]) {
+		if mentionsFastboot(line) {
+			return fail("fastboot inside another command is not supported")
+		}
+		p.add(&scriptStep{Line: number, Source: line, Kind: stepSkip})
+		return nil
+	}
+	step, err := p.fastbootStep(words[1:])
+	if err != nil {
+		return fail(err.Error())
+	}
+	step.Line, step.Source, step.Check = number, line, check
+
+	switch len(pipeline) {
+	case 1:
+	case 2:
+		if len(step.Args) != 2 || step.Args[0] != "getvar" {
+			return fail("only getvar can be piped")
+		}
+		pattern, err := p.guardPattern(p.words(pipeline[1]))
+		if err != nil {
+			return fail(err.Error())
+		}
+		step.Kind, step.Var, step.Pattern = stepGuard, step.Args[1], pattern
+	default:
+		return fail("pipelines are not supported")
+	}
+	p.add(step)
+	return nil
+}
+
+// fastbootStep reads the options and command of a fastboot line
+func (p *scriptParser) fastbootStep(args []string) (*scriptStep, error) {
+	step := &scriptStep{Kind: stepFastboot}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		option := args[0]
+		args = args[1:]
+		switch {
+		case option == "-s" || option == "-S":
+			// Our own connection picks the device
+			if len(args) > 0 {
+				args = args[1:]
+			}
+		case option == "-w":
+			step.Wipe = true
+		case option == "--slot" && len(args) > 0:
+			step.Slot, args = args[0], args[1:]
+		case strings.HasPrefix(option, "--slot="):
+			step.Slot = strings.TrimPrefix(option, "--slot=")
+		default:
+			return nil, fmt.Errorf("fastboot option %s is not supported", option)
+		}
+	}
+	if step.Slot = strings.TrimPrefix(step.Slot, "_"); step.Slot != "" && step.Slot != "a" && step.Slot != "b" && step.Slot != "all" {
+		return nil, fmt.Errorf("slot %s is not supported", step.Slot)
+	}
+
+	if len(args) == 0 {
+		if !step.Wipe {
+			return nil, errors.New("fastboot without a command")
+		}
+		return step, nil
+	}
+	command := strings.ToLower(args[0])
+	args[0] = command
+	switch {
+	case command == "flash" && len(args) == 3:
+		args[2] = p.resolvePath(args[2])
+	case command == "flash":
+		return nil, errors.New("flash needs a partition and an image")
+	case (command == "erase" || command == "set_active" || command == "getvar") && len(args) == 2:
+	case command == "reboot" && len(args) <= 2:
+	case command == "reboot-bootloader" || command == "reboot-fastboot" || command == "reboot-recovery":
+		args = []string{"reboot", strings.TrimPrefix(command, "reboot-")}
+	case (command == "oem" || command == "flashing") && len(args) >= 2:
+	case command == "wipe-super" && len(args) == 2:
+		args[1] = p.resolvePath(args[1])
+	case command == "resize-logical-partition" && len(args) == 3:
+	case command == "devices":
+		step.Kind = stepSkip
+	default:
+		return nil, fmt.Errorf("fastboot %s is not supported", command)
+	}
+	if step.Slot == "all" && command != "flash" && command != "erase" {
+		return nil, errors.New("--slot all only works with flash and erase")
+	}
+	step.Args = args
+	return step, nil
+}
+
+// guardPattern turns the findstr or grep a getvar is piped into into the
+// pattern its "name: value" line must match
+func (p *scriptParser) guardPattern(words []string) (*regexp.Regexp, error) {
+	if len(words) == 0 {
+		return nil, errors.New("empty pipe")
+	}
+	var pattern, flags string
+	literal := true
+	switch strings.ToLower(words[0]) {
+	case "findstr", "findstr.exe":
+		var choices []string
+		for _, word := range words[1:] {
+			lower := strings.ToLower(word)
+			switch {
+			case strings.HasPrefix(lower, "/c:"):
+				pattern = word[3:]
+			case lower == "/r":
+				literal = false
+			case lower == "/i":
+				flags = "(?i)"
+			case strings.HasPrefix(lower, "/"):
+			default:
+				choices = append(choices, word)
+			}
+		}
+		if pattern == "" && len(choices) > 0 {
+			// Without /c: each word is an alternative
+			for i, choice := range choices {
+				if literal {
+					choices[i] = regexp.QuoteMeta(choice)
+				}
+			}
+			return regexp.Compile(flags + strings.Join(choices, "|"))
+		}
+	case "grep":
+		literal = false
+		for _, word := range words[1:] {
+			switch {
+			case word == "-i":
+				flags = "(?i)"
+			case word == "-F":
+				literal = true
+			case strings.HasPrefix(word, "-"):
+			case pattern == "":
+				pattern = word
+			}
+		}
+	default:
+		return nil, fmt.Errorf("piping into %s is not supported", words[0])
+	}
+	if pattern == "" {
+		return nil, errors.New("no pattern in the pipe")
+	}
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	return regexp.Compile(flags + pattern)
+}
+
+// expand replaces variables; the script folder becomes scriptDirMark
+func (p *scriptParser) expand(text string) string {
+	if p.batch {
+		text = batDirVar.ReplaceAllLiteralString(text, scriptDirMark+`\`)
+		return batVar.ReplaceAllStringFunc(text, func(ref string) string {
+			if value, ok := p.vars[ref[1:len(ref)-1]]; ok {
+				return value
+			}
+			return ref
+		})
+	}
+	text = shDirVar.ReplaceAllLiteralString(text, scriptDirMark)
+	return shVar.ReplaceAllStringFunc(text, func(ref string) string {
+		if value, ok := p.vars[strings.Trim(ref, "${}")]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// words expands and splits a command, without the script's own
+// arguments and redirections
+func (p *scriptParser) words(command string) []string {
+	var words []string
+	all := splitWords(p.expand(command), !p.batch)
+	for i := 0; i < len(all); i++ {
+		word := all[i]
+		switch {
+		case scriptArgs.MatchString(word):
+		case redirection.MatchString(word):
+			if strings.TrimLeft(word, "0123456789<>") == "" {
+				i++ // target is the next word
+			}
+		default:
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// resolvePath makes an image path of the script absolute
+func (p *scriptParser) resolvePath(word string) string {
+	word = strings.ReplaceAll(word, scriptDirMark, filepath.ToSlash(p.script.Dir))
+	word = filepath.FromSlash(strings.ReplaceAll(word, `\`, "/"))
+	if !filepath.IsAbs(word) {
+		word = filepath.Join(p.script.Dir, word)
+	}
+	return filepath.Clean(word)
+}
+
+// split cuts text at each separator outside quotes
+func (p *scriptParser) split(text string, seps ...string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' && !p.batch {
+			quote = c
+			continue
+		}
+		for _, sep := range seps {
+			if !strings.HasPrefix(text[i:], sep) {
+				continue
+			}
+			// "|" and "&" are not half of "||" and "&&", nor the "&" of "2>&1"
+			if len(sep) == 1 && (i+1 < len(text) && text[i+1] == sep[0] || i > 0 && strings.IndexByte(sep+"<>", text[i-1]) >= 0) {
+				continue
+			}
+			parts = append(parts, text[start:i])
+			start = i + len(sep)
+			i = start - 1
+			break
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// splitWords splits a command line into words, removing quotes
+func splitWords(text string, singleQuotes bool) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || singleQuotes && r == '\'':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func unquote(text string) string {
+	if len(text) >= 2 && (text[0] == '"' && text[len(text)-1] == '"' || text[0] == '\'' && text[len(text)-1] == '\'') {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
+
+// isFastbootWord reports whether a command word runs fastboot
+func isFastbootWord(word string) bool {
+	name := strings.ToLower(path.Base(strings.ReplaceAll(word, `\`, "/")))
+	return name == "fastboot" || name == "fastboot.exe"
+}
+
+var fastbootWord = regexp.MustCompile(`(?i)(^|[\s\\/"'%$])fastboot(\.exe)?\b`)
+
+func mentionsFastboot(text string) bool {
+	return fastbootWord.MatchString(text)
+}
+
+// scriptRun runs a parsed script on one device
+type scriptRun struct {
+	script *flashScript
+	conn   fastbootConn
+	reopen func(ctx context.Context) (fastbootConn, error)
+	onLine func(OutputLine)
+
+	// override asks whether to go on when an android-info.txt line fails;
+	// overridden holds the lines already accepted before the flash
+	override   func(context.Context, []preflightCheck) bool
+	overridden map[*scriptStep]bool
+}
+
+// status reports the script's progress next to the fastboot output
+func (r *scriptRun) status(text string) {
+	if r.onLine != nil {
+		r.onLine(OutputLine{Time: time.Now(), Stream: streamScript, Text: text})
+	}
+}
+
+func (r *scriptRun) run(ctx context.Context) error {
+	steps := r.script.Steps
+	total := len(r.script.Commands())
+	done := 0
+	var failed error
+	for i := 0; i < len(steps); i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		step := steps[i]
+		switch step.Kind {
+		case stepLabel:
+			continue
+		case stepEcho:
+			r.status("💬 " + step.Value)
+			continue
+		case stepSkip:
+			r.status(fmt.Sprintf("⏭ Line %d skipped: %s", step.Line, step.Source))
+			continue
+		case stepGoto:
+			i = r.script.label(step.Value)
+			continue
+		case stepExit:
+			if failed == nil && step.Value != "0" {
+				failed = fmt.Errorf("line %d: script exits with code %s", step.Line, step.Value)
+			}
+			return failed
+		case stepSleep:
+			seconds, _ := strconv.Atoi(step.Value)
+			r.status(fmt.Sprintf("⏳ Waiting %ds", seconds))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(seconds) * time.Second):
+			}
+			continue
+		}
+
+		done++
+		nextStep(ctx, step.String())
+		if step.Line > 0 {
+			r.status(fmt.Sprintf("▶ Step %d of %d (line %d): %s", done, total, step.Line, step))
+		} else {
+			r.status(fmt.Sprintf("▶ Step %d of %d: %s", done, total, step))
+		}
+		err := r.exec(ctx, step)
+		if err == nil {
+			r.status("✅ " + step.String())
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.status(fmt.Sprintf("❌ %s: %v", step, err))
+
+		check := step.Check
+		if check == nil && r.script.StopOnError {
+			check = &errorCheck{Stop: true}
+		}
+		if check == nil {
+			r.status("⚠️ The script does not check this step, continuing")
+			continue
+		}
+		if check.Message != "" {
+			r.status("💬 " + check.Message)
+		}
+		stepErr := fmt.Errorf("line %d: %s: %w", step.Line, step, err)
+		switch {
+		case check.Goto != "":
+			failed = stepErr
+			i = r.script.label(check.Goto)
+		case check.Stop:
+			return stepErr
+		}
+	}
+	return failed
+}
+
+// exec runs one step that talks to the phone
+func (r *scriptRun) exec(ctx context.Context, step *scriptStep) error {
+	switch step.Kind {
+	case stepGuard:
+		value, err := r.conn.GetVar(ctx, step.Var)
+		if err != nil {
+			return err
+		}
+		line := step.Var + ": " + value
+		r.status(line)
+		if !step.Pattern.MatchString(line) {
+			return fmt.Errorf("%q does not match %s", line, step.Pattern)
+		}
+		return nil
+	case stepAnti:
+		allowed, err := strconv.Atoi(step.Value)
+		if err != nil {
+			return fmt.Errorf("anti-rollback version %q is not a number", step.Value)
+		}
+		value, err := r.conn.GetVar(ctx, "anti")
+		if err != nil && !isFastbootError(err) {
+			return err
+		}
+		// Phones without anti-rollback do not know the variable
+		version, _ := strconv.Atoi(strings.TrimSpace(value))
+		r.status(fmt.Sprintf("anti: %d", version))
+		if version > allowed {
+			return fmt.Errorf("device anti-rollback version %d is greater than this package (%d)", version, allowed)
+		}
+		return nil
+	case stepRequire:
+		return r.require(ctx, step)
+	}
+
+	if step.Wipe {
+		if err := r.wipe(ctx); err != nil {
+			return err
+		}
+	}
+	if len(step.Args) == 0 {
+		return nil
+	}
+	args := step.Args
+	// --slot all writes both slots, like the fastboot binary
+	partitions := func() []string {
+		switch step.Slot {
+		case "":
+			return []string{args[1]}
+		case "all":
+			return []string{args[1] + "_a", args[1] + "_b"}
+		}
+		return []string{args[1] + "_" + step.Slot}
+	}
+	switch args[0] {
+	case "flash":
+		for _, partition := range partitions() {
+			if step.Resize {
+				if err := r.resizeLogical(ctx, partition, args[2]); err != nil {
+					return err
+				}
+			}
+			if err := r.conn.Flash(ctx, partition, args[2]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "wipe-super":
+		return r.conn.WipeSuper(ctx, args[1])
+	case "resize-logical-partition":
+		size, err := strconv.ParseInt(args[2], 0, 64)
+		if err != nil {
+			return fmt.Errorf("bad partition size %q", args[2])
+		}
+		return r.conn.ResizeLogicalPartition(ctx, args[1], size)
+	case "erase":
+		for _, partition := range partitions() {
+			if err := r.conn.Erase(ctx, partition); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "set_active":
+		return r.conn.SetActive(ctx, args[1])
+	case "getvar":
+		value, err := r.conn.GetVar(ctx, args[1])
+		if err == nil {
+			r.status(args[1] + ": " + value)
+		}
+		return err
+	case "oem":
+		_, err := r.conn.OEM(ctx, args[1:]...)
+		return err
+	case "flashing":
+		_, err := r.conn.Flashing(ctx, args[1])
+		return err
+	case "reboot":
+		target := ""
+		if len(args) > 1 {
+			target = args[1]
+		}
+		if err := r.conn.Reboot(ctx, target); err != nil {
+			return err
+		}
+		if target != "bootloader" && target != "fastboot" {
+			return nil
+		}
+		// The rest of the script talks to the phone once it is back
+		r.conn.Close()
+		conn, err := r.reopen(ctx)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+		return nil
+	}
+	return fmt.Errorf("fastboot %s is not supported", args[0])
+}
+
+// resizeLogical makes room for image when partition lives in super, like
+// fastboot update does before flashing it from userspace fastboot
+func (r *scriptRun) resizeLogical(ctx context.Context, partition, image string) error {
+	slot, err := r.conn.GetVar(ctx, "current-slot")
+	if err != nil && !isFastbootError(err) {
+		return err
+	}
+	if slot = strings.TrimPrefix(slot, "_"); slot != "" && partitionSlot(partition) == "" {
+		partition += "_" + slot
+	}
+	logical, err := r.conn.GetVar(ctx, "is-logical:"+partition)
+	if err != nil && !isFastbootError(err) {
+		return err
+	}
+	if logical != "yes" {
+		return nil
+	}
+	size, err := imageSize(image)
+	if err != nil {
+		return err
+	}
+	return r.conn.ResizeLogicalPartition(ctx, partition, size)
+}
+
+// require checks an android-info.txt line now that the phone runs the
+// bootloader it is meant for. A failure stops the flash unless it was
+// overridden before or the technician overrides it now.
+func (r *scriptRun) require(ctx context.Context, step *scriptStep) error {
+	check, err := checkRequirement(ctx, r.conn, step.Require)
+	if err != nil {
+		return err
+	}
+	check.Step = step
+	if check.Result != checkFailed {
+		if strings.HasPrefix(check.Detail, "IGNORE") {
+			r.status(check.Name + " " + check.Detail)
+		} else {
+			r.status(check.Name + " OKAY")
+		}
+		return nil
+	}
+	r.status(check.Name + " FAILED")
+	r.status(check.Detail)
+	switch {
+	case r.overridden[step]:
+		r.status("⚠️ Overridden before the flash")
+		return nil
+	case r.override != nil && r.override(ctx, []preflightCheck{check}):
+		r.status("⚠️ Overridden")
+		return nil
+	}
+	return errors.New("requirements not met")
+}
+
+// wipe does what fastboot -w does: erase userdata, plus cache and
+// metadata where the phone has them
+func (r *scriptRun) wipe(ctx context.Context) error {
+	if err := r.conn.Erase(ctx, "userdata"); err != nil {
+		return err
+	}
+	for _, partition := range []string{"cache", "metadata"} {
+		if err := r.conn.Erase(ctx, partition); err != nil && !isFastbootError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBatchScript runs a flash script file against one device
+func (t *FlashTool) runBatchScript(ctx context.Context, path, serial string, onLine func(OutputLine), override func(context.Context, []preflightCheck) bool) error {
+	script, err := loadFlashScript(path)
+	if err != nil {
+		return err
+	}
+	return t.runScript(ctx, script, serial, onLine, override)
+}
+
+// runScript runs a parsed script against one device through our own
+// fastboot connection. Nothing is flashed when a pre-flight check fails,
+// unless override (when set) says so.
+func (t *FlashTool) runScript(ctx context.Context, script *flashScript, serial string, onLine func(OutputLine), override func(context.Context, []preflightCheck) bool) error {
+	conn, err := t.dialFastboot(ctx, serial, onLine)
+	if err != nil {
+		return err
+	}
+	run := &scriptRun{
+		script: script,
+		conn:   conn,
+		onLine: onLine,
+		reopen: func(ctx context.Context) (fastbootConn, error) {
+			return t.reopenFastboot(ctx, serial, onLine)
+		},
+		override:   override,
+		overridden: map[*scriptStep]bool{},
+	}
+	defer func() { run.conn.Close() }()
+
+	run.status("🔎 Pre-flight checks")
+	checks, err := preflight(ctx, conn, newFlashPlan(script))
+	for _, check := range checks {
+		run.status("   " + check.String())
+	}
+	if err != nil {
+		return err
+	}
+	if failed := failedChecks(checks); len(failed) > 0 {
+		if override == nil || !override(ctx, failed) {
+			return &preflightError{Failed: failed}
+		}
+		run.status(fmt.Sprintf("⚠️ %d failed pre-flight checks overridden", len(failed)))
+		for _, check := range failed {
+			if check.Step != nil {
+				run.overridden[check.Step] = true
+			}
+		}
+	}
+	return run.run(ctx)
+}
+
+// reopenFastboot waits for serial to come back to the bootloader after the
+// script rebooted it
+func (t *FlashTool) reopenFastboot(ctx context.Context, serial string, onLine func(OutputLine)) (fastbootConn, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, scriptRebootTimeout)
+	defer cancel()
+	start := time.Now()
+	gone := false
+	for {
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%s did not come back to fastboot within %s", serial, scriptRebootTimeout)
+		case <-time.After(waitPollInterval):
+		}
+		if time.Since(start) < scriptRebootSettle {
+			continue
+		}
+		if isNetworkSerial(serial) {
+			if conn, err := t.dialFastboot(waitCtx, serial, onLine); err == nil {
+				return conn, nil
+			}
+			continue
+		}
+
+		// Wait for the old session to leave first, like waitForMode
+		entries, _ := t.fastbootDevices(waitCtx)
+		present := slices.ContainsFunc(entries, func(entry deviceEntry) bool { return entry.Serial == serial })
+		if !present {
+			gone = true
+		} else if gone || time.Since(start) > waitLeaveGrace {
+			return t.dialFastboot(waitCtx, serial, onLine)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// describeSteps writes steps as "kind: what" plus their error handling,
+// image paths relative to dir
+func describeSteps(dir string, steps []*scriptStep) []string {
+	var lines []string
+	for _, step := range steps {
+		line := step.Kind + ": " + step.String()
+		if step.Kind == stepFastboot && len(step.Args) > 2 && step.Args[0] == "flash" {
+			image, _ := filepath.Rel(dir, step.Args[2])
+			line += " <" + filepath.ToSlash(image) + ">"
+		}
+		if c := step.Check; c != nil {
+			line += fmt.Sprintf(" || %q", c.Message)
+			if c.Goto != "" {
+				line += " goto " + c.Goto
+			}
+			if c.Stop {
+				line += " stop"
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestParseFlashScript(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		text  string
+		steps []string
+		err   string
+	}{
+		{
+			name: "batch folder and exit handlers",
+			file: "flash_all.bat",
+			text: `@echo off
+fastboot %* flash crclist %~dp0images\crclist.txt || @echo "Flash crclist error" && exit /B 1
+fastboot %* flash xbl_ab "%~dp0images\xbl.elf" || @echo "Flash xbl error" && exit /B 1
+fastboot %* erase userdata
+fastboot %* reboot`,
+			steps: []string{
+				`fastboot: flash crclist crclist.txt <images/crclist.txt> || "Flash crclist error" stop`,
+				`fastboot: flash xbl_ab xbl.elf <images/xbl.elf> || "Flash xbl error" stop`,
+				`fastboot: erase userdata`,
+				`fastboot: reboot`,
+			},
+		},
+		{
+			name: "shell folder forms",
+			file: "flash_all.sh",
+			text: "#!/bin/sh\n" +
+				"fastboot $* flash crclist `dirname $0`/images/crclist.txt\n" +
+				"fastboot $* flash xbl_ab \"$(dirname \"$0\")/images/xbl.elf\"\n" +
+				"fastboot $* flash boot $(dirname $0)/images/boot.img\n",
+			steps: []string{
+				`fastboot: flash crclist crclist.txt <images/crclist.txt>`,
+				`fastboot: flash xbl_ab xbl.elf <images/xbl.elf>`,
+				`fastboot: flash boot boot.img <images/boot.img>`,
+			},
+		},
+		{
+			name: "batch errorlevel blocks",
+			file: "flash_all.bat",
+			text: `fastboot flash boot %~dp0boot.img
+if errorlevel 1 (
+	echo Flash boot error
+	exit /B 1
+)
+fastboot flash dtbo %~dp0dtbo.img
+if %errorlevel% neq 0 echo Flash dtbo error & exit /B 1
+fastboot flash vbmeta %~dp0vbmeta.img
+if "%errorlevel%" NEQ "0" goto error
+echo done
+:error
+echo failed`,
+			steps: []string{
+				`fastboot: flash boot boot.img <boot.img> || "Flash boot error" stop`,
+				`fastboot: flash dtbo dtbo.img <dtbo.img> || "Flash dtbo error" stop`,
+				`fastboot: flash vbmeta vbmeta.img <vbmeta.img> || "" goto error`,
+				`echo: done`,
+				`label: error`,
+				`echo: failed`,
+			},
+		},
+		{
+			name: "shell exit status checks",
+			file: "flash_all.sh",
+			text: `fastboot $* erase boot_ab
+if [ $? -ne 0 ] ; then echo "Erase boot error"; exit 1; fi
+fastboot $* flash dtbo_ab images/dtbo.img
+if [ "$?" != "0" ]; then
+  echo "Flash dtbo error"
+  exit 1
+fi`,
+			steps: []string{
+				`fastboot: erase boot_ab || "Erase boot error" stop`,
+				`fastboot: flash dtbo_ab dtbo.img <images/dtbo.img> || "Flash dtbo error" stop`,
+			},
+		},
+		{
+			name: "findstr and grep guards",
+			file: "flash_all.bat",
+			text: `fastboot %* getvar product 2>&1 | findstr /r /c:"^product: *lavender" || echo Missmatching image and device
+fastboot %* getvar product 2>&1 | findstr /r /c:"^product: *lavender" || exit /B 1`,
+			steps: []string{
+				`guard: check product matches ^product: *lavender || "Missmatching image and device"`,
+				`guard: check product matches ^product: *lavender || "" stop`,
+			},
+		},
+		{
+			name: "grep guard",
+			file: "flash_all.sh",
+			text: `fastboot $* getvar product 2>&1 | grep "^product: *lavender"
+if [ $? -ne 0  ] ; then echo "Missmatching image and device"; exit 1; fi`,
+			steps: []string{
+				`guard: check product matches ^product: *lavender || "Missmatching image and device" stop`,
+			},
+		},
+		{
+			name: "batch anti-rollback block",
+			file: "flash_all.bat",
+			text: `set CURRENT_ANTI_VER=3
+for /f "tokens=2 delims=: " %%i in ('fastboot %* getvar anti 2^>^&1 ^| findstr /r /c:"anti:"') do (set version=%%i)
+if [%version%] EQU [] set version=0
+if %version% GTR %CURRENT_ANTI_VER% (
+	echo "Current device antirollback version is greater than this pakcage"
+	exit /B 1
+)
+fastboot %* reboot`,
+			steps: []string{
+				`anti: check anti-rollback version ≤ 3 || "" stop`,
+				`fastboot: reboot`,
+			},
+		},
+		{
+			name: "shell anti-rollback block",
+			file: "flash_all.sh",
+			text: "CURRENT_ANTI_VER=2\n" +
+				"ver=`fastboot $* getvar anti 2>&1 | grep -oP \"anti: \\K\\d+\"`\n" +
+				"if [ -z \"$ver\" ]; then ver=0; fi\n" +
+				"if [ $ver -gt $CURRENT_ANTI_VER ]; then echo \"Current device antirollback version is greater than this pakcage\"; exit 1; fi\n",
+			steps: []string{
+				`anti: check anti-rollback version ≤ 2 || "" stop`,
+			},
+		},
+		{
+			name: "goto and labels",
+			file: "flash_all.bat",
+			text: `fastboot flash boot boot.img || goto fail
+goto done
+:fail
+echo Flash failed
+exit /b 1
+:done
+fastboot reboot`,
+			steps: []string{
+				`fastboot: flash boot boot.img <boot.img> || "" goto fail`,
+				`goto: done`,
+				`label: fail`,
+				`echo: Flash failed`,
+				`exit: exit /b 1`,
+				`label: done`,
+				`fastboot: reboot`,
+			},
+		},
+		{
+			name: "slot all with set_active",
+			file: "flash_all.sh",
+			text: `fastboot --slot all flash boot boot.img
+fastboot --slot=_b erase misc
+fastboot --slot all set_active a`,
+			err: "line 3: --slot all only works with flash and erase",
+		},
+		{
+			name:  "slot all",
+			file:  "flash_all.sh",
+			text:  "fastboot --slot all flash boot boot.img\nfastboot --slot=_b erase misc\n",
+			steps: []string{`fastboot: --slot=all flash boot boot.img <boot.img>`, `fastboot: --slot=b erase misc`},
+		},
+		{
+			name: "unknown slot",
+			file: "flash_all.sh",
+			text: "fastboot --slot other flash boot boot.img\n",
+			err:  "slot other is not supported",
+		},
+		{
+			name: "missing label",
+			file: "flash_all.bat",
+			text: "fastboot flash boot boot.img || goto fail\n",
+			err:  "line 1: no label fail",
+		},
+		{
+			name: "fastboot update",
+			file: "flash-all.sh",
+			text: "fastboot -w update image.zip\n",
+			err:  "fastboot update is not supported",
+		},
+	}
+
+	dir := filepath.Join(string(filepath.Separator), "roms", "rom folder")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, err := parseFlashScript(filepath.Join(dir, test.file), test.text)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := describeSteps(dir, script.Steps)
+			if strings.Join(got, "\n") != strings.Join(test.steps, "\n") {
+				t.Errorf("steps =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.steps, "\n"))
+			}
+		})
+	}
+}
+
+func TestRunScriptSlotAll(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flash_all.sh")
+	os.WriteFile(filepath.Join(dir, "boot.img"), make([]byte, 64), 0o644)
+	script, err := parseFlashScript(path, "fastboot --slot all flash boot boot.img\nfastboot --slot all erase misc\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &FakeRunner{}
+	r.On("fastboot", "-s", "S", "getvar", "*").Stderr("getvar: FAILED (remote: 'unknown')\n").Exit(1)
+	r.On("fastboot", "-s", "S", "*", "*", "*").Stderr("OKAY\n")
+	r.On("fastboot", "-s", "S", "*", "*").Stderr("OKAY\n")
+	tool := &FlashTool{runner: r}
+	if err := tool.runScript(context.Background(), script, "S", func(OutputLine) {}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var writes []string
+	for _, c := range r.Calls() {
+		if c.Args[2] != "getvar" {
+			writes = append(writes, strings.Join(c.Args[2:4], " "))
+		}
+	}
+	want := []string{"flash boot_a", "flash boot_b", "erase misc_a", "erase misc_b"}
+	if strings.Join(writes, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q, want %q", writes, want)
+	}
+	if entry := newFlashPlan(script).Entries[0]; entry.Slot != "both" {
+		t.Errorf("plan slot = %q", entry.Slot)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+)
+
+// jobKind tells the job manager how a job may interact with other jobs
+type jobKind int
+
+const (
+	jobRead        jobKind = iota // only reads from the device
+	jobControl                    // changes device state (reboot, diag)
+	jobDestructive                // writes partitions or wipes data
+)
+
+// Jobs that are not tied to one device yet share this queue
+const defaultDevice = "default"
+
+// job is one queued or running user action
+type job struct {
+	name   string
+	kind   jobKind
+	device string
+	fn     func(ctx context.Context)
+	op     *operation // set once the job starts
+}
+
+// jobStatus is a snapshot of a job for the UI
+type jobStatus struct {
+	job      *job
+	running  bool
+	elapsed  time.Duration
+	step     int
+	stepName string
+}
+
+func (s jobStatus) String() string {
+	if !s.running {
+		return "⏳ " + s.job.name
+	}
+	text := fmt.Sprintf("▶ %s  %s", s.job.name, s.elapsed.Truncate(time.Second))
+	if s.step > 0 {
+		text += fmt.Sprintf("  step %d: %s", s.step, s.stepName)
+	}
+	return text
+}
+
+// jobManager runs the jobs of each device one after another, so two
+// actions never talk to the same phone at once
+type jobManager struct {
+	mu       sync.Mutex
+	queues   map[string][]*job // the first job of a queue is the running one
+	log      func(string)
+	onChange func()
+}
+
+func newJobManager(log func(string), onChange func()) *jobManager {
+	return &jobManager{
+		queues:   make(map[string][]*job),
+		log:      log,
+		onChange: onChange,
+	}
+}
+
+// conflict reports why incoming cannot be queued behind existing
+func conflict(existing, incoming *job) error {
+	if existing.name == incoming.name {
+		return fmt.Errorf("%s is already running or queued", existing.name)
+	}
+	// While a flash is in progress only read-only jobs may wait for it
+	if existing.kind == jobDestructive && incoming.kind != jobRead {
+		return fmt.Errorf("%s is in progress on this device.\nWait for it to finish or stop it first", existing.name)
+	}
+	return nil
+}
+
+// submit queues j on its device. It starts right away when the device is
+// idle and is refused when it conflicts with a job already there.
+func (m *jobManager) submit(j *job) error {
+	m.mu.Lock()
+	queue := m.queues[j.device]
+	for _, other := range queue {
+		if err := conflict(other, j); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	m.queues[j.device] = append(queue, j)
+	if len(queue) == 0 {
+		m.start(j)
+	}
+	m.mu.Unlock()
+
+	if len(queue) > 0 {
+		m.log(fmt.Sprintf("⏳ %s queued behind %s", j.name, queue[len(queue)-1].name))
+	}
+	m.onChange()
+	return nil
+}
+
+// start runs j in the background, m.mu must be held
+func (m *jobManager) start(j *job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &operation{name: j.name, start: time.Now(), cancel: cancel}
+	j.op = op
+	ctx = context.WithValue(ctx, operationKey{}, op)
+
+	go func() {
+		j.fn(ctx)
+		if op.wasStopped() {
+			m.log(op.cancelRecord())
+		}
+		cancel()
+		m.finish(j)
+	}()
+}
+
+// finish removes j from its queue and starts the next job of the device
+func (m *jobManager) finish(j *job) {
+	m.mu.Lock()
+	queue := m.queues[j.device]
+	for i, other := range queue {
+		if other == j {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.queues, j.device)
+	} else {
+		m.queues[j.device] = queue
+		if queue[0].op == nil {
+			// The output of a queued job follows what ran before it
+			m.log(fmt.Sprintf("\n=== %s ===", queue[0].name))
+			m.start(queue[0])
+		}
+	}
+	m.mu.Unlock()
+	m.onChange()
+}
+
+// cancel stops j when it is running or drops it from the queue
+func (m *jobManager) cancel(j *job) {
+	m.mu.Lock()
+	if j.op != nil {
+		m.mu.Unlock()
+		m.log(fmt.Sprintf("⛔ Stopping %s...", j.name))
+		j.op.stop()
+		return
+	}
+	queue := m.queues[j.device]
+	for i, other := range queue {
+		if other == j {
+			m.queues[j.device] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	m.log(fmt.Sprintf("🗑 Removed %s from the queue", j.name))
+	m.onChange()
+}
+
+// stopAll drops every pending job and stops the running ones
+func (m *jobManager) stopAll() {
+	for _, status := range m.snapshot() {
+		if !status.running {
+			m.cancel(status.job)
+		}
+	}
+	for _, status := range m.snapshot() {
+		m.cancel(status.job)
+	}
+}
+
+// idle reports whether no job is running or queued
+func (m *jobManager) idle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queues) == 0
+}
+
+// destructiveRunning reports whether a flash or wipe is in progress
+func (m *jobManager) destructiveRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, queue := range m.queues {
+		if len(queue) > 0 && queue[0].op != nil && queue[0].kind == jobDestructive {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot lists running jobs first, then pending ones in queue order
+func (m *jobManager) snapshot() []jobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make([]string, 0, len(m.queues))
+	for device := range m.queues {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	var running, pending []jobStatus
+	for _, device := range devices {
+		for _, j := range m.queues[device] {
+			if j.op == nil {
+				pending = append(pending, jobStatus{job: j})
+				continue
+			}
+			step, stepName := j.op.currentStep()
+			running = append(running, jobStatus{
+				job:      j,
+				running:  true,
+				elapsed:  time.Since(j.op.start),
+				step:     step,
+				stepName: stepName,
+			})
+		}
+	}
+	return append(running, pending...)
+}
+
+// run queues fn as a job for the selected device and tells the user when
+// it was refused
+func (t *FlashTool) run(kind jobKind, name string, fn func(ctx context.Context)) {
+	serial := t.target.get()
+	t.startLog()
+	err := t.jobs.submit(&job{name: name, kind: kind, device: t.jobDevice(serial), fn: func(ctx context.Context) {
+		fn(withTarget(ctx, serial))
+	}})
+	if err != nil {
+		dialog.ShowError(err, t.window)
+	}
+}
+
+// jobDevice is the queue of the phone a job for serial talks to, keyed by
+// its own serial whatever name it is connected as. Auto resolves to the
+// only phone connected, so the job waits behind that phone's other jobs,
+// parallel flashes included.
+func (t *FlashTool) jobDevice(serial string) string {
+	if serial != "" {
+		return t.devices.get(serial).Serial
+	}
+	if phones := t.devices.connected(); len(phones) == 1 {
+		return phones[0].Serial
+	}
+	return defaultDevice
+}
+
+// startLog gives a new action a clean log, unless other jobs are still
+// running or queued: their results stay and the new output follows
+func (t *FlashTool) startLog() {
+	if t.jobs.idle() {
+		t.clearLog()
+	}
+}
+
+// refreshJobs updates the job panel, it may be called from any goroutine
+func (t *FlashTool) refreshJobs() {
+	statuses := t.jobs.snapshot()
+	fyne.Do(func() {
+		t.jobStatuses = statuses
+		if t.jobList != nil {
+			t.jobList.Refresh()
+		}
+		if t.stopButton != nil {
+			if len(statuses) > 0 {
+				t.stopButton.Enable()
+			} else {
+				t.stopButton.Disable()
+			}
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobDevice(t *testing.T) {
+	tool := &FlashTool{}
+	if got := tool.jobDevice(""); got != defaultDevice {
+		t.Errorf("no phone: %q", got)
+	}
+
+	now := time.Now()
+	tool.devices.observe(deviceEvent{Time: now, Kind: eventConnected, Serial: "ABC123", Source: sourceFastboot, State: "fastboot"})
+	if got := tool.jobDevice(""); got != "ABC123" {
+		t.Errorf("auto with one phone: %q", got)
+	}
+	// A phone connected over the network queues under its own serial
+	tool.devices.setProps("192.168.1.50:5555", map[string]string{"ro.serialno": "ABC123"})
+	if got := tool.jobDevice("192.168.1.50:5555"); got != "ABC123" {
+		t.Errorf("network name: %q", got)
+	}
+
+	tool.devices.observe(deviceEvent{Time: now, Kind: eventConnected, Serial: "XYZ789", Source: sourceFastboot, State: "fastboot"})
+	if got := tool.jobDevice(""); got != defaultDevice {
+		t.Errorf("auto with two phones: %q", got)
+	}
+	if got := tool.jobDevice("XYZ789"); got != "XYZ789" {
+		t.Errorf("selected phone: %q", got)
+	}
+}
+
+func TestAutoJobWaitsForParallelFlash(t *testing.T) {
+	tool := &FlashTool{}
+	tool.devices.observe(deviceEvent{Time: time.Now(), Kind: eventConnected, Serial: "ABC123", Source: sourceFastboot, State: "fastboot"})
+	var logs []string
+	tool.jobs = newJobManager(func(line string) { logs = append(logs, line) }, func() {})
+
+	release := make(chan struct{})
+	defer close(release)
+	flash := &job{name: "Flash ABC123", kind: jobDestructive, device: tool.jobDevice("ABC123"), fn: func(ctx context.Context) { <-release }}
+	if err := tool.jobs.submit(flash); err != nil {
+		t.Fatal(err)
+	}
+	// Auto is the same phone, so the reboot is refused instead of
+	// running next to the flash
+	reboot := &job{name: "Reboot", kind: jobControl, device: tool.jobDevice(""), fn: func(ctx context.Context) {}}
+	if err := tool.jobs.submit(reboot); err == nil || !strings.Contains(err.Error(), "Flash ABC123 is in progress") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -7,14 +7,18 @@ import (
 )
 
 func main() {
-    myApp := app.New()
+    myApp := app.NewWithID("com.retza.rsztool")
     myWindow := myApp.NewWindow("RSZ Tool")
     
     tool := &FlashTool{
         window: myWindow,
+        runner:    newExecRunner(),
+        adbServer: newADBClient(),
+        adbKeys:   newADBKeyStore(),
     }
     
     tool.createUI()
+    tool.startDeviceWatcher()
     myWindow.Resize(fyne.NewSize(800, 600))
     myWindow.ShowAndRun()
 }
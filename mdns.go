@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mDNS service types adbd announces for wireless debugging
+const (
+	serviceADBPairing = "_adb-tls-pairing._tcp.local."
+	serviceADBConnect = "_adb-tls-connect._tcp.local."
+)
+
+// DNS record types we ask for
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+
+	dnsClassIN      = 1
+	dnsUnicastReply = 0x8000 // QU bit: answer to our port, not the group
+)
+
+const (
+	mdnsAddr          = "224.0.0.251:5353"
+	mdnsQueryInterval = 3 * time.Second
+	mdnsExpiry        = 15 * time.Second
+)
+
+// dnsRecord is one resource record from a response, with only the fields
+// of the types we use
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string // PTR, SRV
+	Port   uint16 // SRV
+	IP     net.IP // A
+}
+
+// dnsQuery builds a query packet asking for every name/type pair
+func dnsQuery(questions map[string]uint16) []byte {
+	packet := make([]byte, 12)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(questions)))
+	names := make([]string, 0, len(questions))
+	for name := range questions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			packet = append(packet, byte(len(label)))
+			packet = append(packet, label...)
+		}
+		packet = append(packet, 0)
+		packet = binary.BigEndian.AppendUint16(packet, questions[name])
+		packet = binary.BigEndian.AppendUint16(packet, dnsClassIN|dnsUnicastReply)
+	}
+	return packet
+}
+
+var errDNSPacket = errors.New("malformed DNS packet")
+
+// dnsName reads a possibly compressed name starting at off and returns it
+// with the offset after it
+func dnsName(packet []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(packet) {
+			return "", 0, errDNSPacket
+		}
+		n := int(packet[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(packet) || jumps > 16 {
+				return "", 0, errDNSPacket
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(packet[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(packet) {
+				return "", 0, errDNSPacket
+			}
+			labels = append(labels, string(packet[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseDNSResponse returns the records of all sections of a response
+func parseDNSResponse(packet []byte) ([]dnsRecord, error) {
+	if len(packet) < 12 || packet[2]&0x80 == 0 {
+		return nil, errDNSPacket
+	}
+	questions := int(binary.BigEndian.Uint16(packet[4:]))
+	records := int(binary.BigEndian.Uint16(packet[6:])) + int(binary.BigEndian.Uint16(packet[8:])) + int(binary.BigEndian.Uint16(packet[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := dnsName(packet, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	var result []dnsRecord
+	for i := 0; i < records; i++ {
+		name, next, err := dnsName(packet, off)
+		if err != nil {
+			return result, err
+		}
+		if next+10 > len(packet) {
+			return result, errDNSPacket
+		}
+		record := dnsRecord{Name: name, Type: binary.BigEndian.Uint16(packet[next:])}
+		size := int(binary.BigEndian.Uint16(packet[next+8:]))
+		data := next + 10
+		if data+size > len(packet) {
+			return result, errDNSPacket
+		}
+		switch record.Type {
+		case dnsTypePTR:
+			record.Target, _, err = dnsName(packet, data)
+		case dnsTypeSRV:
+			if size < 7 {
+				return result, errDNSPacket
+			}
+			record.Port = binary.BigEndian.Uint16(packet[data+4:])
+			record.Target, _, err = dnsName(packet, data+6)
+		case dnsTypeA:
+			if size == 4 {
+				record.IP = net.IP(append([]byte(nil), packet[data:data+4]...))
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+		result = append(result, record)
+		off = data + size
+	}
+	return result, nil
+}
+
+// nearbyDevice is a phone announcing wireless debugging
+type nearbyDevice struct {
+	Instance string // "adb-R5CN1234-AbCdEf"
+	Service  string // serviceADBPairing or serviceADBConnect
+	Addr     string // "192.168.1.20:37123", empty until resolved
+	Seen     time.Time
+}
+
+// Pairing reports whether the phone is waiting for a pairing code
+func (d nearbyDevice) Pairing() bool {
+	return d.Service == serviceADBPairing
+}
+
+// mdnsBrowser keeps what the network announced about adb services
+type mdnsBrowser struct {
+	group    string
+	interval time.Duration // between query rounds
+
+	mu        sync.Mutex
+	instances map[string]nearbyDevice // full instance name -> device
+	srv       map[string]dnsRecord    // instance -> SRV
+	hosts     map[string]net.IP       // SRV target -> IPv4
+}
+
+func newMDNSBrowser() *mdnsBrowser {
+	return &mdnsBrowser{
+		group:     mdnsAddr,
+		interval:  mdnsQueryInterval,
+		instances: make(map[string]nearbyDevice),
+		srv:       make(map[string]dnsRecord),
+		hosts:     make(map[string]net.IP),
+	}
+}
+
+// browse queries until ctx ends, calling onChange with the current list
+// after every round
+func (b *mdnsBrowser) browse(ctx context.Context, onChange func([]nearbyDevice)) error {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	group, err := net.ResolveUDPAddr("udp4", b.group)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Keep whatever parsed before a malformed record
+			records, _ := parseDNSResponse(buf[:n])
+			b.add(records)
+		}
+	}()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteToUDP(dnsQuery(b.questions()), group); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("mdns query: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(b.interval / 3):
+			// Give responders a moment before showing the round
+		}
+		onChange(b.devices())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// questions asks for both services, plus SRV and A records that earlier
+// answers left out
+func (b *mdnsBrowser) questions() map[string]uint16 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	questions := map[string]uint16{serviceADBPairing: dnsTypePTR, serviceADBConnect: dnsTypePTR}
+	for instance := range b.instances {
+		srv, ok := b.srv[instance]
+		if !ok {
+			questions[instance] = dnsTypeSRV
+		} else if b.hosts[srv.Target] == nil {
+			questions[srv.Target] = dnsTypeA
+		}
+	}
+	return questions
+}
+
+func (b *mdnsBrowser) add(records []dnsRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, record := range records {
+		switch record.Type {
+		case dnsTypePTR:
+			if record.Name != serviceADBPairing && record.Name != serviceADBConnect {
+				continue
+			}
+			device := b.instances[record.Target]
+			device.Instance = strings.TrimSuffix(record.Target, "."+record.Name)
+			device.Service = record.Name
+			device.Seen = now
+			b.instances[record.Target] = device
+		case dnsTypeSRV:
+			b.srv[record.Name] = record
+		case dnsTypeA:
+			if record.IP != nil {
+				b.hosts[record.Name] = record.IP
+			}
+		}
+	}
+}
+
+// devices returns the phones seen recently, resolved ones with an address
+func (b *mdnsBrowser) devices() []nearbyDevice {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var devices []nearbyDevice
+	for name, device := range b.instances {
+		if time.Since(device.Seen) > mdnsExpiry {
+			delete(b.instances, name)
+			continue
+		}
+		if srv, ok := b.srv[name]; ok {
+			if ip := b.hosts[srv.Target]; ip != nil {
+				device.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port)))
+			}
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Instance != devices[j].Instance {
+			return devices[i].Instance < devices[j].Instance
+		}
+		return devices[i].Service < devices[j].Service
+	})
+	return devices
+}
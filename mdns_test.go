@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsRecordBytes encodes one resource record, class IN with the cache
+// flush bit set the way mDNS responders send them
+func dnsRecordBytes(name []byte, kind uint16, data []byte) []byte {
+	b := append([]byte(nil), name...)
+	b = binary.BigEndian.AppendUint16(b, kind)
+	b = binary.BigEndian.AppendUint16(b, 0x8001)
+	b = binary.BigEndian.AppendUint32(b, 120)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func dnsNameBytes(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func TestDNSQuery(t *testing.T) {
+	packet := dnsQuery(map[string]uint16{serviceADBPairing: dnsTypePTR, "Android.local.": dnsTypeA})
+	want := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0}
+	// Names are sorted, every question asks for a unicast answer
+	want = append(want, dnsNameBytes("Android.local.")...)
+	want = append(want, 0, dnsTypeA, 0x80, 0x01)
+	want = append(want, dnsNameBytes(serviceADBPairing)...)
+	want = append(want, 0, dnsTypePTR, 0x80, 0x01)
+	if !bytes.Equal(packet, want) {
+		t.Errorf("query =\n%v\nwant\n%v", packet, want)
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	instance := "adb-R5CN1234-AbCdEf." + serviceADBConnect
+	packet := []byte{0, 0, 0x84, 0, 0, 1, 0, 4, 0, 0, 0, 1}
+	// A question before the answers is skipped
+	packet = append(packet, dnsNameBytes(serviceADBConnect)...)
+	packet = append(packet, 0, dnsTypePTR, 0, 1)
+	serviceAt := 12
+
+	// PTR with the service name compressed to the question's
+	ptrTarget := append([]byte{19}, "adb-R5CN1234-AbCdEf"...)
+	ptrTarget = append(ptrTarget, 0xc0, byte(serviceAt))
+	instanceAt := len(packet) + 2 + 10
+	packet = append(packet, dnsRecordBytes([]byte{0xc0, byte(serviceAt)}, dnsTypePTR, ptrTarget)...)
+
+	// TXT is not used and must not throw the parser off
+	packet = append(packet, dnsRecordBytes([]byte{0xc0, byte(instanceAt)}, 16, []byte("\x09version=2"))...)
+
+	srv := []byte{0, 0, 0, 0, 0x9c, 0x40}
+	srv = append(srv, dnsNameBytes("Android.local.")...)
+	packet = append(packet, dnsRecordBytes([]byte{0xc0, byte(instanceAt)}, dnsTypeSRV, srv)...)
+	packet = append(packet, dnsRecordBytes(dnsNameBytes("Android.local."), dnsTypeA, []byte{192, 168, 1, 50})...)
+	// An additional record of a type we ignore
+	packet = append(packet, dnsRecordBytes(dnsNameBytes("Android.local."), 28, make([]byte, 16))...)
+
+	records, err := parseDNSResponse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("records = %+v", records)
+	}
+	ptr, txt, srvRecord, a := records[0], records[1], records[2], records[3]
+	if ptr.Type != dnsTypePTR || ptr.Name != serviceADBConnect || ptr.Target != instance {
+		t.Errorf("PTR = %+v", ptr)
+	}
+	if txt.Type != 16 || txt.Name != instance || txt.Target != "" {
+		t.Errorf("TXT = %+v", txt)
+	}
+	if srvRecord.Type != dnsTypeSRV || srvRecord.Name != instance || srvRecord.Port != 40000 || srvRecord.Target != "Android.local." {
+		t.Errorf("SRV = %+v", srvRecord)
+	}
+	if a.Type != dnsTypeA || a.Name != "Android.local." || !a.IP.Equal(net.IPv4(192, 168, 1, 50)) {
+		t.Errorf("A = %+v", a)
+	}
+
+	// The browser puts the records together into an address
+	b := newMDNSBrowser()
+	b.add(records)
+	devices := b.devices()
+	if len(devices) != 1 || devices[0].Instance != "adb-R5CN1234-AbCdEf" || devices[0].Addr != "192.168.1.50:40000" || devices[0].Pairing() {
+		t.Errorf("devices = %+v", devices)
+	}
+
+	for name, bad := range map[string][]byte{
+		"query":     {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"truncated": packet[:len(packet)-3],
+		"loop":      {0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0xc0, 12},
+	} {
+		if _, err := parseDNSResponse(bad); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+// fakeResponder answers mDNS questions on loopback, every record in its
+// own packet the way a phone that was asked for one type does
+type fakeResponder struct {
+	conn    *net.UDPConn
+	records map[string][]byte // "name type" -> encoded answer
+
+	mu      sync.Mutex
+	queries [][]string // questions of every query, as "name type"
+}
+
+func newFakeResponder(t *testing.T) *fakeResponder {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &fakeResponder{conn: conn, records: make(map[string][]byte)}
+}
+
+func (r *fakeResponder) answer(name string, kind uint16, data []byte) {
+	r.records[fmt.Sprint(name, " ", kind)] = dnsRecordBytes(dnsNameBytes(name), kind, data)
+}
+
+func (r *fakeResponder) asked() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.queries...)
+}
+
+func (r *fakeResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := buf[:n]
+		var questions []string
+		off := 12
+		for range binary.BigEndian.Uint16(packet[4:]) {
+			name, next, err := dnsName(packet, off)
+			if err != nil || next+4 > n {
+				break
+			}
+			questions = append(questions, fmt.Sprint(name, " ", binary.BigEndian.Uint16(packet[next:])))
+			off = next + 4
+		}
+		sort.Strings(questions)
+		r.mu.Lock()
+		r.queries = append(r.queries, questions)
+		r.mu.Unlock()
+		for _, question := range questions {
+			if record, ok := r.records[question]; ok {
+				reply := append([]byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0}, record...)
+				r.conn.WriteToUDP(reply, from)
+			}
+		}
+	}
+}
+
+func TestMDNSBrowse(t *testing.T) {
+	instance := "adb-R5CN1234-AbCdEf." + serviceADBConnect
+	responder := newFakeResponder(t)
+	responder.answer(serviceADBConnect, dnsTypePTR, dnsNameBytes(instance))
+	srv := append([]byte{0, 0, 0, 0, 0x9c, 0x40}, dnsNameBytes("Android.local.")...)
+	responder.answer(instance, dnsTypeSRV, srv)
+	responder.answer("Android.local.", dnsTypeA, []byte{192, 168, 1, 50})
+	go responder.serve()
+
+	b := newMDNSBrowser()
+	b.group = responder.conn.LocalAddr().String()
+	b.interval = 30 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resolved := make(chan []nearbyDevice, 1)
+	go b.browse(ctx, func(devices []nearbyDevice) {
+		if len(devices) == 1 && devices[0].Addr != "" {
+			select {
+			case resolved <- devices:
+			default:
+			}
+		}
+	})
+
+	var devices []nearbyDevice
+	select {
+	case devices = <-resolved:
+	case <-ctx.Done():
+		t.Fatalf("not resolved, questions %q", responder.asked())
+	}
+	cancel()
+	if devices[0].Instance != "adb-R5CN1234-AbCdEf" || devices[0].Addr != "192.168.1.50:40000" || devices[0].Pairing() {
+		t.Errorf("devices = %+v", devices)
+	}
+
+	// Every round asks only for what the last answers left out
+	services := fmt.Sprint(serviceADBConnect, " ", dnsTypePTR) + "|" + fmt.Sprint(serviceADBPairing, " ", dnsTypePTR)
+	var rounds []string
+	for _, questions := range responder.asked() {
+		round := strings.Join(questions, "|")
+		if len(rounds) == 0 || rounds[len(rounds)-1] != round {
+			rounds = append(rounds, round)
+		}
+	}
+	want := []string{
+		services,
+		services + "|" + fmt.Sprint(instance, " ", dnsTypeSRV),
+		"Android.local. 1|" + services,
+		services,
+	}
+	if len(rounds) > len(want) || strings.Join(rounds, "\n") != strings.Join(want[:len(rounds)], "\n") || len(rounds) < 3 {
+		t.Errorf("questions =\n%s\nwant\n%s", strings.Join(rounds, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A phone that stops announcing drops off the list
+	b.mu.Lock()
+	device := b.instances[instance]
+	device.Seen = time.Now().Add(-mdnsExpiry - time.Second)
+	b.instances[instance] = device
+	b.mu.Unlock()
+	if devices := b.devices(); len(devices) != 0 {
+		t.Errorf("expired devices = %+v", devices)
+	}
+	if _, ok := b.questions()[instance]; ok {
+		t.Error("still asking about an expired phone")
+	}
+}
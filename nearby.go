@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showNearbyDevices lists phones announcing wireless debugging on the
+// local network while the dialog is open
+func (t *FlashTool) showNearbyDevices() {
+	var devices []nearbyDevice
+	status := widget.NewLabel("🔎 Searching the local network...")
+
+	list := widget.NewList(
+		func() int {
+			return len(devices)
+		},
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Connect", nil), widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			device := devices[id]
+			row := item.(*fyne.Container)
+			label := row.Objects[0].(*widget.Label)
+			button := row.Objects[1].(*widget.Button)
+
+			addr := device.Addr
+			if addr == "" {
+				addr = "resolving..."
+			}
+			if device.Pairing() {
+				label.SetText(fmt.Sprintf("🔐 %s   %s   (pairing)", device.Instance, addr))
+				button.SetText("Pair")
+				button.OnTapped = func() { t.showPairCodeDialog(device.Addr) }
+			} else {
+				label.SetText(fmt.Sprintf("📶 %s   %s", device.Instance, addr))
+				button.SetText("Connect")
+				button.OnTapped = func() {
+					t.run(jobControl, "Connect Wi-Fi", func(ctx context.Context) {
+						t.adbConnectWifi(ctx, device.Addr)
+					})
+				}
+			}
+			if device.Addr == "" {
+				button.Disable()
+			} else {
+				button.Enable()
+			}
+		},
+	)
+
+	help := widget.NewLabel("Open Developer options > Wireless debugging on the phone.\nUse \"Pair device with pairing code\" the first time.")
+	help.Wrapping = fyne.TextWrapWord
+	content := container.NewBorder(container.NewVBox(help, status), nil, nil, nil, list)
+
+	d := dialog.NewCustom("Nearby devices", "Close", content, t.window)
+	d.Resize(fyne.NewSize(560, 380))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.SetOnClosed(cancel)
+	go func() {
+		err := newMDNSBrowser().browse(ctx, func(found []nearbyDevice) {
+			fyne.Do(func() {
+				devices = found
+				if len(found) == 0 {
+					status.SetText("🔎 Searching the local network... no devices yet")
+				} else {
+					status.SetText(fmt.Sprintf("📡 %d service(s) found", len(found)))
+				}
+				list.Refresh()
+			})
+		})
+		if err != nil {
+			fyne.Do(func() { status.SetText(fmt.Sprintf("❌ Network search failed: %v", err)) })
+		}
+	}()
+	d.Show()
+}
+
+// showPairCodeDialog asks for the code of a phone found on the network
+func (t *FlashTool) showPairCodeDialog(addr string) {
+	code := widget.NewEntry()
+	code.SetPlaceHolder("6-digit code")
+	dialog.ShowForm("Pair "+addr, "Pair", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Pairing code", code)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			pairingCode := strings.TrimSpace(code.Text)
+			if pairingCode == "" {
+				dialog.ShowError(errors.New("enter the pairing code shown on the phone"), t.window)
+				return
+			}
+			t.run(jobControl, "Pair Device", func(ctx context.Context) {
+				t.adbPairDevice(ctx, addr, pairingCode)
+			})
+		}, t.window)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// operation is the running state of a job that can be stopped from the UI
+type operation struct {
+	name   string
+	start  time.Time
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	step     int
+	stepName string
+	stopped  bool
+}
+
+type operationKey struct{}
+
+// nextStep marks the start of the next step of the operation running in
+// ctx, so a cancel can report where it stopped. It returns the step number.
+func nextStep(ctx context.Context, name string) int {
+	op, ok := ctx.Value(operationKey{}).(*operation)
+	if !ok {
+		return 0
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.step++
+	op.stepName = name
+	return op.step
+}
+
+func (op *operation) stop() {
+	op.mu.Lock()
+	op.stopped = true
+	op.mu.Unlock()
+	op.cancel()
+}
+
+func (op *operation) wasStopped() bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.stopped
+}
+
+// currentStep returns the step number and name the operation is at
+func (op *operation) currentStep() (int, string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.step, op.stepName
+}
+
+// cancelRecord describes where a stopped operation was interrupted
+func (op *operation) cancelRecord() string {
+	step, stepName := op.currentStep()
+	elapsed := time.Since(op.start).Seconds()
+	if step == 0 {
+		return fmt.Sprintf("⛔ %s cancelled after %.2fs", op.name, elapsed)
+	}
+	return fmt.Sprintf("⛔ %s cancelled at step %d (%s) after %.2fs", op.name, step, stepName, elapsed)
+}
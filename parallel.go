@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Results of one device in a parallel flash
+const (
+	workerQueued  = "⏳ Queued"
+	workerRunning = "▶ Running"
+	workerPassed  = "✅ Passed"
+	workerFailed  = "❌ Failed"
+	workerStopped = "⛔ Stopped"
+)
+
+// flashWorker flashes one device of a parallel flash and keeps its own
+// log pane and progress bar
+type flashWorker struct {
+	serial string
+
+	logOutput     *widget.Entry
+	progressBar   *widget.ProgressBar
+	progressLabel *widget.Label
+
+	mu      sync.Mutex
+	result  string
+	step    string // fastboot action in progress, the failing one at the end
+	detail  string
+	started time.Time
+	elapsed time.Duration
+}
+
+func newFlashWorker(serial string) *flashWorker {
+	w := &flashWorker{
+		serial:        serial,
+		logOutput:     widget.NewMultiLineEntry(),
+		progressBar:   widget.NewProgressBar(),
+		progressLabel: widget.NewLabel("Waiting for fastboot..."),
+		result:        workerQueued,
+	}
+	w.logOutput.Wrapping = fyne.TextWrapWord
+	return w
+}
+
+func (w *flashWorker) appendLog(message string) {
+	fyne.Do(func() {
+		if w.logOutput.Text == "" {
+			w.logOutput.SetText(message)
+		} else {
+			w.logOutput.SetText(w.logOutput.Text + "\n" + message)
+		}
+	})
+}
+
+func (w *flashWorker) set(change func(w *flashWorker)) {
+	w.mu.Lock()
+	change(w)
+	w.mu.Unlock()
+}
+
+// row is the worker's line in the summary table
+func (w *flashWorker) row() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	elapsed := w.elapsed
+	if w.result == workerRunning {
+		elapsed = time.Since(w.started)
+	}
+	took := ""
+	if elapsed > 0 {
+		took = elapsed.Truncate(time.Second).String()
+	}
+	return []string{w.serial, w.result, w.step, took, w.detail}
+}
+
+// parallelFlash is one script run on several devices at once
+type parallelFlash struct {
+	tool    *FlashTool
+	path    string
+	workers []*flashWorker
+	table   *widget.Table
+
+	// Pre-flight failures the technician accepted before the workers
+	// started, by device
+	approved map[string][]preflightCheck
+
+	mu      sync.Mutex
+	pending int
+}
+
+// How long the pre-flight checks of all devices may take together
+const parallelPreflightTimeout = 2 * time.Minute
+
+var parallelColumns = []string{"Device", "Result", "Step", "Time", "Details"}
+
+// run flashes one device, it is the job body of its worker
+func (p *parallelFlash) run(ctx context.Context, w *flashWorker) {
+	w.set(func(w *flashWorker) {
+		w.result = workerRunning
+		w.started = time.Now()
+	})
+	p.refresh()
+	w.appendLog(fmt.Sprintf("Starting execution of: %s on %s", filepath.Base(p.path), w.serial))
+
+	progress := newProgressTracker(func(fp flashProgress) {
+		fyne.Do(func() {
+			w.progressBar.SetValue(fp.Fraction())
+			w.progressLabel.SetText(fp.String())
+		})
+	})
+	var current fastbootAction
+	onLine := func(line OutputLine) {
+		w.appendLog(line.String())
+		progress.feed(line.Text)
+		if action, ok := parseFastbootAction(line.Text); ok && action != current {
+			current = action
+			w.set(func(w *flashWorker) { w.step = action.String() })
+			p.refresh()
+		}
+	}
+
+	err := p.tool.runBatchScript(ctx, p.path, w.serial, onLine, p.override(w.serial))
+	w.set(func(w *flashWorker) {
+		w.elapsed = time.Since(w.started)
+		switch {
+		case ctx.Err() != nil:
+			w.result = workerStopped
+		case err != nil:
+			w.result = workerFailed
+			w.detail = err.Error()
+			if w.step == "" {
+				w.step = "start"
+			}
+		default:
+			w.result = workerPassed
+			w.step = ""
+		}
+	})
+	switch {
+	case ctx.Err() != nil:
+		progress.fail()
+		w.appendLog("⛔ Stopped")
+	case err != nil:
+		progress.fail()
+		w.appendLog(fmt.Sprintf("❌ Execution failed: %v", err))
+	default:
+		progress.finish()
+		w.appendLog("✅ Completed successfully")
+	}
+	p.done()
+}
+
+// done counts a finished worker and logs the summary after the last one
+func (p *parallelFlash) done() {
+	p.refresh()
+	p.mu.Lock()
+	p.pending--
+	last := p.pending == 0
+	p.mu.Unlock()
+	if !last {
+		return
+	}
+
+	passed := 0
+	var failed []string
+	for _, w := range p.workers {
+		row := w.row()
+		if row[1] == workerPassed {
+			passed++
+		} else if row[2] != "" {
+			failed = append(failed, fmt.Sprintf("   %s %s at %s", row[1], row[0], row[2]))
+		} else {
+			failed = append(failed, fmt.Sprintf("   %s %s", row[1], row[0]))
+		}
+	}
+	p.tool.appendLog(fmt.Sprintf("📋 Parallel flash of %s: %d of %d passed", filepath.Base(p.path), passed, len(p.workers)))
+	for _, line := range failed {
+		p.tool.appendLog(line)
+	}
+}
+
+func (p *parallelFlash) refresh() {
+	fyne.Do(func() {
+		if p.table != nil {
+			p.table.Refresh()
+		}
+	})
+}
+
+// window shows the summary table over one log tab per device
+func (p *parallelFlash) window() fyne.Window {
+	p.table = widget.NewTable(
+		func() (int, int) {
+			return len(p.workers) + 1, len(parallelColumns)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.TableCellID, cell fyne.CanvasObject) {
+			label := cell.(*widget.Label)
+			if id.Row == 0 {
+				label.TextStyle = fyne.TextStyle{Bold: true}
+				label.SetText(parallelColumns[id.Col])
+				return
+			}
+			label.TextStyle = fyne.TextStyle{}
+			label.SetText(p.workers[id.Row-1].row()[id.Col])
+		},
+	)
+	for col, width := range []float32{160, 110, 180, 80, 320} {
+		p.table.SetColumnWidth(col, width)
+	}
+
+	tabs := container.NewAppTabs()
+	for _, w := range p.workers {
+		progress := container.NewVBox(w.progressLabel, w.progressBar)
+		tabs.Append(container.NewTabItem(w.serial, container.NewBorder(progress, nil, nil, nil, w.logOutput)))
+	}
+
+	window := fyne.CurrentApp().NewWindow("Parallel flash - " + filepath.Base(p.path))
+	window.SetContent(container.NewVSplit(p.table, tabs))
+	window.Resize(fyne.NewSize(900, 600))
+
+	// Keep the running times current
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			p.mu.Lock()
+			pending := p.pending
+			p.mu.Unlock()
+			if pending == 0 {
+				return
+			}
+			p.refresh()
+		}
+	}()
+	return window
+}
+
+// override lets a worker go past the failures accepted for its device,
+// and no others
+func (p *parallelFlash) override(serial string) func(context.Context, []preflightCheck) bool {
+	return func(ctx context.Context, failed []preflightCheck) bool {
+		for _, check := range failed {
+			if !slices.ContainsFunc(p.approved[serial], func(ok preflightCheck) bool {
+				return ok.Name == check.Name && ok.Detail == check.Detail
+			}) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// preflightParallel runs the pre-flight checks of the script on every
+// device before any worker starts, asks once whether to go past the
+// failures, then starts the flash
+func (t *FlashTool) preflightParallel(path string, serials []string) {
+	script, err := loadFlashScript(path)
+	if err != nil {
+		dialog.ShowError(err, t.window)
+		return
+	}
+	t.startLog()
+	t.appendLog(fmt.Sprintf("🔎 Pre-flight checks on %d devices", len(serials)))
+	err = t.preflightJobs(script, serials, func(ctx context.Context, results map[string][]preflightCheck, stopped bool) {
+		if stopped {
+			t.appendLog("⛔ Parallel flash cancelled: pre-flight stopped")
+			return
+		}
+		approved := map[string][]preflightCheck{}
+		var failed []preflightCheck
+		for _, serial := range serials {
+			for _, check := range failedChecks(results[serial]) {
+				approved[serial] = append(approved[serial], check)
+				check.Name = serial + ": " + check.Name
+				failed = append(failed, check)
+			}
+		}
+		for _, check := range failed {
+			t.appendLog("   " + check.String())
+		}
+		if len(failed) > 0 && !t.confirmPreflightOverride(ctx, failed) {
+			t.appendLog("⛔ Parallel flash cancelled: pre-flight checks failed")
+			return
+		}
+		if len(failed) == 0 {
+			t.appendLog("✅ Pre-flight checks passed on every device")
+		} else {
+			t.appendLog(fmt.Sprintf("⚠️ %d failed pre-flight checks overridden", len(failed)))
+		}
+		fyne.Do(func() { t.startParallelFlash(path, serials, approved) })
+	})
+	if err != nil {
+		dialog.ShowError(err, t.window)
+	}
+}
+
+// preflightJobs queues the pre-flight of every device as its own job, so
+// it waits for and is refused by that device's other jobs like a flash.
+// The last one to finish calls done with the results of all devices and
+// whether any of them was stopped.
+func (t *FlashTool) preflightJobs(script *flashScript, serials []string, done func(ctx context.Context, results map[string][]preflightCheck, stopped bool)) error {
+	var mu sync.Mutex
+	pending, stopped := len(serials), false
+	results := make(map[string][]preflightCheck)
+
+	var queued []*job
+	for _, serial := range serials {
+		j := &job{
+			name: "Pre-flight " + serial,
+			// Only reads, but a flash follows: refused where one is running
+			kind:   jobControl,
+			device: t.jobDevice(serial),
+		}
+		j.fn = func(ctx context.Context) {
+			checkCtx, cancel := context.WithTimeout(ctx, parallelPreflightTimeout)
+			checks, err := t.preflightDevice(checkCtx, script, serial)
+			cancel()
+			if err != nil {
+				checks = append(checks, preflightCheck{Name: "pre-flight", Result: checkFailed, Detail: err.Error()})
+			}
+
+			mu.Lock()
+			results[serial] = checks
+			stopped = stopped || ctx.Err() != nil
+			pending--
+			last, wasStopped := pending == 0, stopped
+			mu.Unlock()
+			if last {
+				done(ctx, results, wasStopped)
+			}
+		}
+		if err := t.jobs.submit(j); err != nil {
+			// No flash without the pre-flight of every device
+			for _, other := range queued {
+				t.jobs.cancel(other)
+			}
+			return fmt.Errorf("%s: %w", serial, err)
+		}
+		queued = append(queued, j)
+	}
+	return nil
+}
+
+// preflightDevice runs the pre-flight checks of script on one device
+func (t *FlashTool) preflightDevice(ctx context.Context, script *flashScript, serial string) ([]preflightCheck, error) {
+	conn, err := t.dialFastboot(ctx, serial, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return preflight(ctx, conn, newFlashPlan(script))
+}
+
+// startParallelFlash runs the selected script on every serial at once,
+// each device as its own job. approved holds the pre-flight failures the
+// technician accepted.
+func (t *FlashTool) startParallelFlash(path string, serials []string, approved map[string][]preflightCheck) {
+	p := &parallelFlash{tool: t, path: path, pending: len(serials), approved: approved}
+	for _, serial := range serials {
+		p.workers = append(p.workers, newFlashWorker(serial))
+	}
+	p.window().Show()
+
+	for _, w := range p.workers {
+		err := t.jobs.submit(&job{
+			name:   "Flash " + w.serial,
+			kind:   jobDestructive,
+			device: t.jobDevice(w.serial),
+			fn: func(ctx context.Context) {
+				p.run(withTarget(ctx, w.serial), w)
+			},
+		})
+		if err != nil {
+			w.set(func(w *flashWorker) {
+				w.result = workerFailed
+				w.step = "queue"
+				w.detail = err.Error()
+			})
+			w.appendLog(fmt.Sprintf("❌ %v", err))
+			p.done()
+		}
+	}
+}
+
+// fastbootSerials lists the devices a parallel flash can target
+func (t *FlashTool) fastbootSerials() []string {
+	var serials []string
+	for _, device := range t.watcher.snapshot() {
+		if device.Source == sourceFastboot && !slices.Contains(serials, device.Serial) {
+			serials = append(serials, device.Serial)
+		}
+	}
+	if serial := t.fastbootNet.get(); serial != "" {
+		serials = append(serials, serial)
+	}
+	return serials
+}
+
+// showParallelFlashDialog lets the user choose the devices to flash with
+// the selected batch file, then shows its plan before anything starts
+func (t *FlashTool) showParallelFlashDialog() {
+	if t.filePath == "" {
+		dialog.ShowError(fmt.Errorf("please select a batch file first"), t.window)
+		return
+	}
+	serials := t.fastbootSerials()
+	if len(serials) == 0 {
+		dialog.ShowError(errNoFastbootDevice, t.window)
+		return
+	}
+	choice := widget.NewCheckGroup(serials, nil)
+	choice.SetSelected(serials)
+	path := t.filePath
+	dialog.ShowForm("Flash multiple devices", "Flash", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Script", widget.NewLabel(filepath.Base(path))),
+			widget.NewFormItem("Devices", choice),
+		},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			if len(choice.Selected) == 0 {
+				dialog.ShowError(errors.New("choose at least one device"), t.window)
+				return
+			}
+			serials := slices.Clone(choice.Selected)
+			t.confirmFlashPlan(path, func() { t.preflightParallel(path, serials) })
+		}, t.window)
+}
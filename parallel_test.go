@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelOverrideOnlyApproved(t *testing.T) {
+	product := preflightCheck{Name: "product", Result: checkFailed, Detail: "lavender wanted, ginkgo found"}
+	p := &parallelFlash{approved: map[string][]preflightCheck{"AAA": {product}}}
+	ctx := context.Background()
+
+	if !p.override("AAA")(ctx, []preflightCheck{product}) {
+		t.Error("an accepted failure was refused")
+	}
+	other := preflightCheck{Name: "partition boot", Result: checkFailed, Detail: "too big"}
+	if p.override("AAA")(ctx, []preflightCheck{product, other}) {
+		t.Error("a failure nobody saw was let through")
+	}
+	// Accepting a failure on one device says nothing about another
+	if p.override("BBB")(ctx, []preflightCheck{product}) {
+		t.Error("another device's failure was let through")
+	}
+}
+
+func TestPreflightDevice(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "boot.img"), make([]byte, 64), 0o644)
+	script, err := parseFlashScript(filepath.Join(dir, "flash_all.sh"),
+		"fastboot getvar product 2>&1 | grep \"^product: *lavender\" || exit 1\nfastboot flash boot boot.img\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &FakeRunner{}
+	r.On("fastboot", "-s", "AAA", "getvar", "product").Stderr("product: ginkgo\n")
+	r.On("fastboot", "-s", "AAA", "getvar", "*").Stderr("getvar: FAILED (remote: 'unknown')\n").Exit(1)
+	tool := &FlashTool{runner: r}
+
+	checks, err := tool.preflightDevice(context.Background(), script, "AAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := failedChecks(checks)
+	if len(failed) != 1 || !strings.Contains(failed[0].Name, "product") {
+		t.Errorf("failed = %v", failed)
+	}
+	// Nothing but variables is read
+	for _, c := range r.Calls() {
+		if c.Args[2] != "getvar" {
+			t.Errorf("pre-flight ran %s", c)
+		}
+	}
+}
+
+func TestPreflightJobs(t *testing.T) {
+	dir := t.TempDir()
+	script, err := parseFlashScript(filepath.Join(dir, "flash_all.sh"),
+		"fastboot getvar product 2>&1 | grep \"^product: *lavender\" || exit 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTool := func(r *FakeRunner) *FlashTool {
+		tool := &FlashTool{runner: r}
+		tool.jobs = newJobManager(func(string) {}, func() {})
+		return tool
+	}
+	waitIdle := func(t *testing.T, tool *FlashTool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !tool.jobs.idle(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("jobs did not finish")
+			}
+		}
+	}
+
+	t.Run("results of every device", func(t *testing.T) {
+		r := &FakeRunner{}
+		r.On("fastboot", "-s", "AAA", "getvar", "product").Stderr("product: lavender\n")
+		r.On("fastboot", "-s", "BBB", "getvar", "product").Stderr("product: ginkgo\n").Delay(20 * time.Millisecond)
+		r.On("fastboot", "-s", "*", "getvar", "*").Stderr("getvar: FAILED (remote: 'unknown')\n").Exit(1)
+		tool := newTool(r)
+		got := make(chan map[string][]preflightCheck, 2)
+		err := tool.preflightJobs(script, []string{"AAA", "BBB"}, func(ctx context.Context, results map[string][]preflightCheck, stopped bool) {
+			if stopped {
+				t.Error("stopped")
+			}
+			if _, ok := ctx.Value(operationKey{}).(*operation); !ok {
+				t.Error("done does not run in a job")
+			}
+			got <- results
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitIdle(t, tool)
+		results := <-got
+		if len(got) != 0 || len(failedChecks(results["AAA"])) != 0 || len(failedChecks(results["BBB"])) != 1 {
+			t.Errorf("results = %v", results)
+		}
+	})
+
+	t.Run("refused next to a flash", func(t *testing.T) {
+		r := &FakeRunner{}
+		r.On("fastboot", "-s", "*", "getvar", "product").Stderr("product: lavender\n").Delay(20 * time.Millisecond)
+		tool := newTool(r)
+		release := make(chan struct{})
+		tool.jobs.submit(&job{name: "Flash BBB", kind: jobDestructive, device: "BBB", fn: func(ctx context.Context) { <-release }})
+		var called atomic.Bool
+		err := tool.preflightJobs(script, []string{"AAA", "BBB"}, func(context.Context, map[string][]preflightCheck, bool) { called.Store(true) })
+		if err == nil || !strings.Contains(err.Error(), "BBB: Flash BBB is in progress") {
+			t.Errorf("err = %v", err)
+		}
+		close(release)
+		waitIdle(t, tool)
+		if called.Load() {
+			t.Error("the flash went ahead without every pre-flight")
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		r := &FakeRunner{}
+		r.On("fastboot", "-s", "AAA", "getvar", "product").Stderr("product: lavender\n")
+		r.On("fastboot", "-s", "BBB", "getvar", "product").Stderr("product: lavender\n").Delay(time.Minute)
+		tool := newTool(r)
+		var stopped atomic.Bool
+		err := tool.preflightJobs(script, []string{"AAA", "BBB"}, func(_ context.Context, _ map[string][]preflightCheck, s bool) { stopped.Store(s) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		tool.jobs.stopAll()
+		waitIdle(t, tool)
+		if !stopped.Load() {
+			t.Error("the flash was not called off")
+		}
+	})
+}
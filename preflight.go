@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Results of a pre-flight check
+const (
+	checkPassed  = "✅"
+	checkFailed  = "❌"
+	checkUnknown = "❔" // the device did not tell us, not held against the plan
+)
+
+// preflightCheck is one thing verified before a flash starts
+type preflightCheck struct {
+	Name   string
+	Result string
+	Detail string
+	Step   *scriptStep // the script step checked, if any
+}
+
+func (c preflightCheck) String() string {
+	if c.Detail == "" {
+		return c.Result + " " + c.Name
+	}
+	return c.Result + " " + c.Name + ": " + c.Detail
+}
+
+// preflightError is returned when checks failed and nobody overrode them
+type preflightError struct {
+	Failed []preflightCheck
+}
+
+func (e *preflightError) Error() string {
+	return fmt.Sprintf("pre-flight: %d checks failed", len(e.Failed))
+}
+
+func failedChecks(checks []preflightCheck) []preflightCheck {
+	var failed []preflightCheck
+	for _, check := range checks {
+		if check.Result == checkFailed {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// imageSize is how many bytes an image takes on its partition: the
+// expanded size for sparse images, the file size otherwise
+func imageSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, 28)
+	if _, err := io.ReadFull(f, header); err != nil {
+		// Shorter than a sparse header, and readable
+		return info.Size(), nil
+	}
+	if binary.LittleEndian.Uint32(header) != sparseMagic {
+		return info.Size(), nil
+	}
+	blockSize := int64(binary.LittleEndian.Uint32(header[12:]))
+	blocks := int64(binary.LittleEndian.Uint32(header[16:]))
+	return blockSize * blocks, nil
+}
+
+// preflight checks the plan against its files and the connected device.
+// Every check runs, so all problems are reported at once.
+func preflight(ctx context.Context, conn fastbootConn, plan *flashPlan) ([]preflightCheck, error) {
+	var checks []preflightCheck
+	add := func(name, result, detail string) {
+		checks = append(checks, preflightCheck{Name: name, Result: result, Detail: detail})
+	}
+	// getVar tells a variable the bootloader does not know from a device
+	// that stopped answering
+	getVar := func(name string) (string, bool, error) {
+		value, err := conn.GetVar(ctx, name)
+		if err != nil {
+			if isFastbootError(err) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		return value, true, nil
+	}
+
+	// Image files
+	sizes := map[string]int64{}
+	for _, entry := range plan.Entries {
+		if entry.Image == "" {
+			continue
+		}
+		if _, done := sizes[entry.Image]; done {
+			continue
+		}
+		size, err := imageSize(entry.Image)
+		sizes[entry.Image] = size
+		switch {
+		case os.IsNotExist(err):
+			add("image "+filepath.Base(entry.Image), checkFailed, "missing ("+entry.Image+")")
+		case err != nil:
+			add("image "+filepath.Base(entry.Image), checkFailed, "not readable: "+err.Error())
+		default:
+			add("image "+filepath.Base(entry.Image), checkPassed, formatBytes(entry.Size))
+		}
+	}
+
+	// The script's own product and anti-rollback guards
+	run := &scriptRun{script: plan.Script, conn: conn}
+	guarded := false
+	for _, entry := range plan.Entries {
+		step := entry.Step
+		if step.Kind != stepGuard && step.Kind != stepAnti {
+			continue
+		}
+		if step.Kind == stepGuard && step.Var == "product" {
+			if guarded {
+				continue // scripts repeat the same check to echo and to exit
+			}
+			guarded = true
+		}
+		if err := run.exec(ctx, step); err != nil {
+			if ctx.Err() != nil {
+				return checks, ctx.Err()
+			}
+			add(step.String(), checkFailed, err.Error())
+		} else {
+			add(step.String(), checkPassed, "")
+		}
+	}
+
+	// android-info.txt, as fastboot update checks it. A version the plan
+	// flashes first is checked once the phone runs it.
+	flashed := map[string]string{}
+	for _, entry := range plan.Entries {
+		step := entry.Step
+		if step.Kind == stepFastboot && len(step.Args) == 3 && step.Args[0] == "flash" {
+			flashed[step.Args[1]] = step.Args[2]
+		}
+		if step.Kind != stepRequire {
+			continue
+		}
+		image := ""
+		switch step.Require.Var {
+		case "version-bootloader":
+			image = flashed["bootloader"]
+		case "version-baseband":
+			image = flashed["radio"]
+		}
+		if image != "" {
+			add("Checking '"+step.Require.Var+"'", checkUnknown, "checked after "+filepath.Base(image)+" is flashed")
+			continue
+		}
+		check, err := checkRequirement(ctx, conn, step.Require)
+		if err != nil {
+			return checks, err
+		}
+		check.Step = step
+		checks = append(checks, check)
+		if step.Require.Var == "product" && step.Require.Product == "" {
+			guarded = true
+		}
+	}
+	if !guarded {
+		product, ok, err := getVar("product")
+		if err != nil {
+			return checks, err
+		}
+		if ok {
+			add("product", checkUnknown, product+", the script does not check it")
+		}
+	}
+
+	// A locked bootloader refuses every flash unless the plan unlocks it
+	writes, unlocks := false, false
+	for _, entry := range plan.Entries {
+		if args := entry.Step.Args; entry.Step.Kind == stepFastboot && len(args) > 0 {
+			switch {
+			case args[0] == "flash" || args[0] == "erase":
+				writes = true
+			case (args[0] == "flashing" || args[0] == "oem") && strings.HasPrefix(strings.ToLower(args[len(args)-1]), "unlock"):
+				unlocks = true
+			}
+		}
+	}
+	unlocked, ok, err := getVar("unlocked")
+	switch {
+	case err != nil:
+		return checks, err
+	case !ok:
+		add("bootloader unlocked", checkUnknown, "not reported")
+	case writes && !unlocks && strings.EqualFold(unlocked, "no"):
+		add("bootloader unlocked", checkFailed, "the bootloader is locked")
+	default:
+		add("bootloader unlocked", checkPassed, unlocked)
+	}
+
+	// Images bigger than the download buffer go in parts, and every image
+	// must fit its partition
+	maxDownload := int64(0)
+	if value, ok, err := getVar("max-download-size"); err != nil {
+		return checks, err
+	} else if ok {
+		maxDownload, _ = strconv.ParseInt(value, 0, 64)
+	}
+	slot, _, err := getVar("current-slot")
+	if err != nil {
+		return checks, err
+	}
+	for _, entry := range plan.Entries {
+		if entry.Image == "" || entry.SizeErr != nil {
+			continue
+		}
+		name := entry.Partition
+		if maxDownload > 0 && entry.Size > maxDownload {
+			add("download "+name, checkPassed, fmt.Sprintf("%s is sent in parts of %s", formatBytes(entry.Size), formatBytes(maxDownload)))
+		}
+		// super is rebuilt and logical partitions are resized to their
+		// image before they are written
+		if entry.Step.Resize || entry.Step.Args[0] == "wipe-super" {
+			continue
+		}
+
+		var candidates []string
+		switch {
+		case entry.Step.Slot == "all":
+			candidates = []string{name + "_a"}
+		case entry.Step.Slot != "":
+			candidates = []string{name + "_" + entry.Step.Slot}
+		case strings.HasSuffix(name, "_ab"):
+			candidates = []string{strings.TrimSuffix(name, "_ab") + "_a"}
+		default:
+			candidates = []string{name}
+			if slot != "" {
+				candidates = append(candidates, name+"_"+strings.TrimPrefix(slot, "_"))
+			}
+		}
+		size := int64(-1)
+		for _, candidate := range candidates {
+			value, ok, err := getVar("partition-size:" + candidate)
+			if err != nil {
+				return checks, err
+			}
+			if ok {
+				size, _ = strconv.ParseInt(value, 0, 64)
+				break
+			}
+		}
+		switch needed := sizes[entry.Image]; {
+		case size <= 0:
+			add("partition "+name, checkUnknown, "size not reported")
+		case needed > size:
+			add("partition "+name, checkFailed, fmt.Sprintf("%s needs %s, the partition has %s", filepath.Base(entry.Image), formatBytes(needed), formatBytes(size)))
+		default:
+			add("partition "+name, checkPassed, fmt.Sprintf("%s of %s", formatBytes(needed), formatBytes(size)))
+		}
+	}
+	return checks, nil
+}
+
+// confirmPreflightOverride asks whether to flash despite failed checks.
+// It runs on a job and waits for the technician.
+func (t *FlashTool) confirmPreflightOverride(ctx context.Context, failed []preflightCheck) bool {
+	answer := make(chan bool, 1)
+	var d dialog.Dialog
+	fyne.Do(func() {
+		var lines []string
+		for _, check := range failed {
+			lines = append(lines, check.String())
+		}
+		list := widget.NewLabel(strings.Join(lines, "\n"))
+		list.Wrapping = fyne.TextWrapWord
+		scroll := container.NewVScroll(list)
+		scroll.SetMinSize(fyne.NewSize(560, 220))
+		accept := widget.NewCheck("I have read every failure and want to flash anyway", nil)
+		content := container.NewBorder(widget.NewLabel("These pre-flight checks failed:"), accept, nil, nil, scroll)
+		d = dialog.NewCustomConfirm("Pre-flight failed", "Flash anyway", "Cancel", content, func(ok bool) {
+			answer <- ok && accept.Checked
+		}, t.window)
+		d.Show()
+	})
+	select {
+	case ok := <-answer:
+		return ok
+	case <-ctx.Done():
+		fyne.Do(func() {
+			if d != nil {
+				d.Hide()
+			}
+		})
+		return false
+	}
+}
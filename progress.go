@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+// flashProgress is a snapshot of a running flash
+type flashProgress struct {
+	Partition  string
+	Phase      string // "sending", "writing", "erasing", "done", "failed", "finished"
+	Chunk      int    // sparse chunk being sent, 1-based
+	Chunks     int    // number of sparse chunks, 1 for plain images
+	ChunksDone int    // chunks of the current partition written
+	ChunksSent int    // chunks of the current partition sent
+	PartBytes  int64  // bytes of the current partition sent
+	BytesSent  int64  // bytes sent since the flash started
+	TotalBytes int64  // bytes the whole flash will send, 0 when unknown
+	Throughput float64
+	StepsDone  int // partitions finished
+	TotalSteps int // partitions in the flash, 0 when unknown
+	Elapsed    time.Duration
+	Finished   bool
+}
+
+// Fraction is the progress bar value: the whole flash when its size is
+// known, otherwise the partition currently being flashed
+func (p flashProgress) Fraction() float64 {
+	if p.Finished {
+		return 1
+	}
+	if p.TotalBytes > 0 {
+		return min(float64(p.BytesSent)/float64(p.TotalBytes), 1)
+	}
+	partition := 0.0
+	if p.Chunks > 0 {
+		partition = float64(p.ChunksDone) / float64(p.Chunks)
+	}
+	if p.TotalSteps > 0 {
+		return min((float64(p.StepsDone)+partition)/float64(p.TotalSteps), 1)
+	}
+	if p.Phase == "done" {
+		return 1
+	}
+	return partition
+}
+
+// ETA estimates the time left from the measured throughput
+func (p flashProgress) ETA() (time.Duration, bool) {
+	if p.Throughput <= 0 || p.Finished {
+		return 0, false
+	}
+	var remaining int64
+	switch {
+	case p.TotalBytes > 0:
+		remaining = p.TotalBytes - p.BytesSent
+	case p.ChunksSent > 0:
+		// Sparse chunks of one image are about the same size
+		perChunk := p.PartBytes / int64(p.ChunksSent)
+		remaining = perChunk * int64(p.Chunks-p.ChunksSent)
+	default:
+		return 0, false
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / p.Throughput * float64(time.Second)), true
+}
+
+func (p flashProgress) String() string {
+	if p.Finished {
+		return fmt.Sprintf("✅ Finished  %s sent in %s", formatBytes(p.BytesSent), p.Elapsed.Truncate(time.Second))
+	}
+	if p.Partition == "" {
+		return "Waiting for fastboot..."
+	}
+	text := fmt.Sprintf("%s '%s'", phaseLabels[p.Phase], p.Partition)
+	if p.Chunks > 1 {
+		text += fmt.Sprintf("  %d/%d", p.Chunk, p.Chunks)
+	}
+	if p.TotalSteps > 0 {
+		text += fmt.Sprintf("  (partition %d of %d)", min(p.StepsDone+1, p.TotalSteps), p.TotalSteps)
+	}
+	text += "  " + formatBytes(p.BytesSent) + " sent"
+	if p.Throughput > 0 {
+		text += "  " + formatBytes(int64(p.Throughput)) + "/s"
+	}
+	if eta, ok := p.ETA(); ok {
+		text += "  ETA " + eta.Truncate(time.Second).String()
+	}
+	return text
+}
+
+var phaseLabels = map[string]string{
+	"sending": "Sending",
+	"writing": "Writing",
+	"erasing": "Erasing",
+	"done":    "Done",
+	"failed":  "Failed",
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// progressTracker builds a flashProgress from flash events. Events come
+// either from parsed fastboot output (feed) or straight from our own
+// fastboot code calling the event methods.
+type progressTracker struct {
+	mu        sync.Mutex
+	progress  flashProgress
+	start     time.Time
+	sendStart time.Time
+	sendBytes int64 // size of the transfer in flight
+	sending   bool
+	writing   bool
+	sendTime  time.Duration // total time spent sending
+	onChange  func(flashProgress)
+}
+
+func newProgressTracker(onChange func(flashProgress)) *progressTracker {
+	return &progressTracker{start: time.Now(), onChange: onChange}
+}
+
+// setTotals tells the tracker how big the whole flash is when it is known
+func (pt *progressTracker) setTotals(steps int, bytes int64) {
+	pt.update(func(p *flashProgress) {
+		p.TotalSteps = steps
+		p.TotalBytes = bytes
+	})
+}
+
+func (pt *progressTracker) startTransfer(partition string, chunk, chunks int, size int64) {
+	pt.update(func(p *flashProgress) {
+		pt.nextPartition(p, partition)
+		p.Phase = "sending"
+		p.Chunk = chunk
+		p.Chunks = chunks
+		pt.sending = true
+		pt.sendStart = time.Now()
+		pt.sendBytes = size
+	})
+}
+
+// transferDone completes the transfer in flight. took is what fastboot
+// reported, 0 means measure it ourselves.
+func (pt *progressTracker) transferDone(took time.Duration) {
+	pt.update(func(p *flashProgress) {
+		if !pt.sending {
+			return
+		}
+		if took <= 0 {
+			took = time.Since(pt.sendStart)
+		}
+		pt.sending = false
+		pt.sendTime += took
+		p.ChunksSent++
+		p.PartBytes += pt.sendBytes
+		p.BytesSent += pt.sendBytes
+		if pt.sendTime > 0 {
+			p.Throughput = float64(p.BytesSent) / pt.sendTime.Seconds()
+		}
+	})
+}
+
+// addBytes reports part of a transfer as it goes out, for our own
+// fastboot code that knows exactly how much was written
+func (pt *progressTracker) addBytes(n int64) {
+	pt.update(func(p *flashProgress) {
+		p.PartBytes += n
+		p.BytesSent += n
+		pt.sendBytes -= n
+		if elapsed := pt.sendTime + time.Since(pt.sendStart); elapsed > 0 {
+			p.Throughput = float64(p.BytesSent) / elapsed.Seconds()
+		}
+	})
+}
+
+func (pt *progressTracker) startWrite(partition string) {
+	pt.update(func(p *flashProgress) {
+		pt.nextPartition(p, partition)
+		if p.Chunks == 0 {
+			p.Chunks = 1
+		}
+		p.Phase = "writing"
+		pt.writing = true
+	})
+}
+
+func (pt *progressTracker) writeDone() {
+	pt.update(func(p *flashProgress) {
+		if !pt.writing {
+			return
+		}
+		pt.writing = false
+		p.ChunksDone++
+		if p.ChunksDone >= p.Chunks {
+			p.StepsDone++
+			p.Phase = "done"
+			pt.resetPartition(p, p.Partition)
+		}
+	})
+}
+
+func (pt *progressTracker) startErase(partition string) {
+	pt.update(func(p *flashProgress) {
+		pt.nextPartition(p, partition)
+		p.Phase = "erasing"
+		pt.resetPartition(p, partition)
+		p.Chunks = 1
+		pt.writing = true
+	})
+}
+
+func (pt *progressTracker) fail() {
+	pt.update(func(p *flashProgress) {
+		pt.sending, pt.writing = false, false
+		p.Phase = "failed"
+	})
+}
+
+// commandDone ends one fastboot invocation. A script runs many of them,
+// so only finish marks the whole flash as done.
+func (pt *progressTracker) commandDone() {
+	pt.update(func(p *flashProgress) {
+		pt.sending, pt.writing = false, false
+	})
+}
+
+// finish marks the whole flash as done, called by whoever ran it
+func (pt *progressTracker) finish() {
+	pt.update(func(p *flashProgress) {
+		p.Finished = true
+		p.Phase = "finished"
+	})
+}
+
+// nextPartition resets the per-partition counters when a new one starts
+func (pt *progressTracker) nextPartition(p *flashProgress, partition string) {
+	if p.Partition != partition {
+		pt.resetPartition(p, partition)
+	}
+}
+
+func (pt *progressTracker) resetPartition(p *flashProgress, partition string) {
+	p.Partition = partition
+	p.Chunk, p.Chunks, p.ChunksDone, p.ChunksSent, p.PartBytes = 0, 0, 0, 0, 0
+}
+
+func (pt *progressTracker) update(change func(p *flashProgress)) {
+	pt.mu.Lock()
+	change(&pt.progress)
+	pt.progress.Elapsed = time.Since(pt.start)
+	snapshot := pt.progress
+	pt.mu.Unlock()
+	if pt.onChange != nil {
+		pt.onChange(snapshot)
+	}
+}
+
+var (
+	fbSendLine   = regexp.MustCompile(`(?i)^sending(?: sparse)? '([^']+)'(?: (\d+)/(\d+))? \((\d+) KB\)`)
+	fbWriteLine  = regexp.MustCompile(`(?i)^writing '([^']+)'`)
+	fbEraseLine  = regexp.MustCompile(`(?i)^erasing '([^']+)'`)
+	fbOkayLine   = regexp.MustCompile(`(?i)OKAY \[\s*([\d.]+)s\]\s*$`)
+	fbFinishLine = regexp.MustCompile(`(?i)^finished\. total time`)
+)
+
+// feed parses one line of fastboot output. fastboot may print "OKAY [..]"
+// on the same line as the action or on a line of its own.
+func (pt *progressTracker) feed(line string) {
+	line = strings.TrimSpace(line)
+	if strings.Contains(line, "FAILED") {
+		pt.fail()
+		return
+	}
+	switch {
+	case fbSendLine.MatchString(line):
+		m := fbSendLine.FindStringSubmatch(line)
+		chunk, chunks := 1, 1
+		if m[2] != "" {
+			chunk, _ = strconv.Atoi(m[2])
+			chunks, _ = strconv.Atoi(m[3])
+		}
+		kb, _ := strconv.ParseInt(m[4], 10, 64)
+		pt.startTransfer(m[1], chunk, chunks, kb*1024)
+		if took, ok := parseOkay(line); ok {
+			pt.transferDone(took)
+		}
+	case fbWriteLine.MatchString(line):
+		pt.startWrite(fbWriteLine.FindStringSubmatch(line)[1])
+		if _, ok := parseOkay(line); ok {
+			pt.writeDone()
+		}
+	case fbEraseLine.MatchString(line):
+		pt.startErase(fbEraseLine.FindStringSubmatch(line)[1])
+		if _, ok := parseOkay(line); ok {
+			pt.writeDone()
+		}
+	case fbFinishLine.MatchString(line):
+		pt.commandDone()
+	default:
+		if took, ok := parseOkay(line); ok {
+			pt.mu.Lock()
+			sending := pt.sending
+			pt.mu.Unlock()
+			if sending {
+				pt.transferDone(took)
+			} else {
+				pt.writeDone()
+			}
+		}
+	}
+}
+
+func parseOkay(line string) (time.Duration, bool) {
+	m := fbOkayLine.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	seconds, _ := strconv.ParseFloat(m[1], 64)
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// newFlashProgress resets the progress bar for a new flash and returns the
+// tracker that drives it
+func (t *FlashTool) newFlashProgress() *progressTracker {
+	fyne.Do(func() {
+		t.progressBar.SetValue(0)
+		t.progressLabel.SetText("Waiting for fastboot...")
+		t.progressBox.Show()
+	})
+	return newProgressTracker(func(p flashProgress) {
+		fyne.Do(func() {
+			t.progressBar.SetValue(p.Fraction())
+			t.progressLabel.SetText(p.String())
+		})
+	})
+}
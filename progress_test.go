@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestProgressFollowsAScript(t *testing.T) {
+	var last flashProgress
+	pt := newProgressTracker(func(p flashProgress) { last = p })
+	pt.setTotals(3, 3*1024*1024)
+
+	for _, line := range []string{
+		"Sending 'boot_a' (1024 KB)",
+		"OKAY [  1.000s]",
+		"Writing 'boot_a'                                   OKAY [  0.500s]",
+		"Finished. Total time: 1.600s",
+	} {
+		pt.feed(line)
+	}
+	// Every fastboot call of a script ends with this line
+	if last.Finished || last.Fraction() >= 1 {
+		t.Fatalf("after the first command: finished %v, fraction %.2f", last.Finished, last.Fraction())
+	}
+	if last.StepsDone != 1 || last.BytesSent != 1024*1024 {
+		t.Errorf("progress = %+v", last)
+	}
+
+	for _, line := range []string{
+		"Sending sparse 'super' 1/2 (1024 KB)             OKAY [  1.000s]",
+		"Writing 'super'                                    OKAY [  1.000s]",
+		"Sending sparse 'super' 2/2 (1024 KB)             OKAY [  1.000s]",
+		"Writing 'super'",
+	} {
+		pt.feed(line)
+	}
+	if last.Partition != "super" || last.Chunk != 2 || last.Phase != "writing" {
+		t.Errorf("progress = %+v", last)
+	}
+	pt.feed("OKAY [  1.000s]")
+	pt.feed("Finished. Total time: 4.000s")
+	if last.Finished || last.StepsDone != 2 {
+		t.Errorf("after super: %+v", last)
+	}
+
+	pt.finish()
+	if !last.Finished || last.Fraction() != 1 {
+		t.Errorf("after finish: %+v", last)
+	}
+}
+
+func TestProgressFailure(t *testing.T) {
+	var last flashProgress
+	pt := newProgressTracker(func(p flashProgress) { last = p })
+	pt.feed("Sending 'boot_a' (1024 KB)")
+	pt.feed("FAILED (remote: 'partition not found')")
+	if last.Phase != "failed" || last.Finished {
+		t.Errorf("progress = %+v", last)
+	}
+}
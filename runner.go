@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default timeouts for the different kinds of tool invocations
+const (
+	quickTimeout  = 15 * time.Second // getprop, getvar, devices, ...
+	rebootTimeout = 30 * time.Second // reboot commands
+	batchTimeout  = 0                // flashing scripts run until done
+)
+
+// Command describes one invocation of an external tool
+type Command struct {
+	Name    string        // "adb", "fastboot", "cmd"
+	Args    []string      // arguments passed to the tool
+	Timeout time.Duration // 0 means no timeout beyond the caller's context
+	Env     []string      // extra KEY=value pairs on top of our environment
+
+	// OnLine, when set, receives stdout/stderr line by line while the
+	// command runs. Calls are never concurrent.
+	OnLine func(OutputLine)
+}
+
+func (c Command) String() string {
+	return strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " "))
+}
+
+// CommandResult holds everything we captured from a finished command
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
+// Output returns stdout and stderr together, the way the tools print them
+func (r *CommandResult) Output() string {
+	if r == nil {
+		return ""
+	}
+	if r.Stderr == "" {
+		return r.Stdout
+	}
+	if r.Stdout == "" {
+		return r.Stderr
+	}
+	return strings.TrimRight(r.Stdout, "\n") + "\n" + r.Stderr
+}
+
+// CommandError is returned when a tool exits with a non-zero code
+type CommandError struct {
+	Command  Command
+	ExitCode int
+	Stderr   string
+}
+
+func (e *CommandError) Error() string {
+	msg := strings.TrimSpace(e.Stderr)
+	if msg == "" {
+		return fmt.Sprintf("%s: exit code %d", e.Command.Name, e.ExitCode)
+	}
+	return fmt.Sprintf("%s: exit code %d: %s", e.Command.Name, e.ExitCode, msg)
+}
+
+// CommandRunner runs adb/fastboot/cmd for every operation in the tool.
+// The returned result is never nil, even when err is set.
+type CommandRunner interface {
+	Run(ctx context.Context, c Command) (*CommandResult, error)
+}
+
+// execRunner runs commands as real processes
+type execRunner struct {
+	toolDir string // directory holding adb/fastboot, empty means PATH
+}
+
+func newExecRunner() *execRunner {
+	return &execRunner{toolDir: findToolDir()}
+}
+
+// findToolDir returns the configured platform-tools directory.
+// RSZ_TOOL_DIR wins, then a platform-tools folder next to the executable.
+func findToolDir() string {
+	if dir := os.Getenv("RSZ_TOOL_DIR"); dir != "" {
+		return dir
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Join(filepath.Dir(exe), "platform-tools")
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return dir
+	}
+	return ""
+}
+
+func (r *execRunner) Run(ctx context.Context, c Command) (*CommandResult, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	cmd := getCommand(ctx, r.toolDir, c.Name, c.Args...)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	stdout, stderr, exitCode, err := executeCommand(cmd, c.OnLine)
+	result := &CommandResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		ExitCode: exitCode,
+		Duration: time.Since(start),
+	}
+	return result, commandError(ctx, c, result, err)
+}
+
+// commandError turns a process error into the error reported to callers
+func commandError(ctx context.Context, c Command, result *CommandResult, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.DeadlineExceeded) && c.Timeout > 0 {
+			return fmt.Errorf("%s: timed out after %s: %w", c.Name, c.Timeout, ctxErr)
+		}
+		return fmt.Errorf("%s: %w", c.Name, ctxErr)
+	}
+	if result.ExitCode > 0 {
+		return &CommandError{Command: c, ExitCode: result.ExitCode, Stderr: result.Stderr}
+	}
+	return fmt.Errorf("%s: %w", c.Name, err)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeRunner is a scripted CommandRunner so every flow can be exercised
+// without a phone attached. Steps are matched in the order they were added.
+type FakeRunner struct {
+	mu    sync.Mutex
+	steps []*FakeStep
+	calls []Command
+}
+
+// FakeStep is one scripted answer of a FakeRunner
+type FakeStep struct {
+	name     string
+	args     []string
+	stdout   string
+	stderr   string
+	exitCode int
+	delay    time.Duration
+	times    int // 0 means unlimited
+	used     int
+}
+
+// On scripts the answer for a command. An argument "*" matches anything.
+func (f *FakeRunner) On(name string, args ...string) *FakeStep {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	step := &FakeStep{name: name, args: args}
+	f.steps = append(f.steps, step)
+	return step
+}
+
+// Calls returns every command the runner was asked to run
+func (f *FakeRunner) Calls() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.calls...)
+}
+
+func (s *FakeStep) Stdout(out string) *FakeStep     { s.stdout = out; return s }
+func (s *FakeStep) Stderr(out string) *FakeStep     { s.stderr = out; return s }
+func (s *FakeStep) Exit(code int) *FakeStep         { s.exitCode = code; return s }
+func (s *FakeStep) Delay(d time.Duration) *FakeStep { s.delay = d; return s }
+func (s *FakeStep) Times(n int) *FakeStep           { s.times = n; return s }
+
+func (s *FakeStep) matches(c Command) bool {
+	if s.name != c.Name || len(s.args) != len(c.Args) {
+		return false
+	}
+	if s.times > 0 && s.used >= s.times {
+		return false
+	}
+	for i, arg := range s.args {
+		if arg != "*" && arg != c.Args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeRunner) Run(ctx context.Context, c Command) (*CommandResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	var step *FakeStep
+	for _, s := range f.steps {
+		if s.matches(c) {
+			step = s
+			step.used++
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if step == nil {
+		result := &CommandResult{Stderr: fmt.Sprintf("fake: unexpected command %q", c.String()), ExitCode: 1}
+		return result, &CommandError{Command: c, ExitCode: 1, Stderr: result.Stderr}
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	result := &CommandResult{ExitCode: -1}
+	if step.delay > 0 {
+		select {
+		case <-time.After(step.delay):
+		case <-ctx.Done():
+			result.Duration = time.Since(start)
+			return result, commandError(ctx, c, result, ctx.Err())
+		}
+	}
+
+	if c.OnLine != nil {
+		emitLines(c.OnLine, step.stdout, step.stderr)
+	}
+	result.Stdout = step.stdout
+	result.Stderr = step.stderr
+	result.ExitCode = step.exitCode
+	result.Duration = time.Since(start)
+	if step.exitCode != 0 {
+		return result, &CommandError{Command: c, ExitCode: step.exitCode, Stderr: step.stderr}
+	}
+	return result, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is not a test: the runner tests start the test binary
+// itself as the external tool, with RSZ_HELPER telling it what to do.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("RSZ_HELPER") {
+	case "":
+		return
+	case "print":
+		fmt.Println("first line")
+		fmt.Fprintln(os.Stderr, "Sending 'boot' (100 KB)")
+		fmt.Println("second line")
+		os.Exit(0)
+	case "fail":
+		fmt.Fprintln(os.Stderr, "FAILED (remote: 'no')")
+		os.Exit(3)
+	case "sleep":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+// helperCommand runs the test binary through an execRunner, the way adb
+// and fastboot are run from platform-tools
+func helperCommand(t *testing.T, mode string) (*execRunner, Command) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("no test executable:", err)
+	}
+	runner := &execRunner{toolDir: filepath.Dir(exe)}
+	return runner, Command{
+		Name: filepath.Base(exe),
+		Args: []string{"-test.run=^TestHelperProcess$"},
+		Env:  []string{"RSZ_HELPER=" + mode},
+	}
+}
+
+func TestGetCommandPrefersToolDir(t *testing.T) {
+	dir := t.TempDir()
+	name := "adb"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	tool := filepath.Join(dir, name)
+	if err := os.WriteFile(tool, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := getCommand(context.Background(), dir, "adb", "devices")
+	if cmd.Path != tool {
+		t.Errorf("path = %q, want %q", cmd.Path, tool)
+	}
+	if got := strings.Join(cmd.Args[1:], " "); got != "devices" {
+		t.Errorf("args = %q", got)
+	}
+
+	// A tool missing from the folder is looked up on PATH
+	cmd = getCommand(context.Background(), dir, "fastboot")
+	if strings.HasPrefix(cmd.Path, dir) {
+		t.Errorf("path = %q, fastboot is not in %s", cmd.Path, dir)
+	}
+}
+
+func TestExecRunnerOutput(t *testing.T) {
+	runner, c := helperCommand(t, "print")
+	var lines []string
+	c.OnLine = func(line OutputLine) { lines = append(lines, line.Stream+": "+line.Text) }
+	result, err := runner.Run(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 || result.Stdout != "first line\nsecond line\n" {
+		t.Errorf("result = %+v", result)
+	}
+	want := []string{"stdout: first line", "stderr: Sending 'boot' (100 KB)", "stdout: second line"}
+	if len(lines) != len(want) {
+		t.Fatalf("lines = %q, want %q", lines, want)
+	}
+	for _, line := range want {
+		if !strings.Contains(strings.Join(lines, "\n"), line) {
+			t.Errorf("lines = %q, missing %q", lines, line)
+		}
+	}
+}
+
+func TestExecRunnerExitCode(t *testing.T) {
+	runner, c := helperCommand(t, "fail")
+	result, err := runner.Run(context.Background(), c)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("err = %v, want a CommandError", err)
+	}
+	if cmdErr.ExitCode != 3 || result.ExitCode != 3 || !strings.Contains(cmdErr.Error(), "remote: 'no'") {
+		t.Errorf("err = %v, result = %+v", err, result)
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	runner, c := helperCommand(t, "sleep")
+	c.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	_, err := runner.Run(context.Background(), c)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out after") {
+		t.Errorf("err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("took %s to stop", elapsed)
+	}
+}
+
+func TestExecRunnerCancel(t *testing.T) {
+	runner, c := helperCommand(t, "sleep")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := runner.Run(ctx, c)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("took %s to stop", elapsed)
+	}
+}
+
+func TestFakeRunnerMatching(t *testing.T) {
+	f := &FakeRunner{}
+	f.On("adb", "-s", "*", "reboot").Stdout("rebooting\n").Times(1)
+	f.On("adb", "-s", "*", "reboot").Stderr("error: device offline\n").Exit(1)
+	ctx := context.Background()
+
+	result, err := f.Run(ctx, Command{Name: "adb", Args: []string{"-s", "ABC", "reboot"}})
+	if err != nil || result.Stdout != "rebooting\n" {
+		t.Fatalf("first call: %v %+v", err, result)
+	}
+	// Times(1) is used up, the next step answers
+	_, err = f.Run(ctx, Command{Name: "adb", Args: []string{"-s", "ABC", "reboot"}})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 1 {
+		t.Fatalf("second call: %v", err)
+	}
+	_, err = f.Run(ctx, Command{Name: "fastboot", Args: []string{"devices"}})
+	if err == nil || !strings.Contains(err.Error(), "unexpected command") {
+		t.Errorf("unscripted call: %v", err)
+	}
+	if calls := f.Calls(); len(calls) != 3 || calls[2].String() != "fastboot devices" {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestFakeRunnerLinesAndCancel(t *testing.T) {
+	f := &FakeRunner{}
+	f.On("fastboot", "getvar", "product").Stderr("product: lavender\nFinished. Total time: 0.001s\n")
+	f.On("fastboot", "flash", "*", "*").Delay(time.Minute)
+
+	var lines []string
+	_, err := f.Run(context.Background(), Command{
+		Name:   "fastboot",
+		Args:   []string{"getvar", "product"},
+		OnLine: func(line OutputLine) { lines = append(lines, line.Text) },
+	})
+	if err != nil || strings.Join(lines, "|") != "product: lavender|Finished. Total time: 0.001s" {
+		t.Errorf("err = %v, lines = %q", err, lines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = f.Run(ctx, Command{Name: "fastboot", Args: []string{"flash", "boot", "boot.img"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled call: %v", err)
+	}
+	_, err = f.Run(context.Background(), Command{Name: "fastboot", Args: []string{"flash", "boot", "boot.img"}, Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timed out call: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// SPAKE2 over edwards25519, compatible with BoringSSL's SPAKE2_* functions
+// that adbd uses for pairing. Only a handful of scalar multiplications
+// happen per pairing, so plain math/big arithmetic is fast enough.
+
+var (
+	edP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	edL = func() *big.Int {
+		l, _ := new(big.Int).SetString("27742317777372353535851937790883648493", 10)
+		return l.Add(l, new(big.Int).Lsh(big.NewInt(1), 252))
+	}()
+	// d = -121665/121666
+	edD = func() *big.Int {
+		d := new(big.Int).ModInverse(big.NewInt(121666), edP)
+		d.Mul(d, big.NewInt(-121665))
+		return d.Mod(d, edP)
+	}()
+	// sqrt(-1) = 2^((p-1)/4)
+	edSqrtM1 = new(big.Int).Exp(big.NewInt(2), new(big.Int).Rsh(new(big.Int).Sub(edP, big.NewInt(1)), 2), edP)
+
+	edBase = func() edPoint {
+		// y = 4/5 with even x
+		y := new(big.Int).ModInverse(big.NewInt(5), edP)
+		y.Mul(y, big.NewInt(4)).Mod(y, edP)
+		var enc [32]byte
+		putLittleEndian(enc[:], y)
+		p, _ := edDecode(enc[:])
+		return p
+	}()
+
+	// Fixed points of the protocol, found by hashing these seeds
+	spakeM = spakePoint("edwards25519 point generation seed (M)")
+	spakeN = spakePoint("edwards25519 point generation seed (N)")
+)
+
+var errBadPoint = errors.New("spake2: invalid point")
+
+// edPoint is a point on edwards25519 in affine coordinates
+type edPoint struct {
+	x, y *big.Int
+}
+
+func edIdentity() edPoint {
+	return edPoint{big.NewInt(0), big.NewInt(1)}
+}
+
+// edAdd uses the complete addition law for a = -1:
+// x3 = (x1y2 + y1x2) / (1 + d x1x2y1y2), y3 = (y1y2 + x1x2) / (1 - d x1x2y1y2)
+func edAdd(a, b edPoint) edPoint {
+	x1y2 := new(big.Int).Mul(a.x, b.y)
+	y1x2 := new(big.Int).Mul(a.y, b.x)
+	y1y2 := new(big.Int).Mul(a.y, b.y)
+	x1x2 := new(big.Int).Mul(a.x, b.x)
+	t := new(big.Int).Mul(x1x2, y1y2)
+	t.Mul(t, edD).Mod(t, edP)
+
+	xDen := new(big.Int).Add(big.NewInt(1), t)
+	xDen.ModInverse(xDen.Mod(xDen, edP), edP)
+	yDen := new(big.Int).Sub(big.NewInt(1), t)
+	yDen.ModInverse(yDen.Mod(yDen, edP), edP)
+
+	x := x1y2.Add(x1y2, y1x2)
+	x.Mul(x, xDen).Mod(x, edP)
+	y := y1y2.Add(y1y2, x1x2)
+	y.Mul(y, yDen).Mod(y, edP)
+	return edPoint{x, y}
+}
+
+func edNeg(a edPoint) edPoint {
+	x := new(big.Int).Sub(edP, a.x)
+	return edPoint{x.Mod(x, edP), new(big.Int).Set(a.y)}
+}
+
+// edMul multiplies by the full scalar k, without reducing it mod l, so
+// small-order components behave exactly as in BoringSSL
+func edMul(k *big.Int, a edPoint) edPoint {
+	r := edIdentity()
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = edAdd(r, r)
+		if k.Bit(i) == 1 {
+			r = edAdd(r, a)
+		}
+	}
+	return r
+}
+
+// edEncode is the usual 32-byte form: y little-endian, sign of x on top
+func edEncode(a edPoint) []byte {
+	enc := make([]byte, 32)
+	putLittleEndian(enc, a.y)
+	enc[31] |= byte(a.x.Bit(0)) << 7
+	return enc
+}
+
+// edDecode recovers x from y and the sign bit, failing when y is not on
+// the curve
+func edDecode(enc []byte) (edPoint, error) {
+	if len(enc) != 32 {
+		return edPoint{}, errBadPoint
+	}
+	b := append([]byte(nil), enc...)
+	sign := uint(b[31] >> 7)
+	b[31] &= 0x7f
+	y := littleEndianInt(b)
+	y.Mod(y, edP)
+
+	// x^2 = (y^2 - 1) / (d y^2 + 1)
+	yy := new(big.Int).Mul(y, y)
+	u := new(big.Int).Sub(yy, big.NewInt(1))
+	v := new(big.Int).Mul(edD, yy)
+	v.Add(v, big.NewInt(1)).Mod(v, edP)
+	xx := new(big.Int).ModInverse(v, edP)
+	xx.Mul(xx, u).Mod(xx, edP)
+
+	exp := new(big.Int).Add(edP, big.NewInt(3))
+	x := new(big.Int).Exp(xx, exp.Rsh(exp, 3), edP)
+	if new(big.Int).Mod(new(big.Int).Mul(x, x), edP).Cmp(xx) != 0 {
+		x.Mul(x, edSqrtM1).Mod(x, edP)
+		if new(big.Int).Mod(new(big.Int).Mul(x, x), edP).Cmp(xx) != 0 {
+			return edPoint{}, errBadPoint
+		}
+	}
+	if x.Bit(0) != sign {
+		x.Sub(edP, x).Mod(x, edP)
+	}
+	return edPoint{x, y}, nil
+}
+
+// spakePoint hashes seed with SHA-256 until the digest decodes as a point
+func spakePoint(seed string) edPoint {
+	v := sha256.Sum256([]byte(seed))
+	for {
+		if p, err := edDecode(v[:]); err == nil {
+			return p
+		}
+		v = sha256.Sum256(v[:])
+	}
+}
+
+func littleEndianInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// SPAKE2 roles: the pairing client is Alice, adbd is Bob
+const (
+	spakeAlice = iota
+	spakeBob
+)
+
+// spake2 is one side of a SPAKE2 exchange
+type spake2 struct {
+	role         int
+	myName       []byte
+	theirName    []byte
+	privateKey   *big.Int
+	passwordHash [64]byte
+	passwordK    *big.Int
+	myMsg        []byte
+}
+
+func newSPAKE2(role int, myName, theirName []byte) *spake2 {
+	return &spake2{role: role, myName: myName, theirName: theirName}
+}
+
+// generateMsg picks our secret and returns the masked point to send
+func (s *spake2) generateMsg(password []byte) ([]byte, error) {
+	var random [64]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	// Reduce mod l and multiply by the cofactor, so the small-order part
+	// of the peer's point drops out later
+	s.privateKey = littleEndianInt(random[:])
+	s.privateKey.Mod(s.privateKey, edL).Lsh(s.privateKey, 3)
+	p := edMul(s.privateKey, edBase)
+
+	s.passwordHash = sha512.Sum512(password)
+	k := littleEndianInt(s.passwordHash[:])
+	k.Mod(k, edL)
+	// Add l, 2l and 4l as needed to make the scalar a multiple of eight,
+	// like BoringSSL does
+	for i, multiple := 0, new(big.Int).Set(edL); i < 3; i++ {
+		if k.Bit(i) == 1 {
+			k.Add(k, multiple)
+		}
+		multiple = new(big.Int).Lsh(multiple, 1)
+	}
+	s.passwordK = k
+
+	mask := spakeM
+	if s.role == spakeBob {
+		mask = spakeN
+	}
+	s.myMsg = edEncode(edAdd(p, edMul(k, mask)))
+	return s.myMsg, nil
+}
+
+// processMsg unmasks the peer's point and derives the 64-byte shared key
+func (s *spake2) processMsg(theirMsg []byte) ([]byte, error) {
+	q, err := edDecode(theirMsg)
+	if err != nil {
+		return nil, err
+	}
+	mask := spakeN
+	if s.role == spakeBob {
+		mask = spakeM
+	}
+	q = edAdd(q, edNeg(edMul(s.passwordK, mask)))
+	shared := edEncode(edMul(s.privateKey, q))
+
+	h := sha512.New()
+	write := func(b []byte) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	if s.role == spakeAlice {
+		write(s.myName)
+		write(s.theirName)
+		write(s.myMsg)
+		write(theirMsg)
+	} else {
+		write(s.theirName)
+		write(s.myName)
+		write(theirMsg)
+		write(s.myMsg)
+	}
+	write(shared)
+	write(s.passwordHash[:])
+	return h.Sum(nil), nil
+}
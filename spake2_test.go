@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEdwards25519(t *testing.T) {
+	if got := hex.EncodeToString(edEncode(edBase)); got != "5866666666666666666666666666666666666666666666666666666666666666" {
+		t.Errorf("base point = %s", got)
+	}
+	if p := edMul(edL, edBase); !bytes.Equal(edEncode(p), edEncode(edIdentity())) {
+		t.Error("l * B is not the identity")
+	}
+	// Our scalar multiplication makes the same public keys as ed25519
+	for _, seed := range []string{"pairing seed one................", "pairing seed two................"} {
+		h := sha512.Sum512([]byte(seed))
+		h[0] &= 248
+		h[31] &= 127
+		h[31] |= 64
+		public := ed25519.NewKeyFromSeed([]byte(seed)).Public().(ed25519.PublicKey)
+		if got := edEncode(edMul(littleEndianInt(h[:32]), edBase)); !bytes.Equal(got, public) {
+			t.Errorf("%q: %x, ed25519 says %x", seed, got, public)
+		}
+	}
+	// No point has y = 2
+	offCurve := make([]byte, 32)
+	offCurve[0] = 2
+	if _, err := edDecode(offCurve); err == nil {
+		t.Error("a point off the curve was decoded")
+	}
+	if p, err := edDecode(edEncode(spakeM)); err != nil || !bytes.Equal(edEncode(p), edEncode(spakeM)) {
+		t.Errorf("M does not decode back: %v", err)
+	}
+}
+
+func TestSPAKE2(t *testing.T) {
+	exchange := func(alicePassword, bobPassword string) ([]byte, []byte) {
+		t.Helper()
+		alice := newSPAKE2(spakeAlice, pairingClientName, pairingServerName)
+		bob := newSPAKE2(spakeBob, pairingServerName, pairingClientName)
+		aliceMsg, err := alice.generateMsg([]byte(alicePassword))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobMsg, err := bob.generateMsg([]byte(bobPassword))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aliceKey, err := alice.processMsg(bobMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobKey, err := bob.processMsg(aliceMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aliceKey, bobKey
+	}
+
+	aliceKey, bobKey := exchange("123456", "123456")
+	if len(aliceKey) != 64 || !bytes.Equal(aliceKey, bobKey) {
+		t.Errorf("keys differ:\n%x\n%x", aliceKey, bobKey)
+	}
+	again, _ := exchange("123456", "123456")
+	if bytes.Equal(again, aliceKey) {
+		t.Error("two exchanges derived the same key")
+	}
+	aliceKey, bobKey = exchange("123456", "654321")
+	if bytes.Equal(aliceKey, bobKey) {
+		t.Error("different passwords derived the same key")
+	}
+
+	alice := newSPAKE2(spakeAlice, pairingClientName, pairingServerName)
+	alice.generateMsg([]byte("123456"))
+	if _, err := alice.processMsg(make([]byte, 31)); err == nil {
+		t.Error("a short message was accepted")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Images bigger than the device's download buffer are sent the way the
+// fastboot binary sends them: cut into sparse images that each fit the
+// buffer and cover the whole partition, every one writing its own blocks
+// and skipping the rest with "don't care" chunks.
+
+// sparseMagic starts every Android sparse image
+const sparseMagic = 0xed26ff3a
+
+// Sparse format sizes and chunk types
+const (
+	sparseHeaderSize      = 28
+	sparseChunkHeaderSize = 12
+	sparseBlockSize       = 4096 // used when a raw image is wrapped
+
+	sparseRaw      = 0xcac1
+	sparseFill     = 0xcac2
+	sparseDontCare = 0xcac3
+	sparseCRC32    = 0xcac4
+)
+
+// sparseChunk is a run of blocks with data: raw bytes from the image
+// file or a repeated 4-byte fill value
+type sparseChunk struct {
+	kind   uint16
+	start  uint32 // first block
+	blocks uint32
+	offset int64 // raw data position in the file
+	length int64 // raw data bytes in the file, the rest is zero padding
+	fill   [4]byte
+}
+
+// dataSize is how many bytes follow the chunk's header
+func (c sparseChunk) dataSize(blockSize uint32) int64 {
+	if c.kind == sparseFill {
+		return 4
+	}
+	return int64(c.blocks) * int64(blockSize)
+}
+
+// sparseImage is the block layout of an image file, sparse or raw
+type sparseImage struct {
+	file      *os.File
+	blockSize uint32
+	blocks    uint32
+	chunks    []sparseChunk // don't care runs are left out
+}
+
+// readSparseImage reads the chunk layout of a sparse image, or describes
+// a raw image as one raw chunk
+func readSparseImage(f *os.File) (*sparseImage, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(f.Name())
+	header := make([]byte, sparseHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || binary.LittleEndian.Uint32(header) != sparseMagic {
+		blocks := (info.Size() + sparseBlockSize - 1) / sparseBlockSize
+		if blocks > int64(^uint32(0)) {
+			return nil, fmt.Errorf("%s: too big for a sparse image", name)
+		}
+		image := &sparseImage{file: f, blockSize: sparseBlockSize, blocks: uint32(blocks)}
+		if blocks > 0 {
+			image.chunks = []sparseChunk{{kind: sparseRaw, blocks: uint32(blocks), length: info.Size()}}
+		}
+		return image, nil
+	}
+
+	fileHeaderSize := int64(binary.LittleEndian.Uint16(header[8:]))
+	chunkHeaderSize := int64(binary.LittleEndian.Uint16(header[10:]))
+	image := &sparseImage{
+		file:      f,
+		blockSize: binary.LittleEndian.Uint32(header[12:]),
+		blocks:    binary.LittleEndian.Uint32(header[16:]),
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != 1 || fileHeaderSize < sparseHeaderSize ||
+		chunkHeaderSize < sparseChunkHeaderSize || image.blockSize == 0 || image.blockSize%4 != 0 {
+		return nil, fmt.Errorf("%s: unsupported sparse image", name)
+	}
+	count := binary.LittleEndian.Uint32(header[20:])
+	offset := fileHeaderSize
+	block := uint32(0)
+	chunkHeader := make([]byte, sparseChunkHeaderSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := f.ReadAt(chunkHeader, offset); err != nil {
+			return nil, fmt.Errorf("%s: chunk %d: %w", name, i, err)
+		}
+		chunk := sparseChunk{
+			kind:   binary.LittleEndian.Uint16(chunkHeader),
+			start:  block,
+			blocks: binary.LittleEndian.Uint32(chunkHeader[4:]),
+			offset: offset + chunkHeaderSize,
+		}
+		total := int64(binary.LittleEndian.Uint32(chunkHeader[8:]))
+		data := total - chunkHeaderSize
+		switch chunk.kind {
+		case sparseRaw:
+			chunk.length = data
+			if data != chunk.dataSize(image.blockSize) {
+				return nil, fmt.Errorf("%s: chunk %d: raw size %d for %d blocks", name, i, data, chunk.blocks)
+			}
+		case sparseFill:
+			if data != 4 {
+				return nil, fmt.Errorf("%s: chunk %d: fill size %d", name, i, data)
+			}
+			if _, err := f.ReadAt(chunk.fill[:], chunk.offset); err != nil {
+				return nil, fmt.Errorf("%s: chunk %d: %w", name, i, err)
+			}
+		case sparseDontCare, sparseCRC32:
+		default:
+			return nil, fmt.Errorf("%s: chunk %d: unknown type %#x", name, i, chunk.kind)
+		}
+		if data < 0 || offset+total > info.Size() || uint64(block)+uint64(chunk.blocks) > uint64(image.blocks) {
+			return nil, fmt.Errorf("%s: chunk %d is out of bounds", name, i)
+		}
+		if (chunk.kind == sparseRaw || chunk.kind == sparseFill) && chunk.blocks > 0 {
+			image.chunks = append(image.chunks, chunk)
+		}
+		offset += total
+		block += chunk.blocks
+	}
+	return image, nil
+}
+
+// sparsePiece is one download: a sparse image of the whole partition
+// holding some of the chunks
+type sparsePiece struct {
+	image  *sparseImage
+	chunks []sparseChunk
+}
+
+// split cuts the image into pieces no bigger than limit bytes. Raw chunks
+// are cut on block boundaries when they do not fit.
+func (s *sparseImage) split(limit int64) ([]*sparsePiece, error) {
+	blockSize := int64(s.blockSize)
+	chunks := append([]sparseChunk(nil), s.chunks...)
+	pieces := []*sparsePiece{{image: s}}
+	// The header and a trailing don't care chunk always go in
+	size := int64(sparseHeaderSize + sparseChunkHeaderSize)
+	next := uint32(0)
+	for i := 0; i < len(chunks); {
+		piece, chunk := pieces[len(pieces)-1], chunks[i]
+		overhead := int64(sparseChunkHeaderSize)
+		if chunk.start > next {
+			overhead += sparseChunkHeaderSize // don't care run before it
+		}
+		if size+overhead+chunk.dataSize(s.blockSize) <= limit {
+			piece.chunks = append(piece.chunks, chunk)
+			size += overhead + chunk.dataSize(s.blockSize)
+			next = chunk.start + chunk.blocks
+			i++
+			continue
+		}
+		if fit := (limit - size - overhead) / blockSize; chunk.kind == sparseRaw && fit > 0 {
+			// Send as many of its blocks as still fit
+			head := chunk
+			head.blocks = uint32(fit)
+			head.length = min(chunk.length, fit*blockSize)
+			piece.chunks = append(piece.chunks, head)
+			chunk.start += head.blocks
+			chunk.blocks -= head.blocks
+			chunk.offset += head.length
+			chunk.length -= head.length
+			chunks[i] = chunk
+		} else if len(piece.chunks) == 0 {
+			return nil, fmt.Errorf("max-download-size %s is too small for a sparse image", formatBytes(limit))
+		}
+		pieces = append(pieces, &sparsePiece{image: s})
+		size = sparseHeaderSize + sparseChunkHeaderSize
+		next = 0
+	}
+	return pieces, nil
+}
+
+// reader returns the piece as a sparse image and its size
+func (p *sparsePiece) reader() (io.Reader, int64) {
+	s := p.image
+	var parts []io.Reader
+	var size int64
+	var count uint32
+	add := func(r io.Reader, n int64) {
+		parts = append(parts, r)
+		size += n
+	}
+	chunkHeader := func(kind uint16, blocks uint32, data int64) {
+		header := make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(header, kind)
+		binary.LittleEndian.PutUint32(header[4:], blocks)
+		binary.LittleEndian.PutUint32(header[8:], uint32(sparseChunkHeaderSize+data))
+		add(bytes.NewReader(header), sparseChunkHeaderSize)
+		count++
+	}
+	header := make([]byte, sparseHeaderSize)
+	add(bytes.NewReader(header), sparseHeaderSize)
+
+	next := uint32(0)
+	for _, chunk := range p.chunks {
+		if chunk.start > next {
+			chunkHeader(sparseDontCare, chunk.start-next, 0)
+		}
+		data := chunk.dataSize(s.blockSize)
+		chunkHeader(chunk.kind, chunk.blocks, data)
+		if chunk.kind == sparseFill {
+			add(bytes.NewReader(chunk.fill[:]), 4)
+		} else {
+			add(io.NewSectionReader(s.file, chunk.offset, chunk.length), chunk.length)
+			// A raw image's last block is padded with zeros
+			add(io.LimitReader(zeroReader{}, data-chunk.length), data-chunk.length)
+		}
+		next = chunk.start + chunk.blocks
+	}
+	if s.blocks > next {
+		chunkHeader(sparseDontCare, s.blocks-next, 0)
+	}
+
+	binary.LittleEndian.PutUint32(header, sparseMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1)
+	binary.LittleEndian.PutUint16(header[8:], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], s.blockSize)
+	binary.LittleEndian.PutUint32(header[16:], s.blocks)
+	binary.LittleEndian.PutUint32(header[20:], count)
+	return io.MultiReader(parts...), size
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output stream names used to tag streamed lines
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamScript = "script" // status of a flash script we run ourselves
+)
+
+// OutputLine is one line printed by a running command
+type OutputLine struct {
+	Time   time.Time
+	Stream string
+	Text   string
+}
+
+func (l OutputLine) String() string {
+	return "[" + l.Time.Format("15:04:05") + "] [" + l.Stream + "] " + l.Text
+}
+
+// lineWriter splits whatever a process writes into lines and hands them
+// to onLine as soon as they are complete. fastboot ends progress lines
+// with '\r' on some builds, so that counts as a line break too.
+//
+// fastboot prints "Sending 'super' (786428 KB)" padded with spaces, then
+// adds "OKAY [ 20.1s]" to the same line when the transfer is done. Such a
+// pending line is emitted right away so the log shows what is happening.
+// Anything else stays buffered until its line ends, wherever the reads of
+// the pipe happen to stop.
+type lineWriter struct {
+	mu     *sync.Mutex // shared by the stdout and stderr writers
+	stream string
+	onLine func(OutputLine)
+	buf    []byte
+}
+
+// fastboot status lines still waiting for their OKAY, padding included
+var fbPendingLine = regexp.MustCompile(`^(Sending(?: sparse)? '[^']+'(?: \d+/\d+)? \(\d+ KB\)|(?:Writing|Erasing) '[^']+') +$`)
+
+func newLineWriters(onLine func(OutputLine)) (*lineWriter, *lineWriter) {
+	mu := &sync.Mutex{}
+	return &lineWriter{mu: mu, stream: streamStdout, onLine: onLine},
+		&lineWriter{mu: mu, stream: streamStderr, onLine: onLine}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	if fbPendingLine.Match(w.buf) {
+		w.emit(string(w.buf))
+		w.buf = w.buf[:0]
+	}
+	return len(p), nil
+}
+
+// flush emits a trailing line that did not end with a newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(text string) {
+	text = strings.TrimRight(text, " \t")
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onLine(OutputLine{Time: time.Now(), Stream: w.stream, Text: text})
+}
+
+// emitLines feeds already captured output through onLine, used by runners
+// that do not have a live process
+func emitLines(onLine func(OutputLine), stdout, stderr string) {
+	outWriter, errWriter := newLineWriters(onLine)
+	outWriter.Write([]byte(stdout))
+	outWriter.flush()
+	errWriter.Write([]byte(stderr))
+	errWriter.flush()
+}
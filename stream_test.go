@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineWriterSplitsReads(t *testing.T) {
+	var lines []string
+	w, _ := newLineWriters(func(line OutputLine) { lines = append(lines, line.Text) })
+	for _, chunk := range []string{
+		"Sending 'boot_a' (65536 KB)", "                ",
+		"OKAY [  1.500s]\nWriting 'boot_a'   ", "          OKAY [  0.300s]\n",
+		"Finished.", " Total time: 2.000s\n",
+		"product: laven", "der\r\n",
+		"no newline at the end. ",
+	} {
+		w.Write([]byte(chunk))
+	}
+	w.flush()
+
+	want := []string{
+		"Sending 'boot_a' (65536 KB)",
+		"OKAY [  1.500s]",
+		"Writing 'boot_a'",
+		"          OKAY [  0.300s]",
+		"Finished. Total time: 2.000s",
+		"product: lavender",
+		"no newline at the end.",
+	}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
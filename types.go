@@ -1,9 +1,14 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "image/color"
     "path/filepath"
+    "strconv"
+    "time"
     "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/canvas"
     "fyne.io/fyne/v2/container"
     "fyne.io/fyne/v2/dialog"
     "fyne.io/fyne/v2/widget"
@@ -13,6 +18,43 @@ type FlashTool struct {
     window    fyne.Window
     logOutput *widget.Entry
     filePath  string
+    runner    CommandRunner
+    adbServer *adbClient
+    adbKeys   *adbKeyStore // host key pair shared with the adb server
+
+    // Queued and running jobs, and the widgets that show them
+    jobs        *jobManager
+    jobStatuses []jobStatus
+    jobList     *widget.List
+    stopButton  *widget.Button
+
+    // Flash progress shown above the log
+    progressBox   *fyne.Container
+    progressBar   *widget.ProgressBar
+    progressLabel *widget.Label
+
+    // Wait for the device to come back after reboot commands
+    waitOptions waitSettings
+
+    // Live device list and the buttons that need a device
+    watcher         *deviceWatcher
+    deviceStatus    *widget.Label
+    adbButtons      []*widget.Button
+    fastbootButtons []*widget.Button
+
+    // Fastboot device reached over the network instead of USB
+    fastbootNet     networkTarget
+    connectIPButton *widget.Button
+
+    // adbd connections made without the adb server
+    direct directDevices
+
+    // Device every operation goes to when several are connected
+    target       selectedTarget
+    targetSelect *widget.Select
+
+    // Every phone seen since start, whatever mode it was in
+    devices deviceRegistry
 }
 
 func (t *FlashTool) createUI() {
@@ -37,6 +79,16 @@ func (t *FlashTool) createUI() {
 `)
     t.logOutput.Wrapping = fyne.TextWrapWord
 
+    // Jobs run one after another per device
+    t.jobs = newJobManager(t.appendLog, t.refreshJobs)
+    jobPanel := t.createJobPanel()
+
+    // Flash progress, hidden until something is flashed
+    t.progressBar = widget.NewProgressBar()
+    t.progressLabel = widget.NewLabel("")
+    t.progressBox = container.NewVBox(t.progressLabel, t.progressBar)
+    t.progressBox.Hide()
+
 	// Create Android Tool tab content
 	androidToolTab := t.createAndroidToolTab()
 
@@ -58,9 +110,14 @@ func (t *FlashTool) createUI() {
 
     // Bottom buttons
     clearButton := widget.NewButton("Clear Log", func() {
-        t.logOutput.SetText("")
+        t.clearLog()
     })
 
+    t.stopButton = widget.NewButton("Stop", func() {
+        t.jobs.stopAll()
+    })
+    t.stopButton.Disable()
+
     exitButton := widget.NewButton("Exit", func() {
         t.window.Close()
     })
@@ -71,13 +128,47 @@ func (t *FlashTool) createUI() {
 	icon, _ := fyne.LoadResourceFromPath("./rsz_icon.png")
 	t.window.SetIcon(icon)
 
+	// Wait for device after reboot commands
+	waitTimeout := widget.NewEntry()
+	waitTimeout.SetText("90")
+	waitCheck := widget.NewCheck("Wait for device", nil)
+	updateWait := func() {
+		seconds, err := strconv.Atoi(waitTimeout.Text)
+		if err != nil || seconds <= 0 {
+			seconds = 90
+		}
+		t.waitOptions.set(waitCheck.Checked, time.Duration(seconds)*time.Second)
+	}
+	waitCheck.OnChanged = func(bool) { updateWait() }
+	waitTimeout.OnChanged = func(string) { updateWait() }
+	updateWait()
+
+	// Connected devices, kept current by the device watcher
+	t.deviceStatus = widget.NewLabel("📵 No device")
+	t.targetSelect = widget.NewSelect([]string{targetAuto}, nil)
+	t.targetSelect.SetSelected(targetAuto)
+	t.targetSelect.OnChanged = func(choice string) {
+		if choice == targetAuto {
+			choice = ""
+		}
+		t.selectTarget(choice)
+	}
+
 	//text with link right side
 	bottomText := widget.NewLabel("MT MART - reTza")
 		
 	// button declared 
 	bottomButtons := container.NewHBox(
 		clearButton,
+		t.stopButton,
 		exitButton,
+		waitCheck,
+		widget.NewLabel("Timeout (s)"),
+		container.NewGridWrap(fyne.NewSize(60, waitTimeout.MinSize().Height), waitTimeout),
+		widget.NewLabel("Target"),
+		t.targetSelect,
+		widget.NewButton("Phone", t.showPhoneInfo),
+		t.deviceStatus,
 		bottomText,
 		
 	)
@@ -87,8 +178,8 @@ func (t *FlashTool) createUI() {
         tabs,
         bottomButtons,
         nil,
-        nil,
-        t.logOutput,
+        jobPanel,
+        container.NewBorder(t.progressBox, nil, nil, nil, t.logOutput),
     )
     
     t.window.SetContent(content)
@@ -97,15 +188,19 @@ func (t *FlashTool) createUI() {
 func (t *FlashTool) createAndroidToolTab() fyne.CanvasObject {
 	// Android Tool buttons
 	backupButton := widget.NewButton("Backup", func() {
-		t.logOutput.SetText("")
-		go t.androidBackup()
+		t.chooseFolder(func(dir string) {
+			t.run(jobRead, "Backup", func(ctx context.Context) { t.androidBackup(ctx, dir) })
+		})
 	})
 
 	restoreButton := widget.NewButton("Restore", func() {
-		t.logOutput.SetText("")
-		go t.androidRestore()
+		t.chooseFolder(func(dir string) {
+			t.run(jobControl, "Restore", func(ctx context.Context) { t.androidRestore(ctx, dir) })
+		})
 	})
 
+	t.adbButtons = append(t.adbButtons, backupButton, restoreButton)
+
 	// Create grid layout for Android Tool buttons
 	return container.NewGridWithColumns(2,
 		backupButton,
@@ -113,42 +208,75 @@ func (t *FlashTool) createAndroidToolTab() fyne.CanvasObject {
 	)
 }
 
+// chooseFolder asks for a local folder and passes its path to fn
+func (t *FlashTool) chooseFolder(fn func(dir string)) {
+	dialog.ShowFolderOpen(func(uri fyne.ListableURI, err error) {
+		if err != nil {
+			dialog.ShowError(err, t.window)
+			return
+		}
+		if uri == nil {
+			return
+		}
+		fn(uri.Path())
+	}, t.window)
+}
+
 // adb buttons and functionality
 func (t *FlashTool) createADBTab() fyne.CanvasObject {
     // ADB buttons
     deviceButton := widget.NewButton("Check Device", func() {
-        t.logOutput.SetText("")
-        go t.checkADBDevice()
+        t.run(jobRead, "Check Device", t.checkADBDevice)
     })
 
     infoButton := widget.NewButton("Device Info", func() {
-        t.logOutput.SetText("")
-        go t.getADBInfo()
+        t.run(jobRead, "Device Info", t.getADBInfo)
     })
 
     rebootButton := widget.NewButton("Reboot", func() {
-        go t.adbReboot()
+        t.run(jobControl, "Reboot", t.adbReboot)
     })
 
     rebootFastbootButton := widget.NewButton("Reboot Fastboot", func() {
-        go t.adbRebootFastboot()
+        t.run(jobControl, "Reboot Fastboot", t.adbRebootFastboot)
     })
 
     rebootRecoveryButton := widget.NewButton("Reboot Recovery", func() {
-        go t.adbRebootRecovery()
+        t.run(jobControl, "Reboot Recovery", t.adbRebootRecovery)
+    })
+
+    rebootSideloadButton := widget.NewButton("Reboot Sideload", func() {
+        t.run(jobControl, "Reboot Sideload", t.adbRebootSideload)
     })
     diagButton := widget.NewButton("Enable DIAG", func() {
-        go t.adbEnableDiag()
+        t.run(jobControl, "Enable DIAG", t.adbEnableDiag)
+    })
+
+    wifiButton := widget.NewButton("Wi-Fi ADB", func() {
+        t.run(jobControl, "Wi-Fi ADB", t.adbEnableWifi)
     })
+    connectWifiButton := widget.NewButton("Connect Wi-Fi", t.showConnectWifiDialog)
+    disconnectWifiButton := widget.NewButton("Disconnect Wi-Fi", t.showDisconnectWifiDialog)
+    pairButton := widget.NewButton("Pair Device", t.showPairDialog)
+    nearbyButton := widget.NewButton("Nearby Devices", t.showNearbyDevices)
+
+    t.adbButtons = append(t.adbButtons, infoButton, rebootButton, rebootFastbootButton,
+        rebootRecoveryButton, rebootSideloadButton, diagButton, wifiButton)
 
     // Create grid layout for ADB buttons
-    return container.NewGridWithColumns(6,
+    return container.NewGridWithColumns(4,
         deviceButton,
         infoButton,
         rebootButton,
         rebootFastbootButton,
         rebootRecoveryButton,
+        rebootSideloadButton,
         diagButton,
+        wifiButton,
+        connectWifiButton,
+        disconnectWifiButton,
+        pairButton,
+        nearbyButton,
     )
 }
 
@@ -166,9 +294,25 @@ func (t *FlashTool) createFastbootTab() fyne.CanvasObject {
             if uri == nil {
                 return
             }
-            t.filePath = uri.URI().Path()
-            t.logOutput.SetText("")
+            path := uri.URI().Path()
+            uri.Close()
+            if isROMPackage(path) {
+                t.startLog()
+                t.openROMPackage(path)
+                return
+            }
+            // flash-all of a factory image ends in fastboot update
+            if factory, ok := isFactoryFlashAll(path); ok {
+                t.startLog()
+                t.openFactoryImage(factory)
+                return
+            }
+            t.filePath = path
+            t.startLog()
             t.appendLog("Selected file: " + filepath.Base(t.filePath))
+            t.confirmFlashPlan(t.filePath, func() {
+                t.run(jobDestructive, "Execute Batch", t.executeBatch)
+            })
         }, t.window)
     })
     
@@ -177,23 +321,29 @@ func (t *FlashTool) createFastbootTab() fyne.CanvasObject {
             dialog.ShowError(fmt.Errorf("please select a batch file first"), t.window)
             return
         }
-        go t.executeBatch()
+        // Nothing touches the phone before the plan is accepted
+        t.confirmFlashPlan(t.filePath, func() {
+            t.run(jobDestructive, "Execute Batch", t.executeBatch)
+        })
     })
     
     deviceButton := widget.NewButton("Check Device", func() {
-        t.logOutput.SetText("")
-        go t.checkFastbootDevice()
+        t.run(jobRead, "Check Device", t.checkFastbootDevice)
     })
 
     infoButton := widget.NewButton("Device Info", func() {
-        t.logOutput.SetText("")
-        go t.getFastbootInfo()
+        t.run(jobRead, "Device Info", t.getFastbootInfo)
     })
 
     fbRebootButton := widget.NewButton("FB Reboot", func() {
-        t.logOutput.SetText("")
-        go t.fastbootReboot()
+        t.run(jobControl, "FB Reboot", t.fastbootReboot)
     })
+    t.fastbootButtons = append(t.fastbootButtons, executeButton, infoButton, fbRebootButton)
+
+    t.connectIPButton = widget.NewButton("Connect by IP", t.showConnectIPDialog)
+    // Not a device button: it is meant for when several are connected
+    parallelButton := widget.NewButton("Flash Multiple", t.showParallelFlashDialog)
+
     // Create grid layout for fastboot buttons
     return container.NewGridWithColumns(6,
         fileButton,
@@ -201,17 +351,66 @@ func (t *FlashTool) createFastbootTab() fyne.CanvasObject {
         deviceButton,
         infoButton,
         fbRebootButton,
+        t.connectIPButton,
+        parallelButton,
     )
 }
 
 
+// Job panel showing what is running and what is waiting
+func (t *FlashTool) createJobPanel() fyne.CanvasObject {
+    t.jobList = widget.NewList(
+        func() int {
+            return len(t.jobStatuses)
+        },
+        func() fyne.CanvasObject {
+            return container.NewBorder(nil, nil, nil, widget.NewButton("✖", nil), widget.NewLabel(""))
+        },
+        func(id widget.ListItemID, item fyne.CanvasObject) {
+            status := t.jobStatuses[id]
+            row := item.(*fyne.Container)
+            row.Objects[0].(*widget.Label).SetText(status.String())
+            row.Objects[1].(*widget.Button).OnTapped = func() {
+                t.jobs.cancel(status.job)
+            }
+        },
+    )
+
+    // Keep elapsed time and step of running jobs current
+    go func() {
+        for range time.Tick(time.Second) {
+            if len(t.jobs.snapshot()) > 0 {
+                t.refreshJobs()
+            }
+        }
+    }()
 
+    title := widget.NewLabelWithStyle("Jobs", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+    width := canvas.NewRectangle(color.Transparent)
+    width.SetMinSize(fyne.NewSize(260, 0))
+    return container.NewStack(width, container.NewBorder(title, nil, nil, nil, t.jobList))
+}
 
+// appendLog is called from worker goroutines, so the widget is only
+// touched on the UI thread. fyne.Do keeps the calls in order.
 func (t *FlashTool) appendLog(message string) {
-    currentText := t.logOutput.Text
-    if currentText == "" {
-        t.logOutput.SetText(message)
-    } else {
-        t.logOutput.SetText(currentText + "\n" + message)
-    }
+    fyne.Do(func() {
+        currentText := t.logOutput.Text
+        if currentText == "" {
+            t.logOutput.SetText(message)
+        } else {
+            t.logOutput.SetText(currentText + "\n" + message)
+        }
+    })
+}
+
+// Log one line of live tool output
+func (t *FlashTool) appendOutput(line OutputLine) {
+    t.appendLog(line.String())
+}
+
+func (t *FlashTool) clearLog() {
+    fyne.Do(func() {
+        t.logOutput.SetText("")
+    })
 }
\ No newline at end of file
@@ -2,29 +2,59 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // Helper functions
-func getCommand(name string, args ...string) *exec.Cmd {
+func getCommand(ctx context.Context, toolDir, name string, args ...string) *exec.Cmd {
 	// Add .exe extension on Windows
 	if runtime.GOOS == "windows" && !strings.HasSuffix(name, ".exe") {
 		name = name + ".exe"
 	}
-	return exec.Command(name, args...)
+	// Prefer the configured platform-tools over whatever is on PATH
+	if toolDir != "" {
+		path := filepath.Join(toolDir, name)
+		if _, err := os.Stat(path); err == nil {
+			name = path
+		}
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	setupProcessTree(cmd)
+	// Children that outlive a killed parent must not keep Wait blocked
+	cmd.WaitDelay = 3 * time.Second
+	return cmd
 }
 
-func executeCommand(cmd *exec.Cmd) (string, error) {
+// executeCommand runs cmd and captures its output. When onLine is set,
+// every line is also passed on while the process is still running.
+func executeCommand(cmd *exec.Cmd, onLine func(OutputLine)) (string, string, int, error) {
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	
+
+	var outLines, errLines *lineWriter
+	if onLine != nil {
+		outLines, errLines = newLineWriters(onLine)
+		cmd.Stdout = io.MultiWriter(&stdout, outLines)
+		cmd.Stderr = io.MultiWriter(&stderr, errLines)
+	}
+
 	err := cmd.Run()
-	if err != nil {
-		return stderr.String(), err
+	if onLine != nil {
+		outLines.flush()
+		errLines.flush()
 	}
-	
-	return stdout.String(), nil
-}
\ No newline at end of file
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	return stdout.String(), stderr.String(), exitCode, err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deviceMode is the mode a phone is seen in by adb or fastboot
+type deviceMode string
+
+const (
+	modeNone     deviceMode = ""         // not visible at all
+	modeADB      deviceMode = "adb"      // adb reports "device", boot may still be running
+	modeBooted   deviceMode = "booted"   // adb device with sys.boot_completed=1
+	modeRecovery deviceMode = "recovery" // adb reports "recovery"
+	modeSideload deviceMode = "sideload" // adb reports "sideload"
+	modeFastboot deviceMode = "fastboot" // listed by fastboot devices
+	modeOffline  deviceMode = "offline"  // adb sees it but cannot talk to it yet
+)
+
+const (
+	waitPollInterval = time.Second
+	// A rebooting phone may drop off the bus before our first poll, so
+	// stop waiting for it to leave after this long
+	waitLeaveGrace = 15 * time.Second
+)
+
+// waitSettings are the "wait for device" options of the ADB tab
+type waitSettings struct {
+	mu      sync.Mutex
+	enabled bool
+	timeout time.Duration
+}
+
+func (w *waitSettings) get() (bool, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enabled, w.timeout
+}
+
+func (w *waitSettings) set(enabled bool, timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enabled = enabled
+	w.timeout = timeout
+}
+
+// deviceEntry is one line of "fastboot devices"
+type deviceEntry struct {
+	Serial string
+	State  string
+}
+
+func parseDeviceList(output string) []deviceEntry {
+	var entries []deviceEntry
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "List of devices") || strings.HasPrefix(line, "*") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) >= 2 {
+			entries = append(entries, deviceEntry{Serial: parts[0], State: parts[1]})
+		}
+	}
+	return entries
+}
+
+// adbStateMode maps an "adb devices" state to a device mode
+func adbStateMode(state string) deviceMode {
+	switch state {
+	case "device":
+		return modeADB
+	case "recovery":
+		return modeRecovery
+	case "sideload":
+		return modeSideload
+	}
+	return modeOffline
+}
+
+// currentMode looks for serial in adb and then in fastboot
+func (t *FlashTool) currentMode(ctx context.Context, serial string) deviceMode {
+	if devices, err := t.adbDevices(ctx); err == nil {
+		for _, device := range devices {
+			if device.Serial == serial {
+				return adbStateMode(device.State)
+			}
+		}
+	}
+	if result, err := t.fastboot(ctx, quickTimeout, "devices"); err == nil {
+		for _, entry := range parseDeviceList(result.Stdout) {
+			if entry.Serial == serial {
+				return modeFastboot
+			}
+		}
+	}
+	return modeNone
+}
+
+// bootCompleted asks a device in adb mode whether Android finished booting
+func (t *FlashTool) bootCompleted(ctx context.Context, serial string) bool {
+	result, err := t.adbShell(ctx, serial, "getprop sys.boot_completed")
+	return err == nil && strings.TrimSpace(result.Stdout) == "1"
+}
+
+// waitForMode follows serial after a reboot command until it shows up in
+// target. It first waits for the device to leave the mode it was in, so
+// the old session is not mistaken for the new one.
+func (t *FlashTool) waitForMode(ctx context.Context, serial string, from, target deviceMode, timeout time.Duration) (time.Duration, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	leaving := from != modeNone
+	last := from
+	t.appendLog(fmt.Sprintf("⏳ Waiting for %s to reach %s (timeout %s)...", serial, target, timeout))
+	for {
+		mode := t.currentMode(waitCtx, serial)
+		if leaving {
+			left := mode != from
+			if target == modeBooted {
+				// The old adb session still reports a finished boot, only
+				// the phone going down tells the reboot has started
+				left = mode == modeNone || mode == modeOffline
+			}
+			if left || time.Since(start) > waitLeaveGrace {
+				leaving = false
+			}
+		}
+		if !leaving && mode == modeADB && target == modeBooted && t.bootCompleted(waitCtx, serial) {
+			mode = modeBooted
+		}
+		if mode != last {
+			t.appendLog(fmt.Sprintf("   %5.1fs  %s", time.Since(start).Seconds(), describeMode(mode)))
+			last = mode
+		}
+
+		if !leaving && mode == target {
+			return time.Since(start), nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return time.Since(start), ctx.Err()
+			}
+			return time.Since(start), fmt.Errorf("%s did not reach %s within %s (last seen: %s)", serial, target, timeout, describeMode(last))
+		case <-ticker.C:
+		}
+	}
+}
+
+func describeMode(mode deviceMode) string {
+	if mode == modeNone {
+		return "disconnected"
+	}
+	return string(mode)
+}
+
+// waitAfterReboot waits for the target mode when the user asked for it
+// and reports how long the transition took
+func (t *FlashTool) waitAfterReboot(ctx context.Context, serial string, from, target deviceMode) error {
+	enabled, timeout := t.waitOptions.get()
+	if !enabled || serial == "" {
+		return nil
+	}
+	if isNetworkSerial(serial) {
+		// After a reboot the phone comes back under its USB or adb serial
+		t.appendLog("ℹ️ Not waiting for a network fastboot device, check the phone")
+		return nil
+	}
+	took, err := t.waitForMode(ctx, serial, from, target, timeout)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			t.appendLog(fmt.Sprintf("❌ %v", err))
+		}
+		return err
+	}
+	t.appendLog(fmt.Sprintf("✅ Device is in %s mode after %.1fs", target, took.Seconds()))
+	return nil
+}
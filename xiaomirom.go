@@ -0,0 +1,367 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// romMode is one way of flashing a Xiaomi fastboot ROM, each with its own
+// script in the package
+type romMode struct {
+	Script string // script name without extension
+	Label  string
+	Note   string
+}
+
+var xiaomiModes = []romMode{
+	{"flash_all", "Clean all", "Flashes everything and erases user data"},
+	{"flash_all_except_storage", "Save user data", "Flashes everything but keeps user data"},
+	{"flash_all_lock", "Clean all and lock", "⚠️ Erases user data and relocks the bootloader"},
+}
+
+// Written into the work folder once a package is fully extracted
+const romExtractedMarker = ".rsztool-extracted"
+
+// Folder names look like lavender_global_images_V12.5.5.0.QFGMIXM_20220712.0000.00_10.0_global
+var romFolderName = regexp.MustCompile(`^([a-z0-9]+)_(?:([a-z_]+?)_)?images_([^_]+)_(\d{8})`)
+
+// xiaomiROM is an extracted Xiaomi fastboot ROM
+type xiaomiROM struct {
+	Root     string
+	Codename string
+	Region   string
+	Version  string
+	Date     string
+	Scripts  map[string]string // mode script name -> script path
+}
+
+// Name describes the ROM the way the technician knows it
+func (r *xiaomiROM) Name() string {
+	name := strings.TrimSpace(r.Codename + " " + r.Version)
+	if r.Region != "" {
+		name += " (" + r.Region + ")"
+	}
+	if name == "" {
+		return filepath.Base(r.Root)
+	}
+	return name
+}
+
+// Archives a ROM comes in: Xiaomi .tgz, Google factory .zip
+var romPackageExts = []string{".tar.gz", ".tgz", ".zip"}
+
+// isROMPackage reports whether path looks like a ROM archive
+func isROMPackage(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range romPackageExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// romWorkDir is where a package is extracted: next to it, without the
+// archive extension
+func romWorkDir(pkg string) string {
+	lower := strings.ToLower(pkg)
+	for _, ext := range romPackageExts {
+		if strings.HasSuffix(lower, ext) {
+			return pkg[:len(pkg)-len(ext)]
+		}
+	}
+	return pkg + ".d"
+}
+
+// countingReader counts the compressed bytes read, for progress
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// extractPackage unpacks a ROM archive of either kind into dir
+func extractPackage(ctx context.Context, pkg, dir string, onProgress func(float64, string)) error {
+	if strings.HasSuffix(strings.ToLower(pkg), ".zip") {
+		return extractZip(ctx, pkg, dir, onProgress)
+	}
+	return extractROM(ctx, pkg, dir, onProgress)
+}
+
+// extractROM unpacks a .tgz into dir. onProgress gets the fraction of the
+// archive read and the file being written.
+func extractROM(ctx context.Context, pkg, dir string, onProgress func(float64, string)) error {
+	f, err := os.Open(pkg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	counter := &countingReader{r: bufio.NewReaderSize(f, 1<<20)}
+	gz, err := gzip.NewReader(counter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(pkg), err)
+	}
+	defer gz.Close()
+
+	// Incomplete extractions are never reused
+	os.Remove(filepath.Join(dir, romExtractedMarker))
+	archive := tar.NewReader(gz)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(pkg), err)
+		}
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: unsafe path %s", filepath.Base(pkg), header.Name)
+		}
+		target := filepath.Join(dir, name)
+		onProgress(float64(counter.n.Load())/float64(info.Size()), header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := writeROMFile(ctx, target, archive, header.FileInfo().Mode().Perm()|0o600); err != nil {
+				return err
+			}
+			onProgress(float64(counter.n.Load())/float64(info.Size()), header.Name)
+		}
+	}
+	onProgress(1, "")
+	return os.WriteFile(filepath.Join(dir, romExtractedMarker), []byte(filepath.Base(pkg)+"\n"), 0o644)
+}
+
+func writeROMFile(ctx context.Context, path string, r io.Reader, mode os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	for {
+		if ctx.Err() != nil {
+			out.Close()
+			return ctx.Err()
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := out.Write(buf[:n]); werr != nil {
+				out.Close()
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// findXiaomiROM looks for the folder holding the flash scripts in dir or
+// the folder the archive unpacked into
+func findXiaomiROM(dir string) (*xiaomiROM, error) {
+	candidates := []string{dir}
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				candidates = append(candidates, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	for _, root := range candidates {
+		if scripts := romScripts(root); len(scripts) > 0 {
+			rom := &xiaomiROM{Root: root, Scripts: scripts}
+			rom.readInfo()
+			return rom, nil
+		}
+	}
+	return nil, fmt.Errorf("no flash_all script in %s", filepath.Base(dir))
+}
+
+// romScripts finds the script of every mode, preferring the one native
+// to this OS
+func romScripts(root string) map[string]string {
+	exts := []string{".sh", ".bat"}
+	if runtime.GOOS == "windows" {
+		exts = []string{".bat", ".sh"}
+	}
+	scripts := map[string]string{}
+	for _, mode := range xiaomiModes {
+		for _, ext := range exts {
+			path := filepath.Join(root, mode.Script+ext)
+			if _, err := os.Stat(path); err == nil {
+				scripts[mode.Script] = path
+				break
+			}
+		}
+	}
+	return scripts
+}
+
+// readInfo takes codename and version from the folder name, then from
+// misc.txt where the package has one
+func (r *xiaomiROM) readInfo() {
+	if m := romFolderName.FindStringSubmatch(filepath.Base(r.Root)); m != nil {
+		r.Codename, r.Region, r.Version, r.Date = m[1], m[2], m[3], m[4]
+	}
+	for _, path := range []string{filepath.Join(r.Root, "misc.txt"), filepath.Join(r.Root, "images", "misc.txt")} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if !ok {
+				continue
+			}
+			key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch key {
+			case "device", "codename", "product":
+				r.Codename = value
+			case "version", "rom_version", "build_version", "miui_version":
+				r.Version = value
+			}
+		}
+		break
+	}
+}
+
+// openROMPackage extracts a ROM package, or reuses an earlier extraction,
+// and lets the technician pick how to flash it
+func (t *FlashTool) openROMPackage(pkg string) {
+	dir := romWorkDir(pkg)
+	if _, err := os.Stat(filepath.Join(dir, romExtractedMarker)); err == nil {
+		t.appendLog("📦 Using the already extracted " + dir)
+		t.openROMFolder(dir)
+		return
+	}
+	t.appendLog(fmt.Sprintf("📦 Extracting %s into %s", filepath.Base(pkg), dir))
+	t.extractWithProgress(pkg, dir, func() { t.openROMFolder(dir) })
+}
+
+// extractWithProgress extracts pkg into dir behind a cancellable progress
+// dialog and calls done on the UI thread when it succeeded
+func (t *FlashTool) extractWithProgress(pkg, dir string, done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bar := widget.NewProgressBar()
+	file := widget.NewLabel("")
+	file.Truncation = fyne.TextTruncateEllipsis
+	d := dialog.NewCustom("Extracting "+filepath.Base(pkg), "Cancel", container.NewVBox(bar, file), t.window)
+	d.SetOnClosed(cancel)
+	d.Resize(fyne.NewSize(520, 160))
+	d.Show()
+
+	go func() {
+		err := extractPackage(ctx, pkg, dir, func(fraction float64, name string) {
+			fyne.Do(func() {
+				bar.SetValue(fraction)
+				file.SetText(name)
+			})
+		})
+		stopped := ctx.Err() != nil
+		// Hiding runs the cancel set as OnClosed, harmless by now
+		fyne.Do(d.Hide)
+		switch {
+		case stopped:
+			t.appendLog("⛔ Extraction cancelled")
+		case err != nil:
+			t.appendLog(fmt.Sprintf("❌ Extraction failed: %v", err))
+		default:
+			t.appendLog("✅ Extracted")
+			fyne.Do(done)
+		}
+	}()
+}
+
+// openROMFolder shows the ROM's details and its flash modes
+func (t *FlashTool) openROMFolder(dir string) {
+	if factory, err := findFactoryImage(dir); err == nil {
+		t.openFactoryImage(factory)
+		return
+	}
+	rom, err := findXiaomiROM(dir)
+	if err != nil {
+		dialog.ShowError(err, t.window)
+		return
+	}
+	t.appendLog("📱 ROM: " + rom.Name())
+
+	var labels []string
+	modes := map[string]romMode{}
+	for _, mode := range xiaomiModes {
+		if _, ok := rom.Scripts[mode.Script]; ok {
+			label := mode.Label + " - " + mode.Note
+			labels = append(labels, label)
+			modes[label] = mode
+		}
+	}
+	choice := widget.NewRadioGroup(labels, nil)
+	choice.SetSelected(labels[0])
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Device", widget.NewLabel(rom.Codename)),
+		widget.NewFormItem("Version", widget.NewLabel(rom.Version)),
+	}
+	if rom.Region != "" {
+		items = append(items, widget.NewFormItem("Region", widget.NewLabel(rom.Region)))
+	}
+	items = append(items, widget.NewFormItem("Mode", choice))
+	dialog.ShowForm("Flash "+rom.Name(), "Next", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		mode, found := modes[choice.Selected]
+		if !found {
+			dialog.ShowError(errors.New("choose a flash mode"), t.window)
+			return
+		}
+		t.filePath = rom.Scripts[mode.Script]
+		t.appendLog(fmt.Sprintf("Selected mode: %s (%s)", mode.Label, filepath.Base(t.filePath)))
+		t.confirmFlashPlan(t.filePath, func() {
+			t.run(jobDestructive, "Execute Batch", t.executeBatch)
+		})
+	}, t.window)
+}
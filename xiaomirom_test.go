@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveMember is one file of a test package, a folder when body is nil
+type archiveMember struct {
+	name string
+	body []byte
+}
+
+func writeTestTgz(t *testing.T, path string, members []archiveMember) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, m := range members {
+		header := &tar.Header{Name: m.name, Mode: 0o644, Size: int64(len(m.body)), Typeflag: tar.TypeReg}
+		if m.body == nil {
+			header.Typeflag, header.Mode = tar.TypeDir, 0o755
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write(m.body)
+	}
+	archive.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// romMembers is a tiny Xiaomi fastboot ROM
+var romMembers = []archiveMember{
+	{name: "lavender_global_images_V12.5.5.0.QFGMIXM_20220712.0000.00_10.0_global/"},
+	{name: "lavender_global_images_V12.5.5.0.QFGMIXM_20220712.0000.00_10.0_global/flash_all.sh", body: []byte("fastboot $* flash boot `dirname $0`/images/boot.img\n")},
+	{name: "lavender_global_images_V12.5.5.0.QFGMIXM_20220712.0000.00_10.0_global/images/boot.img", body: bytes.Repeat([]byte{1}, 4096)},
+}
+
+func TestExtractROM(t *testing.T) {
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "lavender.tgz")
+	writeTestTgz(t, pkg, romMembers)
+	work := romWorkDir(pkg)
+
+	var last float64
+	var names []string
+	err := extractPackage(context.Background(), pkg, work, func(fraction float64, name string) {
+		last = fraction
+		if name != "" && (len(names) == 0 || names[len(names)-1] != name) {
+			names = append(names, name)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 1 || len(names) != 3 {
+		t.Errorf("progress ended at %v, files %q", last, names)
+	}
+	boot, _ := os.ReadFile(filepath.Join(work, filepath.FromSlash(romMembers[2].name)))
+	if !bytes.Equal(boot, romMembers[2].body) {
+		t.Errorf("boot.img has %d bytes", len(boot))
+	}
+	if marker, _ := os.ReadFile(filepath.Join(work, romExtractedMarker)); string(marker) != "lavender.tgz\n" {
+		t.Errorf("marker = %q", marker)
+	}
+	rom, err := findXiaomiROM(work)
+	if err != nil || rom.Codename != "lavender" || rom.Scripts["flash_all"] == "" {
+		t.Errorf("rom = %+v, %v", rom, err)
+	}
+}
+
+func TestExtractROMUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../evil.sh", "images/../../evil.sh", "/tmp/evil.sh"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			pkg := filepath.Join(dir, "rom", "lavender.tgz")
+			os.MkdirAll(filepath.Dir(pkg), 0o755)
+			writeTestTgz(t, pkg, []archiveMember{{name: "flash_all.sh", body: []byte("x")}, {name: name, body: []byte("x")}})
+			err := extractROM(context.Background(), pkg, romWorkDir(pkg), func(float64, string) {})
+			if err == nil || !strings.Contains(err.Error(), "unsafe path") {
+				t.Errorf("err = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil.sh")); err == nil {
+				t.Error("a file was written outside the work folder")
+			}
+			if _, err := os.Stat(filepath.Join(romWorkDir(pkg), romExtractedMarker)); err == nil {
+				t.Error("the failed extraction was marked complete")
+			}
+		})
+	}
+}
+
+func TestExtractROMNeverReusesPartial(t *testing.T) {
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "lavender.tgz")
+	writeTestTgz(t, pkg, romMembers)
+	work := romWorkDir(pkg)
+	if err := extractROM(context.Background(), pkg, work, func(float64, string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Extracting again takes the marker away first, a run that stops half
+	// way leaves the folder unmarked
+	data, _ := os.ReadFile(pkg)
+	os.WriteFile(pkg, data[:len(data)/2], 0o644)
+	if err := extractROM(context.Background(), pkg, work, func(float64, string) {}); err == nil {
+		t.Fatal("a truncated package extracted")
+	}
+	if _, err := os.Stat(filepath.Join(work, romExtractedMarker)); err == nil {
+		t.Error("a truncated extraction was marked complete")
+	}
+
+	writeTestTgz(t, pkg, romMembers)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := extractROM(ctx, pkg, work, func(float64, string) { cancel() })
+	if err != context.Canceled {
+		t.Errorf("err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(work, romExtractedMarker)); err == nil {
+		t.Error("a cancelled extraction was marked complete")
+	}
+}